@@ -0,0 +1,99 @@
+package conf
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The functions aggregating the samples of a metric over a window
+const (
+	AggregationAvg  = "avg"
+	AggregationMax  = "max"
+	AggregationMin  = "min"
+	AggregationLast = "last"
+	// The prefix of the percentiles, e.g., p95
+	AggregationPercentilePrefix = "p"
+)
+
+// AggregationConf requests the samples of a metric over a window to be aggregated into the used and the peak values
+type AggregationConf struct {
+	// The function aggregating the samples into the used value: avg, max, min, last or a percentile such as p95
+	Used string `json:"used"`
+	// The function aggregating the samples into the peak value; no peak is reported if it is empty
+	Peak string `json:"peak,omitempty"`
+	// The window of the samples, e.g., 10m; the discovery interval if not set
+	Window string `json:"window,omitempty"`
+
+	window time.Duration
+}
+
+// DefaultAggregation is the aggregation of the exporters reporting both the average and the peak values by default
+func DefaultAggregation() *AggregationConf {
+	return &AggregationConf{
+		Used: AggregationAvg,
+		Peak: AggregationMax,
+	}
+}
+
+// WindowOr returns the window of the samples, or the given default if it is not configured
+func (a *AggregationConf) WindowOr(defaultWindow time.Duration) time.Duration {
+	if a.window > 0 {
+		return a.window
+	}
+	return defaultWindow
+}
+
+func (a *AggregationConf) validate() error {
+	if err := validateAggregation(a.Used); err != nil {
+		return err
+	}
+
+	if a.Peak != "" {
+		if err := validateAggregation(a.Peak); err != nil {
+			return err
+		}
+	}
+
+	if a.Window != "" {
+		window, err := time.ParseDuration(a.Window)
+		if err != nil {
+			return fmt.Errorf("invalid aggregation window %q: %v", a.Window, err)
+		}
+		if window <= 0 {
+			return fmt.Errorf("aggregation window must be positive")
+		}
+		a.window = window
+	}
+
+	return nil
+}
+
+func validateAggregation(fn string) error {
+	switch fn {
+	case AggregationAvg, AggregationMax, AggregationMin, AggregationLast:
+		return nil
+	}
+
+	if _, ok := ParsePercentile(fn); ok {
+		return nil
+	}
+
+	return fmt.Errorf("unknown aggregation %q", fn)
+}
+
+// ParsePercentile returns the percentile, e.g., 95 for p95, if the aggregation is a percentile in (0, 100]
+func ParsePercentile(fn string) (float64, bool) {
+	if !strings.HasPrefix(fn, AggregationPercentilePrefix) {
+		return 0, false
+	}
+
+	p, err := strconv.ParseFloat(strings.TrimPrefix(fn, AggregationPercentilePrefix), 64)
+	if err != nil || math.IsNaN(p) || p <= 0 || p > 100 {
+		return 0, false
+	}
+
+	return p, true
+}
@@ -5,17 +5,62 @@ import (
 )
 
 const (
-	defaultDiscoveryIntervalSec = 600
+	// The policies of connecting to the Turbo server when some metric exporters are not ready at startup:
+	// exit unless all of them are ready, wait for them and connect anyway, or connect without waiting
+	ReadinessPolicyAll  = "all"
+	ReadinessPolicyAny  = "any"
+	ReadinessPolicyNone = "none"
+)
+
+const (
+	defaultDiscoveryIntervalSec   = 600
+	defaultDiscoveryTimeoutSec    = 120
+	defaultExporterMaxRetries     = 3
+	defaultExporterRetryBackoffMs = 500
+	defaultExporterConcurrency    = 4
+	defaultReadinessTimeoutSec    = 60
+	defaultReadinessPolicy        = ReadinessPolicyAny
+	defaultExporterCacheTTLSec    = 0
+	defaultCapacityHistoryFile    = ""
+	defaultSLODir                 = ""
 )
 
 type PrometurboArgs struct {
-	DiscoveryIntervalSec *int
+	DiscoveryIntervalSec   *int
+	DiscoveryTimeoutSec    *int
+	ExporterMaxRetries     *int
+	ExporterRetryBackoffMs *int
+	ExporterConcurrency    *int
+	ReadinessTimeoutSec    *int
+	ReadinessPolicy        *string
+	ExporterCacheTTLSec    *int
+	CapacityHistoryFile    *string
+	SLODir                 *string
 }
 
 func NewPrometurboArgs(fs *flag.FlagSet) *PrometurboArgs {
 	p := &PrometurboArgs{}
 
 	p.DiscoveryIntervalSec = fs.Int("discovery-interval-sec", defaultDiscoveryIntervalSec, "The discovery interval in seconds")
+	p.DiscoveryTimeoutSec = fs.Int("discovery-timeout-sec", defaultDiscoveryTimeoutSec,
+		"The timeout in seconds of querying the metric exporters in each discovery, including the retries")
+	p.ExporterMaxRetries = fs.Int("exporter-max-retries", defaultExporterMaxRetries,
+		"The max number of retries of a request to a metric exporter failed with a transient error")
+	p.ExporterRetryBackoffMs = fs.Int("exporter-retry-backoff-ms", defaultExporterRetryBackoffMs,
+		"The delay in milliseconds before the first retry, which doubles on each retry")
+	p.ExporterConcurrency = fs.Int("exporter-concurrency", defaultExporterConcurrency,
+		"The max number of metric exporters queried at the same time in each discovery")
+	p.ReadinessTimeoutSec = fs.Int("exporter-readiness-timeout-sec", defaultReadinessTimeoutSec,
+		"The time in seconds to wait for the metric exporters to be ready at startup")
+	p.ReadinessPolicy = fs.String("exporter-readiness-policy", defaultReadinessPolicy,
+		"Whether to exit unless all the metric exporters are ready (all), wait for them and start anyway (any), "+
+			"or start without waiting (none)")
+	p.ExporterCacheTTLSec = fs.Int("exporter-cache-ttl-sec", defaultExporterCacheTTLSec,
+		"The time in seconds to serve the last metrics of a failing metric exporter; no cache if 0")
+	p.CapacityHistoryFile = fs.String("capacity-history-file", defaultCapacityHistoryFile,
+		"The file persisting the history of the metrics for the capacity inference; kept in memory only if empty")
+	p.SLODir = fs.String("slo-dir", defaultSLODir,
+		"The directory of the OpenSLO and Sloth specs whose targets become the capacities of the matching entities")
 
 	return p
 }
@@ -0,0 +1,43 @@
+package conf
+
+import (
+	"fmt"
+)
+
+// AuthConf is the settings to authenticate with a metric exporter
+type AuthConf struct {
+	// The basic auth credentials
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// The file of the bearer token, which is reloaded when it changes
+	BearerTokenFile string `json:"bearerTokenFile,omitempty"`
+	// The TLS settings, including the client certificate and the CA bundle
+	TLS *TLSConf `json:"tlsConfig,omitempty"`
+}
+
+type TLSConf struct {
+	// The CA bundle to verify the server certificate
+	CAFile string `json:"caFile,omitempty"`
+	// The client certificate and key
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	// The server name to verify the server certificate with
+	ServerName         string `json:"serverName,omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+}
+
+func (a *AuthConf) validate() error {
+	if a.Username == "" && a.Password != "" {
+		return fmt.Errorf("password is set without username")
+	}
+
+	if a.Username != "" && a.BearerTokenFile != "" {
+		return fmt.Errorf("at most one of basic auth and bearer token can be configured")
+	}
+
+	if a.TLS != nil && (a.TLS.CertFile == "") != (a.TLS.KeyFile == "") {
+		return fmt.Errorf("both certFile and keyFile must be configured for the client certificate")
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package conf
+
+import (
+	"fmt"
+	"github.com/turbonomic/turbo-go-sdk/pkg/proto"
+)
+
+const (
+	defaultCallSourceLabel      = "source_workload"
+	defaultCallDestinationLabel = "destination_workload"
+	defaultCallLatencyUnit      = "ms"
+)
+
+// CallGraphConf declares the queries of the calls between the applications, e.g., from the istio metrics,
+// from which each calling application buys the transactions and the response times of the applications it calls.
+// The applications are identified by the values of the source and the destination labels, which must be the UIDs
+// of the APPLICATION entities.
+type CallGraphConf struct {
+	// The query of the request rates of the calls, aggregated by the source and the destination labels, e.g.,
+	// sum(rate(istio_requests_total{reporter="destination"}[1m])) by (source_workload, destination_workload)
+	Query string `json:"query"`
+	// The query of the response times of the calls, aggregated by the source and the destination labels
+	LatencyQuery string `json:"latencyQuery,omitempty"`
+	// The unit of the response times; ms by default
+	LatencyUnit string `json:"latencyUnit,omitempty"`
+	// The label of the calling applications; source_workload by default
+	SourceLabel string `json:"sourceLabel,omitempty"`
+	// The label of the called applications; destination_workload by default
+	DestinationLabel string `json:"destinationLabel,omitempty"`
+}
+
+func (c *CallGraphConf) validate() error {
+	if c.Query == "" {
+		return fmt.Errorf("missing query")
+	}
+
+	if c.LatencyUnit == "" {
+		c.LatencyUnit = defaultCallLatencyUnit
+	}
+	target, _ := CommodityUnit(proto.CommodityDTO_RESPONSE_TIME)
+	if _, err := ConvertUnit(0, c.LatencyUnit, target); err != nil {
+		return fmt.Errorf("invalid latencyUnit: %v", err)
+	}
+
+	if c.SourceLabel == "" {
+		c.SourceLabel = defaultCallSourceLabel
+	}
+	if c.DestinationLabel == "" {
+		c.DestinationLabel = defaultCallDestinationLabel
+	}
+	if c.SourceLabel == c.DestinationLabel {
+		return fmt.Errorf("sourceLabel and destinationLabel must be different")
+	}
+
+	return nil
+}
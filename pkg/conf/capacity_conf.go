@@ -0,0 +1,68 @@
+package conf
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	defaultInferenceWindow   = 7 * 24 * time.Hour
+	defaultInferenceHeadroom = 1.0
+)
+
+// CapacityInferenceConf requests the capacity of a commodity of each entity to be inferred from the history
+// of the used and the peak values observed across the discoveries
+type CapacityInferenceConf struct {
+	// The function aggregating the history into the capacity: max (the default) for the high-water mark,
+	// or a percentile such as p99
+	Method string `json:"method,omitempty"`
+	// The factor multiplied to the aggregated history, e.g., 1.2 for 20% of headroom; 1 by default
+	Headroom float64 `json:"headroom,omitempty"`
+	// The min capacity, in the unit of the metric
+	Floor float64 `json:"floor,omitempty"`
+	// The window of the history, e.g., 24h; 7 days by default
+	Window string `json:"window,omitempty"`
+
+	window time.Duration
+}
+
+// HistoryWindow returns the window of the history kept for the inference
+func (c *CapacityInferenceConf) HistoryWindow() time.Duration {
+	if c.window > 0 {
+		return c.window
+	}
+	return defaultInferenceWindow
+}
+
+func (c *CapacityInferenceConf) validate() error {
+	if c.Method == "" {
+		c.Method = AggregationMax
+	}
+	if err := validateAggregation(c.Method); err != nil {
+		return fmt.Errorf("invalid method: %v", err)
+	}
+
+	if c.Headroom == 0 {
+		c.Headroom = defaultInferenceHeadroom
+	}
+	if c.Headroom < 0 {
+		return fmt.Errorf("headroom must be positive")
+	}
+
+	if c.Floor < 0 {
+		return fmt.Errorf("floor must not be negative")
+	}
+
+	if c.Window != "" {
+		window, err := time.ParseDuration(c.Window)
+		if err != nil {
+			return fmt.Errorf("invalid window %q: %v", c.Window, err)
+		}
+		if window <= 0 {
+			return fmt.Errorf("window must be positive")
+		}
+		c.window = window
+	}
+
+	return nil
+}
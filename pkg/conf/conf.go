@@ -11,13 +11,34 @@ import (
 const (
 	LocalDebugConfPath = "configs/prometurbo-config.json"
 	DefaultConfPath    = "/etc/prometurbo/turbo.config"
-	defaultEndpoint    = "http://localhost:8081/pod/metrics"
+
+	// The types of the metric exporter
+	PrometheusExporterType  = "prometheus"
+	AppMetricExporterType   = "appmetric"
+	ScrapeExporterType      = "scrape"
+	RemoteReadExporterType  = "remoteRead"
+	RemoteWriteReceiverType = "remoteWrite"
 )
 
 type PrometurboConf struct {
-	Communicator           *service.TurboCommunicationConfig `json:"communicationConfig,omitempty"`
-	TargetConf             *PrometurboTargetConf             `json:"prometurboTargetConfig,omitempty"`
-	MetricExporterEndpoint string                            `json:"metricExporterEndpoint,omitempty"`
+	Communicator *service.TurboCommunicationConfig `json:"communicationConfig,omitempty"`
+	TargetConf   *PrometurboTargetConf             `json:"prometurboTargetConfig,omitempty"`
+	// The metric exporters queried in each discovery
+	MetricExporters []*ExporterConf `json:"metricExporters,omitempty"`
+
+	// The single exporter settings below are kept for backward compatibility, and
+	// are converted to MetricExporters if MetricExporters is not set.
+
+	// The endpoint of the appmetric exporter. If it is not set, the Prometheus server
+	// at the target address is queried directly.
+	MetricExporterEndpoint string `json:"metricExporterEndpoint,omitempty"`
+	// The type of the exporter at MetricExporterEndpoint: appmetric (default), scrape, which
+	// scrapes the endpoint in the Prometheus text exposition or the OpenMetrics format, or
+	// remoteRead, which reads the samples of the discovery interval with the remote read protocol, or
+	// remoteWrite, which listens on the endpoint (host:port) for the samples pushed by Prometheus
+	MetricExporterType string `json:"metricExporterType,omitempty"`
+	// The settings to authenticate with the metric exporter
+	MetricExporterAuth *AuthConf `json:"metricExporterAuth,omitempty"`
 }
 
 type PrometurboTargetConf struct {
@@ -34,10 +55,6 @@ func NewPrometurboConf(configFilePath string) (*PrometurboConf, error) {
 		return nil, err
 	}
 
-	if config.MetricExporterEndpoint == "" {
-		config.MetricExporterEndpoint = defaultEndpoint
-	}
-
 	if config.Communicator == nil {
 		return nil, fmt.Errorf("Unable to read the turbo communication config from %s", configFilePath)
 	}
@@ -46,16 +63,83 @@ func NewPrometurboConf(configFilePath string) (*PrometurboConf, error) {
 		return nil, fmt.Errorf("Unable to read the target config from %s", configFilePath)
 	}
 
+	if len(config.MetricExporters) == 0 {
+		exporterConf, err := config.singleExporterConf()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid metric exporter config in %s: %v", configFilePath, err)
+		}
+		config.MetricExporters = []*ExporterConf{exporterConf}
+	} else if config.MetricExporterEndpoint != "" || config.MetricExporterType != "" || config.MetricExporterAuth != nil {
+		return nil, fmt.Errorf("Both metricExporters and the single metric exporter are configured in %s", configFilePath)
+	}
+
+	if err := config.validateExporters(); err != nil {
+		return nil, fmt.Errorf("Invalid metric exporter config in %s: %v", configFilePath, err)
+	}
+
 	return config, nil
 }
 
+// singleExporterConf converts the single metric exporter settings to the exporter config
+func (c *PrometurboConf) singleExporterConf() (*ExporterConf, error) {
+	if c.MetricExporterEndpoint == "" {
+		return &ExporterConf{
+			Name:     PrometheusExporterType,
+			Type:     PrometheusExporterType,
+			Endpoint: c.TargetConf.Address,
+			Auth:     c.MetricExporterAuth,
+		}, nil
+	}
+
+	exporterType := c.MetricExporterType
+	switch exporterType {
+	case "":
+		exporterType = AppMetricExporterType
+	case AppMetricExporterType, ScrapeExporterType, RemoteReadExporterType, RemoteWriteReceiverType:
+	default:
+		return nil, fmt.Errorf("unsupported metric exporter type %s", exporterType)
+	}
+
+	return &ExporterConf{
+		Name:     exporterType,
+		Type:     exporterType,
+		Endpoint: c.MetricExporterEndpoint,
+		Auth:     c.MetricExporterAuth,
+	}, nil
+}
+
+func (c *PrometurboConf) validateExporters() error {
+	names := make(map[string]bool)
+	enabled := false
+	for i, e := range c.MetricExporters {
+		if e.Name == "" {
+			e.Name = fmt.Sprintf("%s-%d", e.Type, i)
+		}
+		if names[e.Name] {
+			return fmt.Errorf("duplicate metric exporter name %s", e.Name)
+		}
+		names[e.Name] = true
+
+		if err := e.validate(); err != nil {
+			return err
+		}
+		enabled = enabled || e.IsEnabled()
+	}
+
+	if !enabled {
+		return fmt.Errorf("no metric exporter is enabled")
+	}
+
+	return nil
+}
+
 func readConfig(path string) (*PrometurboConf, error) {
 	file, err := ioutil.ReadFile(path)
 	if err != nil {
 		glog.Errorf("File error: %v\n", err)
 		return nil, err
 	}
-	glog.Infoln(string(file))
+	// The raw file isn't logged as it has the credentials of the exporters
 
 	var config PrometurboConf
 	err = json.Unmarshal(file, &config)
@@ -0,0 +1,140 @@
+package conf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConf(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "turbo.config")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNewPrometurboConf_SingleExporter(t *testing.T) {
+	tests := []struct {
+		name     string
+		exporter string
+		wantType string
+		wantURL  string
+	}{
+		{
+			name:     "prometheus server at the target address",
+			exporter: ``,
+			wantType: PrometheusExporterType,
+			wantURL:  "http://prometheus:9090",
+		},
+		{
+			name:     "appmetric by default",
+			exporter: `, "metricExporterEndpoint": "http://localhost:8081/pod/metrics"`,
+			wantType: AppMetricExporterType,
+			wantURL:  "http://localhost:8081/pod/metrics",
+		},
+		{
+			name:     "typed exporter",
+			exporter: `, "metricExporterEndpoint": "http://localhost:8081/metrics", "metricExporterType": "scrape"`,
+			wantType: ScrapeExporterType,
+			wantURL:  "http://localhost:8081/metrics",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConf(t, `{
+				"communicationConfig": {},
+				"prometurboTargetConfig": {"targetAddress": "http://prometheus:9090", "scope": "k8s"}`+tt.exporter+`
+			}`)
+			defer os.RemoveAll(filepath.Dir(path))
+
+			config, err := NewPrometurboConf(path)
+			if err != nil {
+				t.Fatalf("NewPrometurboConf() error = %v", err)
+			}
+
+			if len(config.MetricExporters) != 1 {
+				t.Fatalf("Expected 1 metric exporter but got %d", len(config.MetricExporters))
+			}
+			e := config.MetricExporters[0]
+			if e.Type != tt.wantType || e.Endpoint != tt.wantURL || !e.IsEnabled() {
+				t.Errorf("Got metric exporter %+v, want type %s at %s", e, tt.wantType, tt.wantURL)
+			}
+		})
+	}
+}
+
+func TestNewPrometurboConf_MetricExporters(t *testing.T) {
+	path := writeConf(t, `{
+		"communicationConfig": {},
+		"prometurboTargetConfig": {"targetAddress": "http://prometheus:9090", "scope": "k8s"},
+		"metricExporters": [
+			{"name": "prom", "type": "prometheus", "endpoint": "http://prometheus:9090", "timeout": "30s"},
+			{"type": "scrape", "endpoint": "http://app:8080/metrics", "scope": "other",
+			 "auth": {"bearerTokenFile": "/var/run/token"}},
+			{"name": "old", "type": "appmetric", "endpoint": "http://appmetric:8081", "enabled": false}
+		]
+	}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	config, err := NewPrometurboConf(path)
+	if err != nil {
+		t.Fatalf("NewPrometurboConf() error = %v", err)
+	}
+
+	exporters := config.MetricExporters
+	if len(exporters) != 3 {
+		t.Fatalf("Expected 3 metric exporters but got %d", len(exporters))
+	}
+
+	if exporters[0].QueryTimeout() != 30*time.Second {
+		t.Errorf("Timeout of %s = %v, want 30s", exporters[0].Name, exporters[0].QueryTimeout())
+	}
+
+	if exporters[1].Name != "scrape-1" || exporters[1].Scope != "other" || exporters[1].Auth == nil {
+		t.Errorf("Got metric exporter %+v", exporters[1])
+	}
+
+	if exporters[2].IsEnabled() {
+		t.Errorf("Metric exporter %s is expected to be disabled", exporters[2].Name)
+	}
+}
+
+func TestNewPrometurboConf_InvalidMetricExporters(t *testing.T) {
+	tests := map[string]string{
+		"unknown type":    `"metricExporters": [{"type": "foo", "endpoint": "http://foo"}]`,
+		"no endpoint":     `"metricExporters": [{"type": "scrape"}]`,
+		"invalid timeout": `"metricExporters": [{"type": "scrape", "endpoint": "http://foo", "timeout": "30"}]`,
+		"duplicate name": `"metricExporters": [{"name": "a", "type": "scrape", "endpoint": "http://foo"},
+			{"name": "a", "type": "scrape", "endpoint": "http://bar"}]`,
+		"all disabled":   `"metricExporters": [{"type": "scrape", "endpoint": "http://foo", "enabled": false}]`,
+		"both forms":     `"metricExporters": [{"type": "scrape", "endpoint": "http://foo"}], "metricExporterEndpoint": "http://bar"`,
+		"single unknown": `"metricExporterEndpoint": "http://foo", "metricExporterType": "foo"`,
+		"remoteWrite auth": `"metricExporters": [{"type": "remoteWrite", "endpoint": ":8081",
+			"auth": {"username": "a", "password": "b"}}]`,
+		"single remoteWrite auth": `"metricExporterEndpoint": ":8081", "metricExporterType": "remoteWrite",
+			"metricExporterAuth": {"tlsConfig": {"insecureSkipVerify": true}}`,
+	}
+
+	for name, exporters := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := writeConf(t, `{
+				"communicationConfig": {},
+				"prometurboTargetConfig": {"targetAddress": "http://prometheus:9090", "scope": "k8s"},
+				`+exporters+`
+			}`)
+			defer os.RemoveAll(filepath.Dir(path))
+
+			if _, err := NewPrometurboConf(path); err == nil {
+				t.Errorf("NewPrometurboConf() expected an error")
+			}
+		})
+	}
+}
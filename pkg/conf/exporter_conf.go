@@ -0,0 +1,92 @@
+package conf
+
+import (
+	"fmt"
+	"time"
+)
+
+// ExporterConf is the settings of a metric exporter
+type ExporterConf struct {
+	// The name of the exporter, which identifies it in the logs
+	Name string `json:"name"`
+	// The exporter type: prometheus, which queries the Prometheus server at the endpoint directly,
+	// appmetric, scrape, remoteRead or remoteWrite
+	Type string `json:"type"`
+	// The endpoint of the exporter, or the address (host:port) listened on by the remoteWrite receiver
+	Endpoint string `json:"endpoint"`
+	// The settings to authenticate with the exporter
+	Auth *AuthConf `json:"auth,omitempty"`
+	// The timeout of querying the exporter, e.g., 30s, which is bounded by the discovery timeout
+	Timeout string `json:"timeout,omitempty"`
+	// The scope of the entities built from the exporter, which overrides the scope of the target
+	Scope string `json:"scope,omitempty"`
+	// The exporter is not queried if it is false; enabled by default
+	Enabled *bool `json:"enabled,omitempty"`
+	// How long the metrics of the last successful query are served when the queries fail, e.g., 30m,
+	// which overrides the --exporter-cache-ttl-sec flag
+	CacheTTL string `json:"cacheTTL,omitempty"`
+
+	timeout  time.Duration
+	cacheTTL time.Duration
+}
+
+// QueryTimeout returns the timeout of querying the exporter, which is 0 if not configured
+func (e *ExporterConf) QueryTimeout() time.Duration {
+	return e.timeout
+}
+
+// MetricCacheTTL returns the TTL of the cached metrics, and whether it is configured
+func (e *ExporterConf) MetricCacheTTL() (time.Duration, bool) {
+	return e.cacheTTL, e.CacheTTL != ""
+}
+
+func (e *ExporterConf) IsEnabled() bool {
+	return e.Enabled == nil || *e.Enabled
+}
+
+func (e *ExporterConf) validate() error {
+	switch e.Type {
+	case PrometheusExporterType, AppMetricExporterType, ScrapeExporterType, RemoteReadExporterType,
+		RemoteWriteReceiverType:
+	default:
+		return fmt.Errorf("unsupported type %q of metric exporter %s", e.Type, e.Name)
+	}
+
+	if e.Endpoint == "" {
+		return fmt.Errorf("missing endpoint of metric exporter %s", e.Name)
+	}
+
+	if e.Timeout != "" {
+		timeout, err := time.ParseDuration(e.Timeout)
+		if err != nil {
+			return fmt.Errorf("invalid timeout %q of metric exporter %s: %v", e.Timeout, e.Name, err)
+		}
+		if timeout <= 0 {
+			return fmt.Errorf("timeout of metric exporter %s must be positive", e.Name)
+		}
+		e.timeout = timeout
+	}
+
+	if e.CacheTTL != "" {
+		cacheTTL, err := time.ParseDuration(e.CacheTTL)
+		if err != nil {
+			return fmt.Errorf("invalid cacheTTL %q of metric exporter %s: %v", e.CacheTTL, e.Name, err)
+		}
+		if cacheTTL < 0 {
+			return fmt.Errorf("cacheTTL of metric exporter %s must not be negative", e.Name)
+		}
+		e.cacheTTL = cacheTTL
+	}
+
+	if e.Auth != nil {
+		// the receiver listens for plain HTTP, so it can't authenticate Prometheus
+		if e.Type == RemoteWriteReceiverType {
+			return fmt.Errorf("auth of metric exporter %s is not supported by the %s receiver", e.Name, e.Type)
+		}
+		if err := e.Auth.validate(); err != nil {
+			return fmt.Errorf("invalid auth config of metric exporter %s: %v", e.Name, err)
+		}
+	}
+
+	return nil
+}
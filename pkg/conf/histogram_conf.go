@@ -0,0 +1,98 @@
+package conf
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The kinds of the Prometheus metrics whose quantiles feed a commodity
+const (
+	HistogramKindHistogram = "histogram"
+	HistogramKindSummary   = "summary"
+
+	defaultHistogramPercentile = "p90"
+)
+
+// HistogramConf requests a commodity to be fed by a percentile of a classic histogram, computed from the increase
+// of the bucket counters over a window, or by a quantile reported by a summary
+type HistogramConf struct {
+	// The base name of the histogram or the summary, e.g., http_request_duration_seconds
+	Metric string `json:"metric"`
+	// The kind of the metric: histogram (the default) or summary
+	Kind string `json:"kind,omitempty"`
+	// The label matchers of the series, e.g., {job="api",code=~"2.."}
+	Matchers string `json:"matchers,omitempty"`
+	// The percentile fed into the used value, e.g., p99; p90 by default
+	Percentile string `json:"percentile,omitempty"`
+	// The percentile fed into the peak value; no peak is reported if it is empty
+	PeakPercentile string `json:"peakPercentile,omitempty"`
+	// The window of the increase of the bucket counters, e.g., 10m; the discovery interval if not set
+	Window string `json:"window,omitempty"`
+
+	window time.Duration
+}
+
+// IsSummary returns true if the quantiles are reported by a summary instead of computed from histogram buckets
+func (h *HistogramConf) IsSummary() bool {
+	return h.Kind == HistogramKindSummary
+}
+
+// Quantiles returns the quantiles in (0, 1] of the used and the peak values; the peak is 0 if not requested
+func (h *HistogramConf) Quantiles() (used, peak float64) {
+	used, _ = ParsePercentile(h.Percentile)
+	peak, _ = ParsePercentile(h.PeakPercentile)
+	return used / 100, peak / 100
+}
+
+// WindowOr returns the window of the bucket counters, or the given default if it is not configured
+func (h *HistogramConf) WindowOr(defaultWindow time.Duration) time.Duration {
+	if h.window > 0 {
+		return h.window
+	}
+	return defaultWindow
+}
+
+func (h *HistogramConf) validate() error {
+	if h.Metric == "" {
+		return fmt.Errorf("missing histogram metric")
+	}
+
+	switch h.Kind {
+	case "":
+		h.Kind = HistogramKindHistogram
+	case HistogramKindHistogram, HistogramKindSummary:
+	default:
+		return fmt.Errorf("unknown histogram kind %q", h.Kind)
+	}
+
+	if h.Matchers != "" && (!strings.HasPrefix(h.Matchers, "{") || !strings.HasSuffix(h.Matchers, "}")) {
+		return fmt.Errorf("histogram matchers %q must be enclosed in braces", h.Matchers)
+	}
+
+	if h.Percentile == "" {
+		h.Percentile = defaultHistogramPercentile
+	}
+	if _, ok := ParsePercentile(h.Percentile); !ok {
+		return fmt.Errorf("invalid histogram percentile %q", h.Percentile)
+	}
+
+	if h.PeakPercentile != "" {
+		if _, ok := ParsePercentile(h.PeakPercentile); !ok {
+			return fmt.Errorf("invalid histogram peak percentile %q", h.PeakPercentile)
+		}
+	}
+
+	if h.Window != "" {
+		window, err := time.ParseDuration(h.Window)
+		if err != nil {
+			return fmt.Errorf("invalid histogram window %q: %v", h.Window, err)
+		}
+		if window <= 0 {
+			return fmt.Errorf("histogram window must be positive")
+		}
+		h.window = window
+	}
+
+	return nil
+}
@@ -0,0 +1,478 @@
+package conf
+
+import (
+	"fmt"
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+	"github.com/turbonomic/prometurbo/pkg/discovery/constant"
+	"github.com/turbonomic/turbo-go-sdk/pkg/proto"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	LocalDebugMetricConfPath = "configs/metrics.yaml"
+	DefaultMetricConfPath    = "/etc/prometurbo/metrics.yaml"
+)
+
+// MetricConf declares the entities built from the metrics and the commodities sold by them
+type MetricConf struct {
+	Entities []*EntityConf `json:"entities"`
+	// The built-in entities of the metrics of well-known exporters, e.g., node-exporter
+	Presets []string `json:"presets,omitempty"`
+	// The default capacities keyed by commodity types, e.g., RESPONSE_TIME, in the units expected by Turbo
+	Capacities map[string]float64 `json:"capacities,omitempty"`
+	// The calls between the applications, from which the applications buy from each other
+	CallGraph *CallGraphConf `json:"callGraph,omitempty"`
+	// The SLOs of the entities, whose targets override the capacities; loaded separately from the SLO specs
+	SLOs []*SLO `json:"-"`
+
+	capacities map[proto.CommodityDTO_CommodityType]float64
+}
+
+type EntityConf struct {
+	// The entity type, e.g., APPLICATION
+	Type string `json:"type"`
+	// The label whose value becomes the UID of the entity
+	UIDLabel    string           `json:"uidLabel"`
+	Commodities []*CommodityConf `json:"commodities"`
+	// The capacities of the entities matching the label selectors, in the order of precedence
+	CapacityOverrides []*CapacityOverride `json:"capacityOverrides,omitempty"`
+	// The label grouping the applications into the virtual applications of the services, e.g., destination_service
+	ServiceLabel string `json:"serviceLabel,omitempty"`
+	// The label whose value stitches the entity to the one discovered by other probes; the UID label by default
+	StitchingLabel string `json:"stitchingLabel,omitempty"`
+	// The attribute matched by the value of the stitching label, IP or hostname; IP by default
+	StitchingAttr string `json:"stitchingAttr,omitempty"`
+	// The entities hosting the entities, e.g., the containers of the database servers, which they buy from
+	Provider *ProviderConf `json:"provider,omitempty"`
+
+	entityType proto.EntityDTO_EntityType
+}
+
+// ProviderConf declares the entity hosting each entity, which is discovered from the metrics as well
+type ProviderConf struct {
+	// The type of the hosting entities, e.g., CONTAINER
+	Type string `json:"type"`
+	// The label of the entities whose value is the UID of the hosting entity, e.g., pod
+	Label string `json:"label"`
+
+	entityType proto.EntityDTO_EntityType
+}
+
+// CapacityOverride overrides the capacities of the commodities of the entities matching the label selector
+type CapacityOverride struct {
+	// The labels of the entities, e.g., app: checkout
+	Selector map[string]string `json:"selector"`
+	// The capacities keyed by the metric names, in the units of the metrics
+	Capacities map[string]float64 `json:"capacities"`
+}
+
+type CommodityConf struct {
+	// The metric name, which is the key of the metric in EntityMetric.Metrics
+	Name string `json:"name"`
+	// The commodity type, e.g., TRANSACTION
+	Type string `json:"type"`
+	// The query whose result feeds the metric
+	Query string `json:"query,omitempty"`
+	// The capacity in the unit of the metric; the default capacity of the commodity type if not set
+	Capacity float64 `json:"capacity,omitempty"`
+	// The query whose result feeds the capacity of each entity, which overrides the other capacities
+	CapacityQuery string `json:"capacityQuery,omitempty"`
+	// The query whose result feeds the peak of each entity, e.g., the demand of a throttled CPU
+	PeakQuery string `json:"peakQuery,omitempty"`
+	// The label of the entities whose value is the capacity in the unit of the metric, e.g., an SLO
+	CapacityLabel string `json:"capacityLabel,omitempty"`
+	// The inference of the capacity of each entity from the history of the metric
+	CapacityInference *CapacityInferenceConf `json:"capacityInference,omitempty"`
+	// The unit of the metric, e.g., ms; the unit in the metadata of the metric in Prometheus if not set
+	Unit string `json:"unit,omitempty"`
+	// The aggregation of the samples over a window, instead of the latest value
+	Aggregation *AggregationConf `json:"aggregation,omitempty"`
+	// The histogram or the summary whose percentile feeds the metric, instead of the query
+	Histogram *HistogramConf `json:"histogram,omitempty"`
+	// The query returns a monotonically increasing counter, whose per-second rate between the discoveries
+	// feeds the metric
+	Counter bool `json:"counter,omitempty"`
+
+	commodityType proto.CommodityDTO_CommodityType
+}
+
+// DefaultMetricConf returns the mapping of the istio metrics of applications,
+// which are the metrics served by the appmetric exporter
+func DefaultMetricConf() *MetricConf {
+	config := &MetricConf{
+		Entities: []*EntityConf{
+			{
+				Type:     "APPLICATION",
+				UIDLabel: "destination_ip",
+				Commodities: []*CommodityConf{
+					{
+						Name:     constant.TPS,
+						Type:     "TRANSACTION",
+						Query:    `sum(rate(istio_turbo_pod_request_count{response_code="200"}[3m])) by (destination_ip)`,
+						Capacity: constant.TPSCap,
+						Unit:     "1/s",
+					},
+					{
+						Name: constant.Latency,
+						Type: "RESPONSE_TIME",
+						Query: `sum(rate(istio_turbo_pod_latency_time_ms_sum{response_code="200"}[3m])) by (destination_ip) / ` +
+							`sum(rate(istio_turbo_pod_latency_time_ms_count{response_code="200"}[3m])) by (destination_ip)`,
+						Capacity: constant.LatencyCap,
+						Unit:     "ms",
+					},
+				},
+			},
+		},
+	}
+
+	if err := config.validate(); err != nil {
+		// Should never happen
+		glog.Fatalf("Invalid default metric config: %v", err)
+	}
+
+	return config
+}
+
+// NewMetricConf reads the metric mapping from the YAML or JSON file at the given path.
+// The default mapping is used if the file doesn't exist.
+func NewMetricConf(configFilePath string) (*MetricConf, error) {
+	file, err := ioutil.ReadFile(configFilePath)
+	if os.IsNotExist(err) {
+		glog.Infof("Metric config file %s doesn't exist; using the default metric config", configFilePath)
+		return DefaultMetricConf(), nil
+	}
+	if err != nil {
+		glog.Errorf("File error: %v\n", err)
+		return nil, err
+	}
+
+	glog.Infof("Read metric configuration from %s", configFilePath)
+
+	var config MetricConf
+	if err := yaml.Unmarshal(file, &config); err != nil {
+		glog.Errorf("Unmarshall error :%v\n", err)
+		return nil, err
+	}
+
+	// The presets are expanded once into the entities, which are validated along with the others
+	if err := config.addPresets(); err != nil {
+		return nil, fmt.Errorf("invalid metric config %s: %v", configFilePath, err)
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid metric config %s: %v", configFilePath, err)
+	}
+
+	return &config, nil
+}
+
+// Entity returns the config of the given entity type
+func (c *MetricConf) Entity(entityType proto.EntityDTO_EntityType) (*EntityConf, bool) {
+	for _, e := range c.Entities {
+		if e.entityType == entityType {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// DefaultCapacity returns the default capacity of the commodity type, in the unit expected by Turbo
+func (c *MetricConf) DefaultCapacity(commType proto.CommodityDTO_CommodityType) (float64, bool) {
+	capacity, ok := c.capacities[commType]
+	return capacity, ok
+}
+
+// SLO returns the first SLO matching the labels of an entity
+func (c *MetricConf) SLO(labels map[string]string) (*SLO, bool) {
+	for _, slo := range c.SLOs {
+		if slo.Matches(labels) {
+			return slo, true
+		}
+	}
+	return nil, false
+}
+
+func (c *MetricConf) validate() error {
+	if len(c.Entities) == 0 {
+		return fmt.Errorf("no entity is defined")
+	}
+
+	c.capacities = make(map[proto.CommodityDTO_CommodityType]float64)
+	for name, capacity := range c.Capacities {
+		commType, ok := proto.CommodityDTO_CommodityType_value[name]
+		if !ok {
+			return fmt.Errorf("unknown commodity type %q of the default capacities", name)
+		}
+		if capacity <= 0 {
+			return fmt.Errorf("default capacity of %s must be positive", name)
+		}
+		c.capacities[proto.CommodityDTO_CommodityType(commType)] = capacity
+	}
+
+	entityTypes := make(map[proto.EntityDTO_EntityType]bool)
+	for _, e := range c.Entities {
+		if err := e.validate(); err != nil {
+			return err
+		}
+		if entityTypes[e.entityType] {
+			return fmt.Errorf("duplicate entity type %s", e.Type)
+		}
+		entityTypes[e.entityType] = true
+
+		if e.ServiceLabel != "" && e.entityType != proto.EntityDTO_APPLICATION {
+			return fmt.Errorf("serviceLabel is only supported by entity type %s", proto.EntityDTO_APPLICATION)
+		}
+
+		for _, comm := range e.Commodities {
+			if _, ok := c.capacities[comm.commodityType]; !ok && comm.Capacity == 0 {
+				return fmt.Errorf("no capacity of metric %s of entity type %s or default capacity of %s",
+					comm.Name, e.Type, comm.Type)
+			}
+		}
+	}
+
+	for _, e := range c.Entities {
+		if e.Provider != nil && !entityTypes[e.Provider.entityType] {
+			return fmt.Errorf("provider type %s of entity type %s is not defined", e.Provider.Type, e.Type)
+		}
+	}
+
+	if c.CallGraph != nil {
+		if !entityTypes[proto.EntityDTO_APPLICATION] {
+			return fmt.Errorf("the call graph requires the APPLICATION entities")
+		}
+		if err := c.CallGraph.validate(); err != nil {
+			return fmt.Errorf("invalid call graph: %v", err)
+		}
+	}
+
+	if c.ServiceLabel() != "" && entityTypes[proto.EntityDTO_VIRTUAL_APPLICATION] {
+		return fmt.Errorf("the virtual applications cannot be both defined and grouped by the serviceLabel")
+	}
+
+	return nil
+}
+
+// ServiceLabel returns the label grouping the applications into the virtual applications, if any
+func (c *MetricConf) ServiceLabel() string {
+	if e, ok := c.Entity(proto.EntityDTO_APPLICATION); ok {
+		return e.ServiceLabel
+	}
+	return ""
+}
+
+// HasProviders returns true if any entity type has a provider
+func (c *MetricConf) HasProviders() bool {
+	for _, e := range c.Entities {
+		if e.Provider != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *EntityConf) EntityType() proto.EntityDTO_EntityType {
+	return e.entityType
+}
+
+// Commodity returns the config of the commodity fed by the named metric
+func (e *EntityConf) Commodity(name string) (*CommodityConf, bool) {
+	for _, c := range e.Commodities {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// OverriddenCapacity returns the capacity of the named metric of the first override matching the labels
+func (e *EntityConf) OverriddenCapacity(metric string, labels map[string]string) (float64, bool) {
+	for _, o := range e.CapacityOverrides {
+		capacity, ok := o.Capacities[metric]
+		if ok && o.matches(labels) {
+			return capacity, true
+		}
+	}
+	return 0, false
+}
+
+func (e *EntityConf) validate() error {
+	entityType, ok := proto.EntityDTO_EntityType_value[e.Type]
+	if !ok {
+		return fmt.Errorf("unknown entity type %q", e.Type)
+	}
+	e.entityType = proto.EntityDTO_EntityType(entityType)
+
+	supported, ok := constant.SupportedCommodities[e.entityType]
+	if !ok {
+		return fmt.Errorf("unsupported entity type %s", e.Type)
+	}
+
+	if e.UIDLabel == "" {
+		return fmt.Errorf("missing uidLabel of entity type %s", e.Type)
+	}
+
+	if e.StitchingLabel == "" {
+		e.StitchingLabel = e.UIDLabel
+	}
+	switch e.StitchingAttr {
+	case "":
+		e.StitchingAttr = constant.StitchingAttr
+	case constant.StitchingAttr:
+	case constant.HostnameStitchingAttr:
+		if e.entityType != proto.EntityDTO_VIRTUAL_MACHINE {
+			return fmt.Errorf("stitchingAttr %s is only supported by entity type %s",
+				constant.HostnameStitchingAttr, proto.EntityDTO_VIRTUAL_MACHINE)
+		}
+	case constant.K8sStitchingAttr:
+		if e.entityType != proto.EntityDTO_CONTAINER {
+			return fmt.Errorf("stitchingAttr %s is only supported by entity type %s",
+				constant.K8sStitchingAttr, proto.EntityDTO_CONTAINER)
+		}
+	default:
+		return fmt.Errorf("unknown stitchingAttr %q of entity type %s", e.StitchingAttr, e.Type)
+	}
+
+	if len(e.Commodities) == 0 {
+		return fmt.Errorf("no commodity is defined for entity type %s", e.Type)
+	}
+
+	names := make(map[string]bool)
+	for _, c := range e.Commodities {
+		if err := c.validate(); err != nil {
+			return fmt.Errorf("invalid commodity of entity type %s: %v", e.Type, err)
+		}
+		if !supported[c.commodityType] {
+			return fmt.Errorf("commodity type %s of metric %s is not supported by entity type %s", c.Type, c.Name, e.Type)
+		}
+		if names[c.Name] {
+			return fmt.Errorf("duplicate metric %s of entity type %s", c.Name, e.Type)
+		}
+		names[c.Name] = true
+	}
+
+	if e.Provider != nil {
+		if err := e.Provider.validate(); err != nil {
+			return fmt.Errorf("invalid provider of entity type %s: %v", e.Type, err)
+		}
+		if e.Provider.entityType == e.entityType {
+			return fmt.Errorf("entity type %s cannot be its own provider", e.Type)
+		}
+	}
+
+	for _, o := range e.CapacityOverrides {
+		if err := o.validate(names); err != nil {
+			return fmt.Errorf("invalid capacity override of entity type %s: %v", e.Type, err)
+		}
+	}
+
+	return nil
+}
+
+func (p *ProviderConf) EntityType() proto.EntityDTO_EntityType {
+	return p.entityType
+}
+
+func (p *ProviderConf) validate() error {
+	entityType, ok := proto.EntityDTO_EntityType_value[p.Type]
+	if !ok {
+		return fmt.Errorf("unknown entity type %q", p.Type)
+	}
+	p.entityType = proto.EntityDTO_EntityType(entityType)
+
+	if p.Label == "" {
+		return fmt.Errorf("missing label")
+	}
+
+	return nil
+}
+
+func (o *CapacityOverride) matches(labels map[string]string) bool {
+	for name, value := range o.Selector {
+		if labels[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (o *CapacityOverride) validate(metrics map[string]bool) error {
+	if len(o.Selector) == 0 {
+		return fmt.Errorf("missing selector")
+	}
+
+	for metric, capacity := range o.Capacities {
+		if !metrics[metric] {
+			return fmt.Errorf("unknown metric %s", metric)
+		}
+		if capacity <= 0 {
+			return fmt.Errorf("capacity of metric %s must be positive", metric)
+		}
+	}
+
+	return nil
+}
+
+func (c *CommodityConf) CommodityType() proto.CommodityDTO_CommodityType {
+	return c.commodityType
+}
+
+func (c *CommodityConf) validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("missing metric name")
+	}
+
+	commType, ok := proto.CommodityDTO_CommodityType_value[c.Type]
+	if !ok {
+		return fmt.Errorf("unknown commodity type %q of metric %s", c.Type, c.Name)
+	}
+	c.commodityType = proto.CommodityDTO_CommodityType(commType)
+
+	if c.Capacity < 0 {
+		return fmt.Errorf("capacity of metric %s must be positive", c.Name)
+	}
+
+	if c.Unit != "" {
+		if err := ValidateUnit(c.Unit); err != nil {
+			return fmt.Errorf("invalid unit of metric %s: %v", c.Name, err)
+		}
+		if target, ok := CommodityUnit(c.commodityType); ok {
+			if _, err := ConvertUnit(c.Capacity, c.Unit, target); err != nil {
+				return fmt.Errorf("invalid unit of metric %s for commodity type %s: %v", c.Name, c.Type, err)
+			}
+		}
+	}
+
+	if c.Aggregation != nil {
+		if err := c.Aggregation.validate(); err != nil {
+			return fmt.Errorf("invalid aggregation of metric %s: %v", c.Name, err)
+		}
+	}
+
+	if c.Histogram != nil {
+		if c.Query != "" || c.Aggregation != nil {
+			return fmt.Errorf("metric %s cannot have a histogram along with a query or an aggregation", c.Name)
+		}
+		if err := c.Histogram.validate(); err != nil {
+			return fmt.Errorf("invalid histogram of metric %s: %v", c.Name, err)
+		}
+	}
+
+	if c.CapacityInference != nil {
+		if err := c.CapacityInference.validate(); err != nil {
+			return fmt.Errorf("invalid capacity inference of metric %s: %v", c.Name, err)
+		}
+	}
+
+	if c.PeakQuery != "" && (c.Histogram != nil || c.Aggregation != nil) {
+		return fmt.Errorf("metric %s cannot have a peak query along with a histogram or an aggregation", c.Name)
+	}
+
+	if c.Counter && (c.Histogram != nil || c.Aggregation != nil) {
+		return fmt.Errorf("counter metric %s cannot have a histogram or an aggregation", c.Name)
+	}
+
+	return nil
+}
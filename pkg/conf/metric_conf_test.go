@@ -0,0 +1,694 @@
+package conf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/turbonomic/turbo-go-sdk/pkg/proto"
+)
+
+func writeMetricConf(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "metricconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "metrics.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNewMetricConf(t *testing.T) {
+	path := writeMetricConf(t, `
+entities:
+- type: APPLICATION
+  uidLabel: instance
+  commodities:
+  - name: tps
+    type: TRANSACTION
+    query: sum(rate(http_requests_total[1m])) by (instance)
+    capacity: 100
+    unit: 1/s
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	mc, err := NewMetricConf(path)
+	if err != nil {
+		t.Fatalf("NewMetricConf() error = %v", err)
+	}
+
+	entity, ok := mc.Entity(proto.EntityDTO_APPLICATION)
+	if !ok {
+		t.Fatalf("Missing APPLICATION in %+v", mc)
+	}
+
+	comm, ok := entity.Commodity("tps")
+	if !ok || comm.CommodityType() != proto.CommodityDTO_TRANSACTION || comm.Capacity != 100 {
+		t.Errorf("Unexpected commodity config %+v", comm)
+	}
+}
+
+func TestNewMetricConf_EntityTypes(t *testing.T) {
+	path := writeMetricConf(t, `
+entities:
+- type: VIRTUAL_APPLICATION
+  uidLabel: service
+  commodities:
+  - {name: tps, type: TRANSACTION, capacity: 100}
+- type: DATABASE_SERVER
+  uidLabel: instance
+  commodities:
+  - {name: connections, type: CONNECTION, capacity: 100}
+- type: CONTAINER
+  uidLabel: container
+  commodities:
+  - {name: cpu, type: VCPU, capacity: 1000}
+- type: VIRTUAL_MACHINE
+  uidLabel: instance
+  commodities:
+  - {name: memory, type: VMEM, capacity: 1024}
+- type: LOAD_BALANCER
+  uidLabel: instance
+  commodities:
+  - {name: latency, type: RESPONSE_TIME, capacity: 500}
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	mc, err := NewMetricConf(path)
+	if err != nil {
+		t.Fatalf("NewMetricConf() error = %v", err)
+	}
+
+	for _, entityType := range []proto.EntityDTO_EntityType{
+		proto.EntityDTO_VIRTUAL_APPLICATION,
+		proto.EntityDTO_DATABASE_SERVER,
+		proto.EntityDTO_CONTAINER,
+		proto.EntityDTO_VIRTUAL_MACHINE,
+		proto.EntityDTO_LOAD_BALANCER,
+	} {
+		if _, ok := mc.Entity(entityType); !ok {
+			t.Errorf("Missing %v in %+v", entityType, mc)
+		}
+	}
+}
+
+func TestNewMetricConf_Presets(t *testing.T) {
+	path := writeMetricConf(t, `
+presets: [node-exporter, jmx-exporter, cadvisor]
+entities:
+- type: APPLICATION
+  uidLabel: destination_ip
+  commodities:
+  - {name: tps, type: TRANSACTION, capacity: 100}
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	mc, err := NewMetricConf(path)
+	if err != nil {
+		t.Fatalf("NewMetricConf() error = %v", err)
+	}
+
+	app, ok := mc.Entity(proto.EntityDTO_APPLICATION)
+	if !ok || app.UIDLabel != "destination_ip" || app.StitchingLabel != "destination_ip" || app.StitchingAttr != "IP" {
+		t.Fatalf("Unexpected applications %+v", app)
+	}
+	// The JVM metrics are along with the metrics of the applications
+	var names []string
+	for _, comm := range app.Commodities {
+		names = append(names, comm.Name)
+	}
+	if expected := []string{"tps", "heap", "gcTime", "threads"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected metrics %v but got %v", expected, names)
+	}
+	// The JVM metrics carry the UID label of the applications, which is the IP of the instance without the port
+	threads, _ := app.Commodity("threads")
+	expected := `label_replace(label_replace(jvm_threads_current, "ip", "$1", "instance", ` +
+		`"\\[?([^\\]]+?)\\]?(?::[0-9]+)?"), "destination_ip", "$1", "ip", "(.+)")`
+	if threads.Query != expected {
+		t.Errorf("Expected query %s but got %s", expected, threads.Query)
+	}
+
+	container, ok := mc.Entity(proto.EntityDTO_CONTAINER)
+	if !ok || container.StitchingAttr != "kubernetes" {
+		t.Fatalf("Unexpected containers %+v", container)
+	}
+	if cpu, ok := container.Commodity("cpu"); !ok || cpu.PeakQuery == "" {
+		t.Errorf("Expected the peak query of the throttled CPU but got %+v", cpu)
+	}
+	// The CPU is in MHz by the frequency of the cores of the nodes, or of 2 GHz
+	cpu, _ := container.Commodity("cpu")
+	for _, query := range []string{cpu.Query, cpu.CapacityQuery, cpu.PeakQuery} {
+		if !strings.Contains(query, nodeNameCPUFrequency+" / 1e6") || !strings.Contains(query, " * 2000)") {
+			t.Errorf("Expected the CPU in MHz but got %s", query)
+		}
+	}
+	if cpu.Capacity != 2000 {
+		t.Errorf("Expected the capacity of a core of 2 GHz but got %v", cpu.Capacity)
+	}
+
+	vm, ok := mc.Entity(proto.EntityDTO_VIRTUAL_MACHINE)
+	if !ok || vm.StitchingLabel != "ip" || vm.StitchingAttr != "IP" {
+		t.Fatalf("Unexpected virtual machines %+v", vm)
+	}
+	for name, commType := range map[string]proto.CommodityDTO_CommodityType{
+		"cpu":        proto.CommodityDTO_VCPU,
+		"memory":     proto.CommodityDTO_VMEM,
+		"filesystem": proto.CommodityDTO_VSTORAGE,
+		"disk":       proto.CommodityDTO_IO_THROUGHPUT,
+		"network":    proto.CommodityDTO_NET_THROUGHPUT,
+	} {
+		if comm, ok := vm.Commodity(name); !ok || comm.CommodityType() != commType {
+			t.Errorf("Expected metric %s of %v but got %+v", name, commType, comm)
+		}
+	}
+
+	// The presets are expanded once when loaded, so the config stays valid when validated again
+	if err := mc.validate(); err != nil {
+		t.Errorf("validate() error = %v", err)
+	}
+	if len(mc.Entities) != 3 || len(app.Commodities) != 4 {
+		t.Errorf("Expected the presets expanded once but got %d entities and %d application metrics",
+			len(mc.Entities), len(app.Commodities))
+	}
+}
+
+func TestNewMetricConf_JMXPreset(t *testing.T) {
+	path := writeMetricConf(t, `
+presets: [jmx-exporter]
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	mc, err := NewMetricConf(path)
+	if err != nil {
+		t.Fatalf("NewMetricConf() error = %v", err)
+	}
+
+	// The applications of the JVMs are identified and stitched by the IPs of the instances without the ports
+	app, ok := mc.Entity(proto.EntityDTO_APPLICATION)
+	if !ok || app.UIDLabel != "ip" || app.StitchingLabel != "ip" || app.StitchingAttr != "IP" {
+		t.Fatalf("Unexpected applications %+v", app)
+	}
+	for _, comm := range app.Commodities {
+		suffix := fmt.Sprintf(`, "ip", "$1", "instance", %q)`, instanceAddressRegex)
+		if !strings.HasPrefix(comm.Query, "label_replace(") || !strings.HasSuffix(comm.Query, suffix) {
+			t.Errorf("Expected the IP of the instance of metric %s but got %s", comm.Name, comm.Query)
+		}
+	}
+}
+
+func TestNewMetricConf_DatabasePresets(t *testing.T) {
+	path := writeMetricConf(t, `
+presets: [cadvisor, mysqld-exporter, postgres-exporter]
+entities:
+- type: DATABASE_SERVER
+  provider: {type: CONTAINER, label: namespace_pod_container}
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	mc, err := NewMetricConf(path)
+	if err != nil {
+		t.Fatalf("NewMetricConf() error = %v", err)
+	}
+
+	db, ok := mc.Entity(proto.EntityDTO_DATABASE_SERVER)
+	if !ok || db.UIDLabel != "ip" || db.StitchingLabel != "ip" || db.StitchingAttr != "IP" ||
+		db.Provider.EntityType() != proto.EntityDTO_CONTAINER || !mc.HasProviders() {
+		t.Fatalf("Unexpected database servers %+v", db)
+	}
+	if len(db.Commodities) != 5 {
+		t.Errorf("Expected the 5 metrics of both presets but got %+v", db.Commodities)
+	}
+
+	// The series of the servers carry the UIDs of their containers
+	container, ok := mc.Entity(proto.EntityDTO_CONTAINER)
+	if !ok || container.UIDLabel != db.Provider.Label {
+		t.Errorf("Expected the provider label %s of the UIDs of the containers but got %+v", db.Provider.Label,
+			container)
+	}
+
+	// The queries of MySQL and Postgres are merged on the IPs of the instances, so that a host has one server
+	ip := func(query string) string {
+		query = `label_replace(label_join(` + query + `, "namespace_pod_container", "/", "namespace", "pod", ` +
+			`"container"), "namespace_pod_container", "", "namespace_pod_container", "/.*|.*/|.*//.*")`
+		return `label_replace(` + query + `, "ip", "$1", "instance", "\\[?([^\\]]+?)\\]?(?::[0-9]+)?")`
+	}
+	comm, _ := db.Commodity("connections")
+	expected := "(" + ip("mysql_global_status_threads_connected") + ") or on(ip) (" +
+		ip("sum without ("+postgresLabels+") (pg_stat_activity_count)") + ")"
+	if comm.Query != expected {
+		t.Errorf("Expected query %s but got %s", expected, comm.Query)
+	}
+	expected = "(" + ip("mysql_global_variables_max_connections") + ") or on(ip) (" +
+		ip("pg_settings_max_connections") + ")"
+	if comm.CapacityQuery != expected {
+		t.Errorf("Expected capacity query %s but got %s", expected, comm.CapacityQuery)
+	}
+	for _, comm := range db.Commodities {
+		if strings.Count(comm.Query, " or on(ip) ") != 1 {
+			t.Errorf("Expected the query of %s merged on the IPs but got %s", comm.Name, comm.Query)
+		}
+	}
+}
+
+func TestInstanceAddressRegex(t *testing.T) {
+	// Prometheus anchors the regex of label_replace
+	regex := regexp.MustCompile("^(?:" + instanceAddressRegex + ")$")
+	for instance, expected := range map[string]string{
+		"10.0.0.1:9104":    "10.0.0.1",
+		"10.0.0.1":         "10.0.0.1",
+		"[fd00::1]:9187":   "fd00::1",
+		"mysql.local:9104": "mysql.local",
+		"postgres.local":   "postgres.local",
+		"[fd00::1]":        "fd00::1",
+	} {
+		var ip string
+		if match := regex.FindStringSubmatch(instance); match != nil {
+			ip = match[1]
+		}
+		if ip != expected {
+			t.Errorf("Expected IP %q of instance %s but got %q", expected, instance, ip)
+		}
+	}
+}
+
+func TestNewMetricConf_CallGraph(t *testing.T) {
+	path := writeMetricConf(t, `
+callGraph:
+  query: sum(rate(istio_requests_total[1m])) by (source_workload, destination_workload)
+entities:
+- type: APPLICATION
+  uidLabel: destination_workload
+  commodities:
+  - {name: tps, type: TRANSACTION, capacity: 100}
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	mc, err := NewMetricConf(path)
+	if err != nil {
+		t.Fatalf("NewMetricConf() error = %v", err)
+	}
+
+	callGraph := mc.CallGraph
+	if callGraph == nil || callGraph.SourceLabel != "source_workload" ||
+		callGraph.DestinationLabel != "destination_workload" || callGraph.LatencyUnit != "ms" {
+		t.Errorf("Got call graph %+v", callGraph)
+	}
+}
+
+func TestNewMetricConf_Aggregation(t *testing.T) {
+	path := writeMetricConf(t, `
+entities:
+- type: APPLICATION
+  uidLabel: instance
+  commodities:
+  - name: tps
+    type: TRANSACTION
+    query: sum(rate(http_requests_total[1m])) by (instance)
+    capacity: 100
+    aggregation:
+      used: avg
+      peak: p95
+      window: 10m
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	mc, err := NewMetricConf(path)
+	if err != nil {
+		t.Fatalf("NewMetricConf() error = %v", err)
+	}
+
+	aggregation := mc.Entities[0].Commodities[0].Aggregation
+	if aggregation == nil || aggregation.Used != AggregationAvg || aggregation.Peak != "p95" {
+		t.Fatalf("Got aggregation %+v", aggregation)
+	}
+	if window := aggregation.WindowOr(time.Minute); window != 10*time.Minute {
+		t.Errorf("WindowOr() = %v, want 10m", window)
+	}
+}
+
+func TestNewMetricConf_Histogram(t *testing.T) {
+	path := writeMetricConf(t, `
+entities:
+- type: APPLICATION
+  uidLabel: instance
+  commodities:
+  - name: latency
+    type: RESPONSE_TIME
+    capacity: 500
+    histogram:
+      metric: http_request_duration_seconds
+      matchers: '{job="api"}'
+      peakPercentile: p99
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	mc, err := NewMetricConf(path)
+	if err != nil {
+		t.Fatalf("NewMetricConf() error = %v", err)
+	}
+
+	histogram := mc.Entities[0].Commodities[0].Histogram
+	if histogram == nil || histogram.Kind != HistogramKindHistogram || histogram.IsSummary() {
+		t.Fatalf("Got histogram %+v", histogram)
+	}
+	if used, peak := histogram.Quantiles(); used != 0.9 || peak != 0.99 {
+		t.Errorf("Quantiles() = %v, %v, want 0.9, 0.99", used, peak)
+	}
+	if window := histogram.WindowOr(time.Minute); window != time.Minute {
+		t.Errorf("WindowOr() = %v, want 1m", window)
+	}
+}
+
+func TestNewMetricConf_Capacities(t *testing.T) {
+	path := writeMetricConf(t, `
+capacities:
+  RESPONSE_TIME: 300
+entities:
+- type: APPLICATION
+  uidLabel: instance
+  commodities:
+  - {name: tps, type: TRANSACTION, capacity: 100}
+  - {name: latency, type: RESPONSE_TIME}
+  capacityOverrides:
+  - selector: {app: checkout, tier: web}
+    capacities: {latency: 150}
+  - selector: {app: checkout}
+    capacities: {latency: 200, tps: 50}
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	mc, err := NewMetricConf(path)
+	if err != nil {
+		t.Fatalf("NewMetricConf() error = %v", err)
+	}
+
+	if capacity, ok := mc.DefaultCapacity(proto.CommodityDTO_RESPONSE_TIME); !ok || capacity != 300 {
+		t.Errorf("DefaultCapacity() = %v, %v, want 300", capacity, ok)
+	}
+	if _, ok := mc.DefaultCapacity(proto.CommodityDTO_TRANSACTION); ok {
+		t.Errorf("Unexpected default capacity of TRANSACTION")
+	}
+
+	entity := mc.Entities[0]
+	tests := []struct {
+		metric   string
+		labels   map[string]string
+		capacity float64
+		ok       bool
+	}{
+		{"latency", map[string]string{"app": "checkout", "tier": "web"}, 150, true},
+		{"latency", map[string]string{"app": "checkout"}, 200, true},
+		{"tps", map[string]string{"app": "checkout", "tier": "web"}, 50, true},
+		{"latency", map[string]string{"app": "cart"}, 0, false},
+	}
+	for _, test := range tests {
+		capacity, ok := entity.OverriddenCapacity(test.metric, test.labels)
+		if capacity != test.capacity || ok != test.ok {
+			t.Errorf("OverriddenCapacity(%s, %v) = %v, %v, want %v, %v",
+				test.metric, test.labels, capacity, ok, test.capacity, test.ok)
+		}
+	}
+}
+
+func TestNewMetricConf_Missing(t *testing.T) {
+	mc, err := NewMetricConf("/nonexistent/metrics.yaml")
+	if err != nil {
+		t.Fatalf("NewMetricConf() error = %v", err)
+	}
+
+	if _, ok := mc.Entity(proto.EntityDTO_APPLICATION); !ok {
+		t.Errorf("Expected the default metric config but got %+v", mc)
+	}
+}
+
+func TestNewMetricConf_Invalid(t *testing.T) {
+	tests := map[string]string{
+		"unknown entity type": `
+entities:
+- type: FOO
+  uidLabel: instance
+  commodities:
+  - {name: tps, type: TRANSACTION, capacity: 20}
+`,
+		"unsupported entity type": `
+entities:
+- type: STORAGE
+  uidLabel: instance
+  commodities:
+  - {name: tps, type: TRANSACTION, capacity: 20}
+`,
+		"commodity type unsupported by the entity type": `
+entities:
+- type: CONTAINER
+  uidLabel: instance
+  commodities:
+  - {name: tps, type: TRANSACTION, capacity: 20}
+`,
+		"service label of virtual applications": `
+entities:
+- type: VIRTUAL_APPLICATION
+  uidLabel: service
+  serviceLabel: service
+  commodities:
+  - {name: tps, type: TRANSACTION, capacity: 20}
+`,
+		"virtual applications both defined and grouped": `
+entities:
+- type: APPLICATION
+  uidLabel: instance
+  serviceLabel: service
+  commodities:
+  - {name: tps, type: TRANSACTION, capacity: 20}
+- type: VIRTUAL_APPLICATION
+  uidLabel: service
+  commodities:
+  - {name: tps, type: TRANSACTION, capacity: 20}
+`,
+		"unknown preset": `
+presets: [foo-exporter]
+`,
+		"metric of a preset already defined": `
+presets: [node-exporter]
+entities:
+- type: VIRTUAL_MACHINE
+  uidLabel: instance
+  commodities:
+  - {name: memory, type: VMEM, capacity: 1024}
+`,
+		"kubernetes stitching of virtual machines": `
+entities:
+- type: VIRTUAL_MACHINE
+  uidLabel: instance
+  stitchingAttr: kubernetes
+  commodities:
+  - {name: memory, type: VMEM, capacity: 1024}
+`,
+		"peak query with an aggregation": `
+entities:
+- type: CONTAINER
+  uidLabel: container
+  commodities:
+  - name: cpu
+    type: VCPU
+    query: cpu
+    peakQuery: cpu_peak
+    aggregation: {used: avg}
+    capacity: 1000
+`,
+		"undefined provider type": `
+entities:
+- type: DATABASE_SERVER
+  uidLabel: instance
+  provider: {type: CONTAINER, label: pod}
+  commodities:
+  - {name: connections, type: CONNECTION, capacity: 100}
+`,
+		"entity type as its own provider": `
+entities:
+- type: CONTAINER
+  uidLabel: pod
+  provider: {type: CONTAINER, label: pod}
+  commodities:
+  - {name: cpu, type: VCPU, capacity: 1000}
+`,
+		"provider without label": `
+entities:
+- type: CONTAINER
+  uidLabel: pod
+  commodities:
+  - {name: cpu, type: VCPU, capacity: 1000}
+- type: DATABASE_SERVER
+  uidLabel: instance
+  provider: {type: CONTAINER}
+  commodities:
+  - {name: connections, type: CONNECTION, capacity: 100}
+`,
+		"unknown stitching attribute": `
+entities:
+- type: VIRTUAL_MACHINE
+  uidLabel: instance
+  stitchingAttr: UUID
+  commodities:
+  - {name: memory, type: VMEM, capacity: 1024}
+`,
+		"hostname stitching of applications": `
+entities:
+- type: APPLICATION
+  uidLabel: instance
+  stitchingAttr: hostname
+  commodities:
+  - {name: tps, type: TRANSACTION, capacity: 20}
+`,
+		"call graph without query": `
+callGraph:
+  latencyQuery: latency
+entities:
+- type: APPLICATION
+  uidLabel: destination_workload
+  commodities:
+  - {name: tps, type: TRANSACTION, capacity: 20}
+`,
+		"call graph with an invalid latency unit": `
+callGraph:
+  query: calls
+  latencyUnit: KB
+entities:
+- type: APPLICATION
+  uidLabel: destination_workload
+  commodities:
+  - {name: tps, type: TRANSACTION, capacity: 20}
+`,
+		"unknown commodity type": `
+entities:
+- type: APPLICATION
+  uidLabel: instance
+  commodities:
+  - {name: tps, type: FOO, capacity: 20}
+`,
+		"missing uid label": `
+entities:
+- type: APPLICATION
+  commodities:
+  - {name: tps, type: TRANSACTION, capacity: 20}
+`,
+		"duplicate metric": `
+entities:
+- type: APPLICATION
+  uidLabel: instance
+  commodities:
+  - {name: tps, type: TRANSACTION, capacity: 20}
+  - {name: tps, type: RESPONSE_TIME, capacity: 20}
+`,
+		"unknown aggregation": `
+entities:
+- type: APPLICATION
+  uidLabel: instance
+  commodities:
+  - {name: tps, type: TRANSACTION, capacity: 20, aggregation: {used: p101}}
+`,
+		"invalid aggregation window": `
+entities:
+- type: APPLICATION
+  uidLabel: instance
+  commodities:
+  - {name: tps, type: TRANSACTION, capacity: 20, aggregation: {used: avg, window: 10}}
+`,
+		"histogram with a query": `
+entities:
+- type: APPLICATION
+  uidLabel: instance
+  commodities:
+  - {name: latency, type: RESPONSE_TIME, capacity: 20, query: latency, histogram: {metric: latency_seconds}}
+`,
+		"missing capacity": `
+entities:
+- type: APPLICATION
+  uidLabel: instance
+  commodities:
+  - {name: tps, type: TRANSACTION}
+`,
+		"unknown commodity type of default capacity": `
+capacities:
+  FOO: 20
+entities:
+- type: APPLICATION
+  uidLabel: instance
+  commodities:
+  - {name: tps, type: TRANSACTION, capacity: 20}
+`,
+		"capacity override of unknown metric": `
+entities:
+- type: APPLICATION
+  uidLabel: instance
+  commodities:
+  - {name: tps, type: TRANSACTION, capacity: 20}
+  capacityOverrides:
+  - {selector: {app: checkout}, capacities: {latency: 100}}
+`,
+		"unknown unit": `
+entities:
+- type: APPLICATION
+  uidLabel: instance
+  commodities:
+  - {name: latency, type: RESPONSE_TIME, capacity: 20, unit: fortnights}
+`,
+		"unit of another dimension": `
+entities:
+- type: APPLICATION
+  uidLabel: instance
+  commodities:
+  - {name: latency, type: RESPONSE_TIME, capacity: 20, unit: KB}
+`,
+		"counter with an aggregation": `
+entities:
+- type: APPLICATION
+  uidLabel: instance
+  commodities:
+  - {name: tps, type: TRANSACTION, capacity: 20, query: requests_total, counter: true, aggregation: {used: avg}}
+`,
+		"unknown capacity inference method": `
+entities:
+- type: APPLICATION
+  uidLabel: instance
+  commodities:
+  - {name: latency, type: RESPONSE_TIME, capacity: 20, capacityInference: {method: foo}}
+`,
+		"negative capacity inference floor": `
+entities:
+- type: APPLICATION
+  uidLabel: instance
+  commodities:
+  - {name: latency, type: RESPONSE_TIME, capacity: 20, capacityInference: {floor: -1}}
+`,
+		"unknown histogram kind": `
+entities:
+- type: APPLICATION
+  uidLabel: instance
+  commodities:
+  - {name: latency, type: RESPONSE_TIME, capacity: 20, histogram: {metric: latency_seconds, kind: gauge}}
+`,
+		"invalid histogram percentile": `
+entities:
+- type: APPLICATION
+  uidLabel: instance
+  commodities:
+  - {name: latency, type: RESPONSE_TIME, capacity: 20, histogram: {metric: latency_seconds, percentile: 99}}
+`,
+	}
+
+	for name, content := range tests {
+		path := writeMetricConf(t, content)
+		if _, err := NewMetricConf(path); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		os.RemoveAll(filepath.Dir(path))
+	}
+}
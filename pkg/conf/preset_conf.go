@@ -0,0 +1,449 @@
+package conf
+
+import (
+	"fmt"
+)
+
+// The built-in mappings of the metrics of well-known exporters, enabled by the presets of the metric config
+const (
+	// The VIRTUAL_MACHINE entities of the hosts monitored by node_exporter, stitched by their IPs
+	NodeExporterPreset = "node-exporter"
+	// The DATABASE_SERVER entities of the MySQL servers monitored by mysqld_exporter
+	MySQLExporterPreset = "mysqld-exporter"
+	// The DATABASE_SERVER entities of the Postgres servers monitored by postgres_exporter
+	PostgresExporterPreset = "postgres-exporter"
+	// The HEAP, COLLECTION_TIME and THREADS of the APPLICATION entities of the JVMs monitored by jmx_exporter
+	JMXExporterPreset = "jmx-exporter"
+	// The CONTAINER entities of the cAdvisor metrics of the kubelets, stitched to the containers of kubeturbo
+	CAdvisorPreset = "cadvisor"
+)
+
+// The file systems which don't take the storage of the hosts
+const nodeFilesystemSelector = `fstype!~"tmpfs|ramfs|overlay|squashfs|nsfs"`
+
+// The max frequency of the cores of each host, or 2 GHz if the host doesn't expose it, e.g., in a VM without cpufreq
+const nodeCPUFrequency = `(avg by (instance) (node_cpu_frequency_max_hertz)` +
+	` or on(instance) count by (instance) (node_uname_info) * 2e9)`
+
+// The network devices which don't carry the traffic of the hosts
+const nodeNetworkSelector = `device!~"lo|veth.*|docker.*|cni.*|flannel.*|cali.*"`
+
+var presets = map[string]func() *EntityConf{
+	NodeExporterPreset:     nodeExporterEntity,
+	MySQLExporterPreset:    mysqlExporterEntity,
+	PostgresExporterPreset: postgresExporterEntity,
+	JMXExporterPreset:      jmxExporterEntity,
+	CAdvisorPreset:         cadvisorEntity,
+}
+
+// nodeExporterEntity maps the node_exporter metrics of each host to a VIRTUAL_MACHINE, whose UID is the address of
+// the instance without the port in the ip label, and whose host name is in the nodename label of node_uname_info
+func nodeExporterEntity() *EntityConf {
+	return &EntityConf{
+		Type:           "VIRTUAL_MACHINE",
+		UIDLabel:       "ip",
+		StitchingLabel: "ip",
+		Commodities: []*CommodityConf{
+			{
+				// The busy cores by the frequency of the cores, in MHz
+				Name: "cpu",
+				Type: "VCPU",
+				Query: nodeQuery(`sum by (instance) (rate(node_cpu_seconds_total{mode!="idle"}[3m]))` +
+					` * on(instance) ` + nodeCPUFrequency + ` / 1e6`),
+				CapacityQuery: nodeQuery(`count by (instance) (node_cpu_seconds_total{mode="idle"})` +
+					` * on(instance) ` + nodeCPUFrequency + ` / 1e6`),
+				// A core of 2 GHz if the capacity query has no result
+				Capacity: 2000,
+			},
+			{
+				Name:          "memory",
+				Type:          "VMEM",
+				Query:         nodeQuery(`node_memory_MemTotal_bytes - node_memory_MemAvailable_bytes`),
+				CapacityQuery: nodeQuery(`node_memory_MemTotal_bytes`),
+				Capacity:      1 << 30,
+				Unit:          "bytes",
+			},
+			{
+				Name: "filesystem",
+				Type: "VSTORAGE",
+				Query: nodeQuery(fmt.Sprintf(`sum by (instance) (node_filesystem_size_bytes{%s}`+
+					` - node_filesystem_avail_bytes{%s})`, nodeFilesystemSelector, nodeFilesystemSelector)),
+				CapacityQuery: nodeQuery(fmt.Sprintf(`sum by (instance) (node_filesystem_size_bytes{%s})`,
+					nodeFilesystemSelector)),
+				Capacity: 10 << 30,
+				Unit:     "bytes",
+			},
+			{
+				Name: "disk",
+				Type: "IO_THROUGHPUT",
+				Query: nodeQuery(`sum by (instance) (rate(node_disk_read_bytes_total[3m])` +
+					` + rate(node_disk_written_bytes_total[3m]))`),
+				// 100 MB/s
+				Capacity: 100 << 20,
+				Unit:     "bytes/s",
+			},
+			{
+				Name: "network",
+				Type: "NET_THROUGHPUT",
+				Query: nodeQuery(fmt.Sprintf(`sum by (instance) (rate(node_network_receive_bytes_total{%s}[3m])`+
+					` + rate(node_network_transmit_bytes_total{%s}[3m]))`, nodeNetworkSelector, nodeNetworkSelector)),
+				CapacityQuery: nodeQuery(fmt.Sprintf(`sum by (instance) (node_network_speed_bytes{%s} > 0)`,
+					nodeNetworkSelector)),
+				// 1 Gbps
+				Capacity: 125e6,
+				Unit:     "bytes/s",
+			},
+		},
+	}
+}
+
+// nodeQuery adds the nodename label of node_uname_info, and the ip label of the address of the instance
+// without the port, to the series of the query aggregated by the instance
+func nodeQuery(query string) string {
+	return instanceQuery(fmt.Sprintf(`(%s) * on(instance) group_left(nodename) node_uname_info`, query))
+}
+
+// The address of the instance, i.e., host:port, [IPv6]:port or the host alone, without the port and the brackets
+const instanceAddressRegex = `\[?([^\]]+?)\]?(?::[0-9]+)?`
+
+// instanceQuery adds the ip label of the address of the instance without the port to the series of the query
+func instanceQuery(query string) string {
+	return fmt.Sprintf(`label_replace(%s, "ip", "$1", "instance", %q)`, query, instanceAddressRegex)
+}
+
+// instanceEntity identifies the entity by the ip label of the address of the instance without the port, e.g.,
+// of the exporter running along with a database server, which is added to the series of all the queries
+func instanceEntity(entity *EntityConf) *EntityConf {
+	entity.UIDLabel = "ip"
+	entity.StitchingLabel = "ip"
+	for _, comm := range entity.Commodities {
+		comm.Query = instanceQuery(comm.Query)
+		if comm.CapacityQuery != "" {
+			comm.CapacityQuery = instanceQuery(comm.CapacityQuery)
+		}
+	}
+	return entity
+}
+
+// The default capacities of the database servers, if the capacity queries have no result
+const (
+	dbConnectionsCapacity  = 100
+	dbTransactionsCapacity = 1000
+	// 500 ms
+	dbLatencyCapacity = 0.5
+	// 1 GB
+	dbMemoryCapacity = 1 << 30
+)
+
+// databaseEntity identifies the database server by the IP of the instance of its exporter, and adds the
+// namespace_pod_container label of the container of the exporter, i.e., the UID of the container of the cadvisor
+// preset, which may be the provider label of the servers
+func databaseEntity(entity *EntityConf) *EntityConf {
+	for _, comm := range entity.Commodities {
+		comm.Query = hostingContainerQuery(comm.Query)
+		if comm.CapacityQuery != "" {
+			comm.CapacityQuery = hostingContainerQuery(comm.CapacityQuery)
+		}
+	}
+	return instanceEntity(entity)
+}
+
+// mysqlExporterEntity maps the mysqld_exporter metrics of each MySQL server to a DATABASE_SERVER, whose UID is the
+// IP of the instance of the exporter. The metrics keep the other labels of the exporter, e.g., the pod hosting the
+// server. The latency requires the events_statements collector of the performance schema.
+func mysqlExporterEntity() *EntityConf {
+	return databaseEntity(&EntityConf{
+		Type: "DATABASE_SERVER",
+		Commodities: []*CommodityConf{
+			{
+				Name:          "connections",
+				Type:          "CONNECTION",
+				Query:         `mysql_global_status_threads_connected`,
+				CapacityQuery: `mysql_global_variables_max_connections`,
+				Capacity:      dbConnectionsCapacity,
+			},
+			{
+				Name:     "tps",
+				Type:     "TRANSACTION",
+				Query:    `sum without (command) (rate(mysql_global_status_commands_total{command=~"commit|rollback"}[3m]))`,
+				Capacity: dbTransactionsCapacity,
+				Unit:     "1/s",
+			},
+			{
+				Name: "latency",
+				Type: "RESPONSE_TIME",
+				Query: `sum without (schema, digest, digest_text) ` +
+					`(rate(mysql_perf_schema_events_statements_seconds_total[3m])) / ` +
+					`sum without (schema, digest, digest_text) (rate(mysql_perf_schema_events_statements_total[3m]))`,
+				Capacity: dbLatencyCapacity,
+				Unit:     "s",
+			},
+			{
+				// The hit ratio of the reads from the InnoDB buffer pool
+				Name: "cacheHitRate",
+				Type: "DB_CACHE_HIT_RATE",
+				Query: `100 * (1 - rate(mysql_global_status_innodb_buffer_pool_reads[3m]) / ` +
+					`rate(mysql_global_status_innodb_buffer_pool_read_requests[3m]))`,
+				Capacity: 100,
+				Unit:     "%",
+			},
+			{
+				// The data in the InnoDB buffer pool
+				Name:          "memory",
+				Type:          "DB_MEM",
+				Query:         `mysql_global_status_innodb_buffer_pool_bytes_data`,
+				CapacityQuery: `mysql_global_variables_innodb_buffer_pool_size`,
+				Capacity:      dbMemoryCapacity,
+				Unit:          "bytes",
+			},
+		},
+	})
+}
+
+// The labels of the series of the databases, the users and the statements of postgres_exporter
+const postgresLabels = `datid, datname, state, usename, application_name, backend_type, user, queryid`
+
+// postgresExporterEntity maps the postgres_exporter metrics of each Postgres server to a DATABASE_SERVER, whose UID
+// is the IP of the instance of the exporter. The metrics keep the other labels of the exporter, e.g., the pod
+// hosting the server. The latency requires the stat_statements collector.
+func postgresExporterEntity() *EntityConf {
+	return databaseEntity(&EntityConf{
+		Type: "DATABASE_SERVER",
+		Commodities: []*CommodityConf{
+			{
+				Name:          "connections",
+				Type:          "CONNECTION",
+				Query:         postgresSum(`pg_stat_activity_count`),
+				CapacityQuery: `pg_settings_max_connections`,
+				Capacity:      dbConnectionsCapacity,
+			},
+			{
+				Name: "tps",
+				Type: "TRANSACTION",
+				Query: postgresSum(`rate(pg_stat_database_xact_commit[3m])`) + ` + ` +
+					postgresSum(`rate(pg_stat_database_xact_rollback[3m])`),
+				Capacity: dbTransactionsCapacity,
+				Unit:     "1/s",
+			},
+			{
+				Name: "latency",
+				Type: "RESPONSE_TIME",
+				Query: postgresSum(`rate(pg_stat_statements_seconds_total[3m])`) + ` / ` +
+					postgresSum(`rate(pg_stat_statements_calls_total[3m])`),
+				Capacity: dbLatencyCapacity,
+				Unit:     "s",
+			},
+			{
+				// The hit ratio of the reads from the shared buffers
+				Name: "cacheHitRate",
+				Type: "DB_CACHE_HIT_RATE",
+				Query: `100 * ` + postgresSum(`rate(pg_stat_database_blks_hit[3m])`) + ` / (` +
+					postgresSum(`rate(pg_stat_database_blks_hit[3m])`) + ` + ` +
+					postgresSum(`rate(pg_stat_database_blks_read[3m])`) + `)`,
+				Capacity: 100,
+				Unit:     "%",
+			},
+			{
+				// The shared buffers in use out of the shared buffers. The buffers in use are counted by the
+				// pg_buffercache query of postgres_exporter, which isn't built in, so the memory is not reported
+				// without it, as the shared buffers are allocated at the start.
+				Name:          "memory",
+				Type:          "DB_MEM",
+				Query:         `pg_buffercache_used_bytes`,
+				CapacityQuery: `pg_settings_shared_buffers_bytes`,
+				Capacity:      dbMemoryCapacity,
+				Unit:          "bytes",
+			},
+		},
+	})
+}
+
+// postgresSum sums up the series of the query over the databases, the users and the statements
+func postgresSum(query string) string {
+	return fmt.Sprintf(`sum without (%s) (%s)`, postgresLabels, query)
+}
+
+// jmxExporterEntity maps the JVM metrics of jmx_exporter to the commodities of the APPLICATION entities, along
+// with the other commodities of the applications, whose UID is the IP of the instance of the exporter, i.e.,
+// of the JVM which the exporter runs in as an agent.
+func jmxExporterEntity() *EntityConf {
+	return instanceEntity(&EntityConf{
+		Type: "APPLICATION",
+		Commodities: []*CommodityConf{
+			{
+				Name:  "heap",
+				Type:  "HEAP",
+				Query: `jvm_memory_bytes_used{area="heap"}`,
+				// The max is -1 if undefined
+				CapacityQuery: `jvm_memory_bytes_max{area="heap"} > 0`,
+				// 1 GB
+				Capacity: 1 << 30,
+				Unit:     "bytes",
+			},
+			{
+				// The ratio of the time spent in the GCs of all the collectors
+				Name:     "gcTime",
+				Type:     "COLLECTION_TIME",
+				Query:    `sum without (gc) (rate(jvm_gc_collection_seconds_sum[3m]))`,
+				Capacity: 1,
+				Unit:     "ratio",
+			},
+			{
+				Name:     "threads",
+				Type:     "THREADS",
+				Query:    `jvm_threads_current`,
+				Capacity: 1000,
+			},
+		},
+	})
+}
+
+// The series of the containers of the pods, excluding the ones of the pods themselves and of their pause containers
+const containerSelector = `{container!="", container!="POD", image!=""}`
+
+// The max frequency of the cores of each host by its name in the nodename label of node_uname_info
+const nodeNameCPUFrequency = `avg by (nodename) ` +
+	`(node_cpu_frequency_max_hertz * on(instance) group_left(nodename) node_uname_info)`
+
+// cadvisorEntity maps the cAdvisor metrics of the kubelets to a CONTAINER of each container of the pods, whose UID
+// is <namespace>/<pod>/<container>. The CPU is in MHz as the one of kubeturbo, whose peak is the demand estimated
+// by the throttled periods of the CPU. Only the used values and the peaks patch the containers of kubeturbo, which
+// knows the limits.
+func cadvisorEntity() *EntityConf {
+	return &EntityConf{
+		Type:          "CONTAINER",
+		UIDLabel:      containerUIDLabel,
+		StitchingAttr: "kubernetes",
+		Commodities: []*CommodityConf{
+			{
+				Name:  "cpu",
+				Type:  "VCPU",
+				Query: containerQuery(containerMHz(containerSum(`rate(container_cpu_usage_seconds_total%s[3m])`))),
+				CapacityQuery: containerQuery(containerMHz(containerSum(`container_spec_cpu_quota%s > 0`) + ` / ` +
+					containerSum(`container_spec_cpu_period%s`))),
+				// The demand is the used CPU scaled up by the ratio of the throttled periods, up to 10 times
+				PeakQuery: containerQuery(containerMHz(containerSum(`rate(container_cpu_usage_seconds_total%s[3m])`) +
+					` / clamp_min(1 - ` + containerSum(`rate(container_cpu_cfs_throttled_periods_total%s[3m])`) +
+					` / ` + containerSum(`rate(container_cpu_cfs_periods_total%s[3m])`) + `, 0.1)`)),
+				// A core of 2 GHz if the container has no limit
+				Capacity: 2000,
+			},
+			{
+				Name:          "memory",
+				Type:          "VMEM",
+				Query:         containerQuery(containerSum(`container_memory_working_set_bytes%s`)),
+				CapacityQuery: containerQuery(containerSum(`container_spec_memory_limit_bytes%s > 0`)),
+				// 1 GB if the container has no limit
+				Capacity: 1 << 30,
+				Unit:     "bytes",
+			},
+		},
+	}
+}
+
+// containerSum sums up the series of the containers in the query, e.g., of the CPUs, keeping the node label of
+// the name of the host of the containers
+func containerSum(query string) string {
+	return fmt.Sprintf(`sum by (namespace, pod, container, node) (%s)`, fmt.Sprintf(query, containerSelector))
+}
+
+// containerMHz converts the cores of the containers in the query to MHz by the max frequency of the cores of their
+// hosts, whose names are in the node label, or by 2 GHz if unknown, e.g., without node_exporter
+func containerMHz(cores string) string {
+	return fmt.Sprintf(`(label_replace(%s, "nodename", "$1", "node", "(.+)") * on(nodename) group_left() %s / 1e6)`+
+		` or on(namespace, pod, container) (%s * 2000)`, cores, nodeNameCPUFrequency, cores)
+}
+
+// The label of the UIDs of the containers, i.e., <namespace>/<pod>/<container>
+const containerUIDLabel = "namespace_pod_container"
+
+// containerQuery adds the namespace_pod_container label to the series of the query
+func containerQuery(query string) string {
+	return fmt.Sprintf(`label_join(%s, %q, "/", "namespace", "pod", "container")`, query, containerUIDLabel)
+}
+
+// hostingContainerQuery adds the namespace_pod_container label of the container of each series of the query,
+// which is dropped if any of the namespace, pod and container labels is missing, e.g., outside of Kubernetes
+func hostingContainerQuery(query string) string {
+	return fmt.Sprintf(`label_replace(%s, %q, "", %q, "/.*|.*/|.*//.*")`,
+		containerQuery(query), containerUIDLabel, containerUIDLabel)
+}
+
+// addPresets adds the commodities of the presets to the entities of their types, which are added unless defined.
+// The metrics of the presets of the same type are merged, e.g., the database servers of both MySQL and Postgres,
+// where the queries of the same metrics are joined by the or operator on the UID label, so that there is one
+// entity of each UID. The metrics of the presets and of the same types must be in the same units.
+func (c *MetricConf) addPresets() error {
+	fromPresets := make(map[*CommodityConf]bool)
+	for _, name := range c.Presets {
+		preset, ok := presets[name]
+		if !ok {
+			return fmt.Errorf("unknown preset %q", name)
+		}
+		entity := preset()
+
+		var defined *EntityConf
+		for _, e := range c.Entities {
+			if e.Type == entity.Type {
+				defined = e
+			}
+		}
+		if defined == nil {
+			defined = &EntityConf{Type: entity.Type}
+			c.Entities = append(c.Entities, defined)
+		}
+		if defined.UIDLabel == "" {
+			defined.UIDLabel = entity.UIDLabel
+		}
+		if defined.UIDLabel == entity.UIDLabel {
+			if defined.StitchingLabel == "" {
+				defined.StitchingLabel = entity.StitchingLabel
+			}
+		} else {
+			// The series of the preset carry the UID label of the defined entity, e.g., destination_ip of the
+			// applications, whose value is the UID of the preset, e.g., the IP of the JVM
+			for _, comm := range entity.Commodities {
+				comm.Query = copyLabelQuery(comm.Query, defined.UIDLabel, entity.UIDLabel)
+				comm.CapacityQuery = copyLabelQuery(comm.CapacityQuery, defined.UIDLabel, entity.UIDLabel)
+				comm.PeakQuery = copyLabelQuery(comm.PeakQuery, defined.UIDLabel, entity.UIDLabel)
+			}
+		}
+		if defined.StitchingAttr == "" {
+			defined.StitchingAttr = entity.StitchingAttr
+		}
+
+		for _, comm := range entity.Commodities {
+			existing, ok := defined.Commodity(comm.Name)
+			switch {
+			case !ok:
+				defined.Commodities = append(defined.Commodities, comm)
+				fromPresets[comm] = true
+			case fromPresets[existing]:
+				existing.Query = orQuery(existing.Query, comm.Query, defined.UIDLabel)
+				existing.CapacityQuery = orQuery(existing.CapacityQuery, comm.CapacityQuery, defined.UIDLabel)
+			default:
+				return fmt.Errorf("metric %s of preset %s is already defined for entity type %s",
+					comm.Name, name, entity.Type)
+			}
+		}
+	}
+
+	return nil
+}
+
+// copyLabelQuery sets the label of the series of the query to the value of the other label, if there is a query
+func copyLabelQuery(query, label, from string) string {
+	if query == "" {
+		return ""
+	}
+	return fmt.Sprintf(`label_replace(%s, %q, "$1", %q, "(.+)")`, query, label, from)
+}
+
+// orQuery joins the queries by the or operator on the label, so that the series of the second query are dropped
+// if the first query has the series of the same value of the label
+func orQuery(a, b, label string) string {
+	if a == "" || b == "" {
+		return a + b
+	}
+	return fmt.Sprintf("(%s) or on(%s) (%s)", a, label, b)
+}
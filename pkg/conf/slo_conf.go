@@ -0,0 +1,267 @@
+package conf
+
+import (
+	"fmt"
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The keys of the annotations of the OpenSLO specs, or the labels of the Sloth specs, declaring the targets
+// and the entities of an SLO
+const (
+	// The response time target in ms, e.g., "300"
+	SLOResponseTimeKey = "prometurbo_response_time_ms"
+	// The throughput budget in transactions per second, e.g., "100"
+	SLOTransactionsKey = "prometurbo_transactions_per_sec"
+	// The labels of the entities, e.g., "app=checkout,env=prod"
+	SLOSelectorKey = "prometurbo_selector"
+
+	// The label of the entities matching the service of an SLO without a selector
+	defaultSLOServiceLabel = "service"
+)
+
+// The threshold of the latency SLIs of Sloth, in seconds, e.g., le="0.3" of a histogram bucket
+var slothLatencyThreshold = regexp.MustCompile(`le="([^"]+)"`)
+
+// SLO is a service level objective of the entities matching its selector, whose targets become the capacities
+// of their RESPONSE_TIME and TRANSACTION commodities
+type SLO struct {
+	Name     string
+	Selector map[string]string
+	// The response time target in ms; none if 0
+	ResponseTime float64
+	// The throughput budget in transactions per second; none if 0
+	Transactions float64
+}
+
+// sloSpec is either an OpenSLO SLO (apiVersion: openslo/v1, kind: SLO) or a Sloth spec (version: prometheus/v1)
+type sloSpec struct {
+	// OpenSLO
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name        string            `json:"name"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		Service string `json:"service"`
+	} `json:"spec"`
+
+	// Sloth
+	Version string            `json:"version"`
+	Service string            `json:"service"`
+	Labels  map[string]string `json:"labels"`
+	SLOs    []struct {
+		Name   string            `json:"name"`
+		Labels map[string]string `json:"labels"`
+		SLI    struct {
+			Events struct {
+				ErrorQuery string `json:"error_query"`
+				TotalQuery string `json:"total_query"`
+			} `json:"events"`
+			Raw struct {
+				ErrorRatioQuery string `json:"error_ratio_query"`
+			} `json:"raw"`
+		} `json:"sli"`
+	} `json:"slos"`
+}
+
+// NewSLOs loads the SLOs from the OpenSLO and Sloth specs in the YAML files in the directory, in the order of
+// the file names and of the documents in each file. The files which are not valid specs are skipped.
+func NewSLOs(dir string) ([]*SLO, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		ext := filepath.Ext(file.Name())
+		if !file.IsDir() && (ext == ".yaml" || ext == ".yml" || ext == ".json") {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var slos []*SLO
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			glog.Errorf("Skipping SLO file %s: %v", path, err)
+			continue
+		}
+		parsed, err := parseSLOs(data)
+		if err != nil {
+			glog.Errorf("Skipping SLO file %s: %v", path, err)
+			continue
+		}
+		slos = append(slos, parsed...)
+	}
+
+	glog.Infof("Loaded %d SLOs from %s", len(slos), dir)
+	return slos, nil
+}
+
+// parseSLOs parses the SLOs in the YAML documents, skipping the documents which are not SLOs
+func parseSLOs(data []byte) ([]*SLO, error) {
+	var slos []*SLO
+	for i, doc := range splitYAMLDocuments(string(data)) {
+		if strings.TrimSpace(doc) == "" {
+			continue
+		}
+
+		var spec sloSpec
+		if err := yaml.Unmarshal([]byte(doc), &spec); err != nil {
+			return nil, fmt.Errorf("document %d: %v", i, err)
+		}
+
+		var parsed []*SLO
+		var err error
+		switch {
+		case strings.HasPrefix(spec.APIVersion, "openslo/") && spec.Kind == "SLO":
+			parsed, err = spec.openSLOs()
+		case strings.HasPrefix(spec.Version, "prometheus/"):
+			parsed, err = spec.slothSLOs()
+		default:
+			glog.V(3).Infof("Skipping document %d, which is not an SLO", i)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("document %d: %v", i, err)
+		}
+		slos = append(slos, parsed...)
+	}
+	return slos, nil
+}
+
+func splitYAMLDocuments(data string) []string {
+	var docs []string
+	var lines []string
+	for _, line := range strings.Split(data, "\n") {
+		if strings.TrimRight(line, " \r") == "---" {
+			docs = append(docs, strings.Join(lines, "\n"))
+			lines = nil
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return append(docs, strings.Join(lines, "\n"))
+}
+
+// openSLOs returns the SLO of an OpenSLO spec, whose prometurbo keys are in the annotations. The thresholds of
+// the objectives aren't used, as neither the SLI they apply to nor their unit is known.
+func (s *sloSpec) openSLOs() ([]*SLO, error) {
+	meta := s.Metadata
+	slo := &SLO{Name: meta.Name}
+
+	if err := slo.setTargets(meta.Annotations, s.Spec.Service); err != nil {
+		return nil, err
+	}
+	if !slo.hasTargets() {
+		return nil, nil
+	}
+	return []*SLO{slo}, nil
+}
+
+// slothSLOs returns the SLOs of a Sloth spec, whose prometurbo keys are in the labels of the service or the SLOs.
+// The response time target is the value of the label, or the bucket threshold of the latency SLI.
+func (s *sloSpec) slothSLOs() ([]*SLO, error) {
+	var slos []*SLO
+	for _, spec := range s.SLOs {
+		slo := &SLO{Name: s.Service + "-" + spec.Name}
+
+		sli := spec.SLI
+		for _, query := range []string{sli.Events.ErrorQuery, sli.Events.TotalQuery, sli.Raw.ErrorRatioQuery} {
+			if match := slothLatencyThreshold.FindStringSubmatch(query); match != nil {
+				if threshold, err := strconv.ParseFloat(match[1], 64); err == nil {
+					slo.ResponseTime = threshold * 1000
+					break
+				}
+			}
+		}
+
+		// The labels of the SLO take precedence over the ones of the service
+		keys := make(map[string]string)
+		for name, value := range s.Labels {
+			keys[name] = value
+		}
+		for name, value := range spec.Labels {
+			keys[name] = value
+		}
+
+		if err := slo.setTargets(keys, s.Service); err != nil {
+			return nil, fmt.Errorf("SLO %s: %v", spec.Name, err)
+		}
+		if slo.hasTargets() {
+			slos = append(slos, slo)
+		}
+	}
+	return slos, nil
+}
+
+// setTargets sets the targets and the selector of the SLO from the prometurbo keys, where the entities are
+// matched by the service if there is no selector
+func (slo *SLO) setTargets(keys map[string]string, service string) error {
+	if slo.Name == "" {
+		return fmt.Errorf("no name")
+	}
+
+	for key, target := range map[string]*float64{
+		SLOResponseTimeKey: &slo.ResponseTime,
+		SLOTransactionsKey: &slo.Transactions,
+	} {
+		value, ok := keys[key]
+		if !ok {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || parsed <= 0 {
+			return fmt.Errorf("invalid %s %q", key, value)
+		}
+		*target = parsed
+	}
+
+	if selector, ok := keys[SLOSelectorKey]; ok {
+		slo.Selector = make(map[string]string)
+		for _, pair := range strings.Split(selector, ",") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return fmt.Errorf("invalid %s %q", SLOSelectorKey, selector)
+			}
+			slo.Selector[kv[0]] = kv[1]
+		}
+		return nil
+	}
+
+	if service == "" {
+		return fmt.Errorf("SLO %s has no selector nor service", slo.Name)
+	}
+	slo.Selector = map[string]string{defaultSLOServiceLabel: service}
+	return nil
+}
+
+// hasTargets returns true if the SLO has any target feeding the capacities, unlike, e.g., an availability SLO
+func (slo *SLO) hasTargets() bool {
+	if slo.ResponseTime > 0 || slo.Transactions > 0 {
+		return true
+	}
+	glog.V(3).Infof("Skipping SLO %s without a response time target nor a throughput budget", slo.Name)
+	return false
+}
+
+// Matches returns true if the labels of an entity match the selector of the SLO
+func (slo *SLO) Matches(labels map[string]string) bool {
+	for name, value := range slo.Selector {
+		if actual, ok := labels[name]; !ok || actual != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,184 @@
+package conf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const openSLOSpec = `
+apiVersion: openslo/v1
+kind: SLO
+metadata:
+  name: checkout-latency
+  annotations:
+    prometurbo_response_time_ms: "300"
+    prometurbo_transactions_per_sec: "100"
+    prometurbo_selector: app=checkout,env=prod
+spec:
+  service: checkout
+  objectives:
+  - displayName: p99 latency
+    op: lte
+    value: 300
+    target: 0.99
+---
+apiVersion: openslo/v1
+kind: Service
+metadata:
+  name: checkout
+---
+apiVersion: openslo/v1
+kind: SLO
+metadata:
+  name: checkout-availability
+spec:
+  service: checkout
+  objectives:
+  - target: 0.999
+`
+
+const slothSpec = `
+version: prometheus/v1
+service: cart
+labels:
+  owner: team-a
+slos:
+- name: latency
+  objective: 99
+  sli:
+    events:
+      error_query: sum(rate(http_request_duration_seconds_count[{{.window}}])) - sum(rate(http_request_duration_seconds_bucket{le="0.25"}[{{.window}}]))
+      total_query: sum(rate(http_request_duration_seconds_count[{{.window}}]))
+- name: throughput
+  objective: 99
+  labels:
+    prometurbo_transactions_per_sec: "50"
+    prometurbo_selector: app=cart
+  sli:
+    raw:
+      error_ratio_query: sum(rate(http_requests_total{code=~"5.."}[{{.window}}])) / sum(rate(http_requests_total[{{.window}}]))
+`
+
+func TestNewSLOs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"a-openslo.yaml": openSLOSpec,
+		"b-sloth.yml":    slothSpec,
+		"c-invalid.yaml": "apiVersion: openslo/v1\nkind: SLO\nmetadata: {name: x, annotations: {prometurbo_response_time_ms: fast}}\n",
+		"README.md":      "not a spec",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	slos, err := NewSLOs(dir)
+	if err != nil {
+		t.Fatalf("NewSLOs() error = %v", err)
+	}
+
+	expected := []*SLO{
+		{
+			Name:         "checkout-latency",
+			Selector:     map[string]string{"app": "checkout", "env": "prod"},
+			ResponseTime: 300,
+			Transactions: 100,
+		},
+		{
+			Name:         "cart-latency",
+			Selector:     map[string]string{"service": "cart"},
+			ResponseTime: 250,
+		},
+		{
+			Name:         "cart-throughput",
+			Selector:     map[string]string{"app": "cart"},
+			Transactions: 50,
+		},
+	}
+	if !reflect.DeepEqual(slos, expected) {
+		for _, slo := range slos {
+			t.Logf("Got %+v", slo)
+		}
+		t.Errorf("NewSLOs() got %d SLOs, want %d", len(slos), len(expected))
+	}
+
+	if _, err := NewSLOs(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("Expected an error for a missing directory")
+	}
+}
+
+func TestParseSLOs_OpenSLO_Objectives(t *testing.T) {
+	// The lt thresholds of the objectives aren't response times: an error rate, and a latency in seconds
+	slos, err := parseSLOs([]byte(`
+apiVersion: openslo/v1
+kind: SLO
+metadata:
+  name: checkout-errors
+  annotations:
+    prometurbo_transactions_per_sec: "100"
+spec:
+  service: checkout
+  objectives:
+  - op: lt
+    value: 0.01
+---
+apiVersion: openslo/v1
+kind: SLO
+metadata:
+  name: checkout-latency
+spec:
+  service: checkout
+  objectives:
+  - op: lte
+    value: 0.3
+    target: 0.99
+`))
+	if err != nil {
+		t.Fatalf("parseSLOs() error = %v", err)
+	}
+
+	expected := []*SLO{{
+		Name:         "checkout-errors",
+		Selector:     map[string]string{"service": "checkout"},
+		Transactions: 100,
+	}}
+	if !reflect.DeepEqual(slos, expected) {
+		for _, slo := range slos {
+			t.Logf("Got %+v", slo)
+		}
+		t.Errorf("parseSLOs() got %d SLOs, want %d", len(slos), len(expected))
+	}
+}
+
+func TestMetricConf_SLO(t *testing.T) {
+	mc := &MetricConf{
+		SLOs: []*SLO{
+			{Name: "checkout", Selector: map[string]string{"app": "checkout", "env": "prod"}, ResponseTime: 300},
+			{Name: "all-checkout", Selector: map[string]string{"app": "checkout"}, ResponseTime: 500},
+		},
+	}
+
+	tests := []struct {
+		labels map[string]string
+		slo    string
+	}{
+		{map[string]string{"app": "checkout", "env": "prod", "pod": "a"}, "checkout"},
+		{map[string]string{"app": "checkout", "env": "dev"}, "all-checkout"},
+		{map[string]string{"app": "cart"}, ""},
+	}
+	for _, test := range tests {
+		slo, ok := mc.SLO(test.labels)
+		if ok != (test.slo != "") || ok && slo.Name != test.slo {
+			t.Errorf("SLO(%v) = %+v, %v, want %s", test.labels, slo, ok, test.slo)
+		}
+	}
+}
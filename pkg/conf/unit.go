@@ -0,0 +1,119 @@
+package conf
+
+import (
+	"fmt"
+	"github.com/turbonomic/turbo-go-sdk/pkg/proto"
+)
+
+// The dimensions of the units, where only the values of the same dimension can be converted to each other
+const (
+	dimensionTime  = "time"
+	dimensionRate  = "rate"
+	dimensionSize  = "size"
+	dimensionRatio = "ratio"
+	dimensionBytes = "throughput"
+)
+
+// unit is a unit of measurement, as a multiple of the base unit of its dimension
+type unit struct {
+	dimension string
+	factor    float64
+}
+
+// The known units, including the ones in the OpenMetrics metadata such as seconds and bytes.
+// The base units are second, per second, byte, byte per second and ratio. KB, MB and GB are 1024-based as in Turbo.
+var units = map[string]unit{
+	"ns":           {dimensionTime, 1e-9},
+	"nanoseconds":  {dimensionTime, 1e-9},
+	"us":           {dimensionTime, 1e-6},
+	"µs":           {dimensionTime, 1e-6},
+	"microseconds": {dimensionTime, 1e-6},
+	"ms":           {dimensionTime, 1e-3},
+	"milliseconds": {dimensionTime, 1e-3},
+	"s":            {dimensionTime, 1},
+	"seconds":      {dimensionTime, 1},
+	"min":          {dimensionTime, 60},
+	"minutes":      {dimensionTime, 60},
+	"h":            {dimensionTime, 3600},
+	"hours":        {dimensionTime, 3600},
+
+	"1/s":        {dimensionRate, 1},
+	"/s":         {dimensionRate, 1},
+	"per_second": {dimensionRate, 1},
+	"1/min":      {dimensionRate, 1.0 / 60},
+	"per_minute": {dimensionRate, 1.0 / 60},
+	"1/h":        {dimensionRate, 1.0 / 3600},
+	"per_hour":   {dimensionRate, 1.0 / 3600},
+
+	"B":     {dimensionSize, 1},
+	"bytes": {dimensionSize, 1},
+	"KB":    {dimensionSize, 1 << 10},
+	"KiB":   {dimensionSize, 1 << 10},
+	"Ki":    {dimensionSize, 1 << 10},
+	"MB":    {dimensionSize, 1 << 20},
+	"MiB":   {dimensionSize, 1 << 20},
+	"Mi":    {dimensionSize, 1 << 20},
+	"GB":    {dimensionSize, 1 << 30},
+	"GiB":   {dimensionSize, 1 << 30},
+	"Gi":    {dimensionSize, 1 << 30},
+
+	"B/s":     {dimensionBytes, 1},
+	"bytes/s": {dimensionBytes, 1},
+	"KB/s":    {dimensionBytes, 1 << 10},
+	"MB/s":    {dimensionBytes, 1 << 20},
+	"GB/s":    {dimensionBytes, 1 << 30},
+
+	"ratio":   {dimensionRatio, 1},
+	"%":       {dimensionRatio, 0.01},
+	"percent": {dimensionRatio, 0.01},
+}
+
+// The units of the commodities expected by Turbo
+var commodityUnits = map[proto.CommodityDTO_CommodityType]string{
+	proto.CommodityDTO_RESPONSE_TIME:     "ms",
+	proto.CommodityDTO_TRANSACTION:       "1/s",
+	proto.CommodityDTO_VMEM:              "KB",
+	proto.CommodityDTO_MEM:               "KB",
+	proto.CommodityDTO_HEAP:              "KB",
+	proto.CommodityDTO_DB_MEM:            "KB",
+	proto.CommodityDTO_VSTORAGE:          "MB",
+	proto.CommodityDTO_IO_THROUGHPUT:     "KB/s",
+	proto.CommodityDTO_NET_THROUGHPUT:    "KB/s",
+	proto.CommodityDTO_DB_CACHE_HIT_RATE: "%",
+	proto.CommodityDTO_COLLECTION_TIME:   "%",
+}
+
+// CommodityUnit returns the unit of the commodity type expected by Turbo, if the commodity has a unit to convert to
+func CommodityUnit(commType proto.CommodityDTO_CommodityType) (string, bool) {
+	u, ok := commodityUnits[commType]
+	return u, ok
+}
+
+// ValidateUnit returns an error if the unit is unknown
+func ValidateUnit(u string) error {
+	if _, ok := units[u]; !ok {
+		return fmt.Errorf("unknown unit %q", u)
+	}
+	return nil
+}
+
+// ConvertUnit converts the value from one unit to another of the same dimension
+func ConvertUnit(value float64, from, to string) (float64, error) {
+	if from == to {
+		return value, nil
+	}
+
+	fromUnit, ok := units[from]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q", from)
+	}
+	toUnit, ok := units[to]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q", to)
+	}
+	if fromUnit.dimension != toUnit.dimension {
+		return 0, fmt.Errorf("cannot convert %s of %s to %s of %s", from, fromUnit.dimension, to, toUnit.dimension)
+	}
+
+	return value * fromUnit.factor / toUnit.factor, nil
+}
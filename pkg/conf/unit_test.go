@@ -0,0 +1,36 @@
+package conf
+
+import (
+	"math"
+	"testing"
+)
+
+func TestConvertUnit(t *testing.T) {
+	tests := []struct {
+		value    float64
+		from, to string
+		expected float64
+	}{
+		{0.25, "s", "ms", 250},
+		{0.25, "seconds", "ms", 250},
+		{1500, "us", "ms", 1.5},
+		{120, "1/min", "1/s", 2},
+		{2048, "bytes", "KB", 2},
+		{1, "GiB", "KB", 1024 * 1024},
+		{50, "%", "ratio", 0.5},
+		{7, "ms", "ms", 7},
+	}
+
+	for _, test := range tests {
+		got, err := ConvertUnit(test.value, test.from, test.to)
+		if err != nil || math.Abs(got-test.expected) > 1e-9 {
+			t.Errorf("ConvertUnit(%v, %s, %s) = %v, %v, want %v", test.value, test.from, test.to, got, err, test.expected)
+		}
+	}
+
+	for _, units := range [][2]string{{"s", "KB"}, {"fortnights", "ms"}, {"ms", "fortnights"}} {
+		if _, err := ConvertUnit(1, units[0], units[1]); err == nil {
+			t.Errorf("ConvertUnit(1, %s, %s) expected an error", units[0], units[1])
+		}
+	}
+}
@@ -6,7 +6,10 @@ import (
 
 const (
 	// EntityType
-	ApplicationType = int32(1)
+	ApplicationType = int32(proto.EntityDTO_APPLICATION)
+
+	// EntityType reported by the appmetric exporter
+	AppMetricApplicationType = int32(1)
 
 	// CommodityType
 	TPS     = "tps"
@@ -15,8 +18,14 @@ const (
 	// MetricType
 	Used     = "used"
 	Capacity = "capacity"
+	Peak     = "peak"
+
+	// The suffix of the metric name for the peak value of a metric
+	PeakSuffix = "_peak"
+	// The suffix of the metric name for the capacity of a metric reported along with the metric
+	CapacitySuffix = "_capacity"
 
-	// Capacity
+	// Default capacity
 	TPSCap     = 20.0
 	LatencyCap = 500.0 //millisec
 
@@ -25,18 +34,74 @@ const (
 
 	// The attribute used for stitching with other probes (e.g., prometurbo) with app and vapp
 	StitchingAttr string = "IP"
+
+	// The attribute used for stitching the VMs with the ones of the hypervisors by their host names
+	HostnameStitchingAttr string = "hostname"
+	// The attribute of the VMs of the hypervisors matched by the host names
+	VMDisplayNameAttr string = "displayName"
+
+	// The attribute used for stitching the containers with the ones of kubeturbo by their namespaces, pods and names
+	K8sStitchingAttr string = "kubernetes"
+
+	// The entity property of the name of the SLO applied to the capacities of the entity
+	SLOProperty string = "SLO"
 )
 
-var EntityTypeMap = map[int32]proto.EntityDTO_EntityType{
-	ApplicationType: proto.EntityDTO_APPLICATION,
+// The properties of the containers of kubeturbo matched by K8sStitchingAttr, and the labels of their values
+var K8sContainerProperties = []struct {
+	Name  string
+	Label string
+}{
+	{"KubernetesNamespace", "namespace"},
+	{"KubernetesPodName", "pod"},
+	{"KubernetesContainerName", "container"},
 }
 
-var CommodityTypeMap = map[string]proto.CommodityDTO_CommodityType{
-	TPS:     proto.CommodityDTO_TRANSACTION,
-	Latency: proto.CommodityDTO_RESPONSE_TIME,
+// The entity types of the appmetric exporter
+var AppMetricEntityTypeMap = map[int32]proto.EntityDTO_EntityType{
+	AppMetricApplicationType: proto.EntityDTO_APPLICATION,
 }
 
-var CommodityCapMap = map[proto.CommodityDTO_CommodityType]float64{
-	proto.CommodityDTO_TRANSACTION:   TPSCap,
-	proto.CommodityDTO_RESPONSE_TIME: LatencyCap,
+// The entity types supported by prometurbo and the commodity types sold by each of them
+var SupportedCommodities = map[proto.EntityDTO_EntityType]map[proto.CommodityDTO_CommodityType]bool{
+	proto.EntityDTO_APPLICATION: {
+		proto.CommodityDTO_TRANSACTION:     true,
+		proto.CommodityDTO_RESPONSE_TIME:   true,
+		proto.CommodityDTO_VCPU:            true,
+		proto.CommodityDTO_VMEM:            true,
+		proto.CommodityDTO_HEAP:            true,
+		proto.CommodityDTO_COLLECTION_TIME: true,
+		proto.CommodityDTO_THREADS:         true,
+		proto.CommodityDTO_CONNECTION:      true,
+	},
+	proto.EntityDTO_VIRTUAL_APPLICATION: {
+		proto.CommodityDTO_TRANSACTION:   true,
+		proto.CommodityDTO_RESPONSE_TIME: true,
+	},
+	proto.EntityDTO_DATABASE_SERVER: {
+		proto.CommodityDTO_TRANSACTION:       true,
+		proto.CommodityDTO_RESPONSE_TIME:     true,
+		proto.CommodityDTO_VCPU:              true,
+		proto.CommodityDTO_VMEM:              true,
+		proto.CommodityDTO_DB_MEM:            true,
+		proto.CommodityDTO_DB_CACHE_HIT_RATE: true,
+		proto.CommodityDTO_CONNECTION:        true,
+		proto.CommodityDTO_TRANSACTION_LOG:   true,
+	},
+	proto.EntityDTO_CONTAINER: {
+		proto.CommodityDTO_VCPU: true,
+		proto.CommodityDTO_VMEM: true,
+	},
+	proto.EntityDTO_VIRTUAL_MACHINE: {
+		proto.CommodityDTO_VCPU:           true,
+		proto.CommodityDTO_VMEM:           true,
+		proto.CommodityDTO_VSTORAGE:       true,
+		proto.CommodityDTO_IO_THROUGHPUT:  true,
+		proto.CommodityDTO_NET_THROUGHPUT: true,
+	},
+	proto.EntityDTO_LOAD_BALANCER: {
+		proto.CommodityDTO_TRANSACTION:   true,
+		proto.CommodityDTO_RESPONSE_TIME: true,
+		proto.CommodityDTO_CONNECTION:    true,
+	},
 }
@@ -1,13 +1,17 @@
 package discovery
 
 import (
+	"context"
 	"fmt"
 	"github.com/golang/glog"
+	"github.com/turbonomic/prometurbo/pkg/conf"
 	"github.com/turbonomic/prometurbo/pkg/discovery/dtofactory"
 	"github.com/turbonomic/prometurbo/pkg/discovery/exporter"
 	"github.com/turbonomic/prometurbo/pkg/registration"
 	"github.com/turbonomic/turbo-go-sdk/pkg/probe"
 	"github.com/turbonomic/turbo-go-sdk/pkg/proto"
+	"sync"
+	"time"
 )
 
 // Implements the TurboDiscoveryClient interface
@@ -15,13 +19,29 @@ type P8sDiscoveryClient struct {
 	targetAddr      string
 	scope           string
 	metricExporters []exporter.MetricExporter
+	metricConf      *conf.MetricConf
+	// The deadline of querying the exporters in each discovery
+	timeout time.Duration
+	// The max number of exporters queried at the same time
+	concurrency int
+	// The history of the commodities for the capacity inference, which is saved after each discovery
+	history *dtofactory.CapacityHistory
 }
 
-func NewDiscoveryClient(targetAddr, scope string, metricExporters []exporter.MetricExporter) *P8sDiscoveryClient {
+func NewDiscoveryClient(targetAddr, scope string, metricExporters []exporter.MetricExporter,
+	metricConf *conf.MetricConf, timeout time.Duration, concurrency int,
+	history *dtofactory.CapacityHistory) *P8sDiscoveryClient {
+	if concurrency < 1 {
+		concurrency = 1
+	}
 	return &P8sDiscoveryClient{
 		targetAddr:      targetAddr,
 		scope:           scope,
 		metricExporters: metricExporters,
+		metricConf:      metricConf,
+		timeout:         timeout,
+		concurrency:     concurrency,
+		history:         history,
 	}
 }
 
@@ -59,20 +79,45 @@ func (d *P8sDiscoveryClient) Validate(accountValues []*proto.AccountValue) (*pro
 
 // Discover the Target Topology
 func (d *P8sDiscoveryClient) Discover(accountValues []*proto.AccountValue) (*proto.DiscoveryResponse, error) {
-	glog.V(2).Infof("Discovering the target %s", accountValues)
+	glog.V(2).Infof("Discovering the target %v", accountValues)
 	var entities []*proto.EntityDTO
 	allExportersFailed := true
 
-	for _, metricExporter := range d.metricExporters {
-		dtos, err := d.buildEntities(metricExporter)
-		if err != nil {
-			glog.Errorf("Error while querying metrics exporter %v: %v", metricExporter, err)
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	// The applications are grouped into the virtual applications of their services if configured
+	var virtualApps *dtofactory.VirtualAppBuilder
+	if serviceLabel := d.metricConf.ServiceLabel(); serviceLabel != "" {
+		virtualApps = dtofactory.NewVirtualAppBuilder(serviceLabel, d.metricConf)
+	}
+	// The applications are connected by their calls if configured
+	var callGraph *dtofactory.CallGraphBuilder
+	if d.metricConf.CallGraph != nil {
+		callGraph = dtofactory.NewCallGraphBuilder(d.metricConf)
+	}
+	// The entities buy from the entities hosting them if configured
+	var hostings *dtofactory.HostingBuilder
+	if d.metricConf.HasProviders() {
+		hostings = dtofactory.NewHostingBuilder(d.metricConf)
+	}
+
+	// Merge the results in the order of the exporters so that the entities are always in the same order
+	var errorDTOs []*proto.ErrorDTO
+	for i, result := range d.queryExporters(ctx, virtualApps, callGraph, hostings) {
+		metricExporter := d.metricExporters[i]
+		if staleErr, ok := result.err.(*exporter.StaleMetricsError); ok {
+			// The entities built from the cached metrics are kept, with a warning in the response
+			glog.Warningf("Metrics exporter %v is stale: %v", metricExporter, staleErr)
+			errorDTOs = append(errorDTOs, newWarningDTO(fmt.Sprintf("Metrics exporter %v: %v", metricExporter, staleErr)))
+		} else if result.err != nil {
+			glog.Errorf("Error while querying metrics exporter %v: %v", metricExporter, result.err)
 			continue
 		}
 		allExportersFailed = false
-		entities = append(entities, dtos...)
+		entities = append(entities, result.dtos...)
 
-		glog.V(4).Infof("Entities built from exporter %v: %v", metricExporter, dtos)
+		glog.V(4).Infof("Entities built from exporter %v: %v", metricExporter, result.dtos)
 	}
 
 	// The discovery fails if all queries to exporters fail
@@ -80,32 +125,116 @@ func (d *P8sDiscoveryClient) Discover(accountValues []*proto.AccountValue) (*pro
 		return d.failDiscovery(), nil
 	}
 
+	// The virtual applications aggregate the commodities of the applications other than the ones of the calls
+	if virtualApps != nil {
+		entities = append(entities, virtualApps.Build()...)
+	}
+	// The hosted entities buy the commodities of the hosting entities other than the ones of the calls
+	if hostings != nil {
+		hostings.Build()
+	}
+	if callGraph != nil {
+		callGraph.Build()
+	}
+
+	if d.history != nil {
+		if err := d.history.Save(); err != nil {
+			glog.Errorf("Failed to save the capacity history: %v", err)
+		}
+	}
+
 	discoveryResponse := &proto.DiscoveryResponse{
 		EntityDTO: entities,
+		ErrorDTO:  errorDTOs,
 	}
 
 	return discoveryResponse, nil
 }
 
-func (d *P8sDiscoveryClient) buildEntities(metricExporter exporter.MetricExporter) ([]*proto.EntityDTO, error) {
+// exporterResult is the entities built from an exporter, or the error querying it
+type exporterResult struct {
+	dtos []*proto.EntityDTO
+	err  error
+}
+
+// queryExporters builds the entities from the exporters concurrently, with at most d.concurrency
+// exporters queried at the same time. The results are in the same order as the exporters.
+func (d *P8sDiscoveryClient) queryExporters(ctx context.Context, virtualApps *dtofactory.VirtualAppBuilder,
+	callGraph *dtofactory.CallGraphBuilder, hostings *dtofactory.HostingBuilder) []*exporterResult {
+	results := make([]*exporterResult, len(d.metricExporters))
+	workers := make(chan struct{}, d.concurrency)
+
+	var wg sync.WaitGroup
+	for i, metricExporter := range d.metricExporters {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(i int, metricExporter exporter.MetricExporter) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			dtos, err := d.buildEntities(ctx, metricExporter, virtualApps, callGraph, hostings)
+			results[i] = &exporterResult{dtos, err}
+		}(i, metricExporter)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// buildEntities builds the entities from the metrics of the exporter, and adds the applications to the virtual
+// applications and the call graph if any, and the entities to the hostings if any
+func (d *P8sDiscoveryClient) buildEntities(ctx context.Context, metricExporter exporter.MetricExporter,
+	virtualApps *dtofactory.VirtualAppBuilder, callGraph *dtofactory.CallGraphBuilder,
+	hostings *dtofactory.HostingBuilder) ([]*proto.EntityDTO, error) {
 	var entities []*proto.EntityDTO
 
-	metrics, err := metricExporter.Query()
-	if err != nil {
+	// The cached metrics are returned along with a StaleMetricsError
+	metrics, err := metricExporter.Query(ctx)
+	_, stale := err.(*exporter.StaleMetricsError)
+	if err != nil && !stale {
 		glog.Errorf("Error while querying metrics exporter: %v", err)
 		return nil, err
 	}
 
+	scope := d.scope
+	if scoped, ok := metricExporter.(exporter.ScopedExporter); ok && scoped.Scope() != "" {
+		scope = scoped.Scope()
+	}
+
 	for _, metric := range metrics {
-		dtos, err := dtofactory.NewEntityBuilder(d.scope, metric).Build()
+		dtos, err := dtofactory.NewEntityBuilder(scope, metric, d.metricConf).
+			WithCapacityHistory(d.history).
+			WithStaleMetrics(stale).
+			Build()
 		if err != nil {
 			glog.Errorf("Error building entity from metric %v: %s", metric, err)
 			continue
 		}
 		entities = append(entities, dtos...)
+
+		if virtualApps != nil {
+			for _, dto := range dtos {
+				virtualApps.Add(scope, metric.Labels, dto)
+			}
+		}
+		if callGraph != nil {
+			callGraph.Add(scope, metric, dtos)
+		}
+		if hostings != nil {
+			hostings.Add(scope, metric, dtos)
+		}
 	}
 
-	return entities, nil
+	return entities, err
+}
+
+func newWarningDTO(description string) *proto.ErrorDTO {
+	severity := proto.ErrorDTO_WARNING
+	return &proto.ErrorDTO{
+		Severity:    &severity,
+		Description: &description,
+	}
 }
 
 func (d *P8sDiscoveryClient) failDiscovery() *proto.DiscoveryResponse {
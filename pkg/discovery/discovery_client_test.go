@@ -1,11 +1,21 @@
 package discovery
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"fmt"
+	"github.com/golang/glog"
+	"github.com/turbonomic/prometurbo/pkg/conf"
 	"github.com/turbonomic/prometurbo/pkg/discovery/constant"
+	"github.com/turbonomic/prometurbo/pkg/discovery/dtofactory"
 	"github.com/turbonomic/prometurbo/pkg/discovery/exporter"
 	"github.com/turbonomic/turbo-go-sdk/pkg/builder"
 	"github.com/turbonomic/turbo-go-sdk/pkg/proto"
@@ -41,7 +51,7 @@ var (
 )
 
 func TestP8sDiscoveryClient_GetAccountValues(t *testing.T) {
-	d := NewDiscoveryClient(targetAddr, scope, []exporter.MetricExporter{})
+	d := NewDiscoveryClient(targetAddr, scope, []exporter.MetricExporter{}, conf.DefaultMetricConf(), time.Minute, 2, nil)
 
 	for _, f := range d.GetAccountValues().GetTargetInstance().InputFields {
 		if f.Name == "targetIdentifier" && f.Value == targetAddr {
@@ -57,9 +67,11 @@ func TestP8sDiscoveryClient_Discover(t *testing.T) {
 		metrics: metrics,
 	}
 
-	d := NewDiscoveryClient(targetAddr, scope, []exporter.MetricExporter{exporter1})
+	d := NewDiscoveryClient(targetAddr, scope, []exporter.MetricExporter{exporter1}, conf.DefaultMetricConf(), time.Minute, 2, nil)
 
-	testDiscoverySuccedded(d, metrics)
+	if err := testDiscoverySuccedded(d, metrics); err != nil {
+		t.Error(err)
+	}
 }
 
 func TestP8sDiscoveryClient_Discover_Two_Exporters(t *testing.T) {
@@ -71,9 +83,11 @@ func TestP8sDiscoveryClient_Discover_Two_Exporters(t *testing.T) {
 		metrics: metrics[2:],
 	}
 
-	d := NewDiscoveryClient(targetAddr, scope, []exporter.MetricExporter{exporter1, exporter2})
+	d := NewDiscoveryClient(targetAddr, scope, []exporter.MetricExporter{exporter1, exporter2}, conf.DefaultMetricConf(), time.Minute, 2, nil)
 
-	testDiscoverySuccedded(d, metrics)
+	if err := testDiscoverySuccedded(d, metrics); err != nil {
+		t.Error(err)
+	}
 }
 
 func TestP8sDiscoveryClient_Discover_Two_Exporters_One_Failed(t *testing.T) {
@@ -85,9 +99,11 @@ func TestP8sDiscoveryClient_Discover_Two_Exporters_One_Failed(t *testing.T) {
 		err: fmt.Errorf("Query failed with the mocked exporter"),
 	}
 
-	d := NewDiscoveryClient(targetAddr, scope, []exporter.MetricExporter{exporter1, exporter2})
+	d := NewDiscoveryClient(targetAddr, scope, []exporter.MetricExporter{exporter1, exporter2}, conf.DefaultMetricConf(), time.Minute, 2, nil)
 
-	testDiscoverySuccedded(d, metrics[0:2])
+	if err := testDiscoverySuccedded(d, metrics[0:2]); err != nil {
+		t.Error(err)
+	}
 }
 
 func TestP8sDiscoveryClient_Discover_Query_Failed(t *testing.T) {
@@ -99,7 +115,7 @@ func TestP8sDiscoveryClient_Discover_Query_Failed(t *testing.T) {
 		err: fmt.Errorf("Query failed with the mocked exporter"),
 	}
 
-	d := NewDiscoveryClient(targetAddr, scope, []exporter.MetricExporter{exporter1, exporter2})
+	d := NewDiscoveryClient(targetAddr, scope, []exporter.MetricExporter{exporter1, exporter2}, conf.DefaultMetricConf(), time.Minute, 2, nil)
 
 	res, err := d.Discover([]*proto.AccountValue{})
 
@@ -114,12 +130,794 @@ func TestP8sDiscoveryClient_Discover_Query_Failed(t *testing.T) {
 	}
 }
 
+func TestP8sDiscoveryClient_Discover_Query_Timeout(t *testing.T) {
+	exporter1 := &mockExporter{
+		metrics: metrics[0:2],
+	}
+
+	exporter2 := &mockExporter{
+		hang: true,
+	}
+
+	d := NewDiscoveryClient(targetAddr, scope, []exporter.MetricExporter{exporter1, exporter2},
+		conf.DefaultMetricConf(), 100*time.Millisecond, 2, nil)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- testDiscoverySuccedded(d, metrics[0:2])
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("P8sDiscoveryClient.Discover() didn't return after the timeout")
+	}
+}
+
+func TestP8sDiscoveryClient_Discover_Concurrency(t *testing.T) {
+	var inFlight, maxInFlight int32
+
+	// The later exporters return earlier, but the entities are expected in the order of the exporters
+	var exporters []exporter.MetricExporter
+	for i, metric := range metrics {
+		exporters = append(exporters, &mockExporter{
+			metrics:     []*exporter.EntityMetric{metric},
+			delay:       time.Duration(len(metrics)-i) * 20 * time.Millisecond,
+			inFlight:    &inFlight,
+			maxInFlight: &maxInFlight,
+		})
+	}
+
+	d := NewDiscoveryClient(targetAddr, scope, exporters, conf.DefaultMetricConf(), time.Minute, 2, nil)
+
+	if err := testDiscoverySuccedded(d, metrics); err != nil {
+		t.Error(err)
+	}
+
+	if maxInFlight != 2 {
+		t.Errorf("Expected at most 2 exporters queried at the same time but got %d", maxInFlight)
+	}
+}
+
+func TestP8sDiscoveryClient_Discover_Scoped_Exporter(t *testing.T) {
+	exporter1 := &mockExporter{
+		metrics: metrics[0:1],
+	}
+
+	exporter2 := exporter.NewConfiguredExporter("scoped", &mockExporter{
+		metrics: metrics[1:2],
+	}, time.Minute, "other-scope")
+
+	d := NewDiscoveryClient(targetAddr, scope, []exporter.MetricExporter{exporter1, exporter2},
+		conf.DefaultMetricConf(), time.Minute, 2, nil)
+
+	res, err := d.Discover([]*proto.AccountValue{})
+	if err != nil {
+		t.Fatalf("P8sDiscoveryClient.Discover() error = %v", err)
+	}
+
+	if len(res.EntityDTO) != 2 {
+		t.Fatalf("Expected 2 entities but got %d entities", len(res.EntityDTO))
+	}
+
+	expectedIds := []string{
+		appPrefix + scope + "/" + metrics[0].UID,
+		appPrefix + "other-scope/" + metrics[1].UID,
+	}
+	for i, entity := range res.EntityDTO {
+		if entity.GetId() != expectedIds[i] {
+			t.Errorf("Expected entity %s but got %s", expectedIds[i], entity.GetId())
+		}
+	}
+}
+
+func TestP8sDiscoveryClient_Discover_Stale_Metrics(t *testing.T) {
+	exporter1 := &mockExporter{
+		metrics: metrics[0:2],
+	}
+
+	exporter2 := &mockExporter{
+		metrics: metrics[2:],
+		err: &exporter.StaleMetricsError{
+			Age: time.Minute,
+			Err: fmt.Errorf("Query failed with the mocked exporter"),
+		},
+	}
+
+	d := NewDiscoveryClient(targetAddr, scope, []exporter.MetricExporter{exporter1, exporter2},
+		conf.DefaultMetricConf(), time.Minute, 2, nil)
+
+	res, err := d.Discover([]*proto.AccountValue{})
+	if err != nil {
+		t.Fatalf("P8sDiscoveryClient.Discover() error = %v", err)
+	}
+
+	// The entities of the stale metrics are kept with a warning
+	if len(res.EntityDTO) != len(metrics) {
+		t.Errorf("Expected %d entities but got %d entities", len(metrics), len(res.EntityDTO))
+	}
+
+	if len(res.ErrorDTO) != 1 || *res.ErrorDTO[0].Severity != proto.ErrorDTO_WARNING {
+		t.Errorf("Expected one error DTO with serverity WARNING but got %v", res.ErrorDTO)
+	}
+}
+
+func TestP8sDiscoveryClient_Discover_Units(t *testing.T) {
+	inSeconds := newMetric("1.2.3.4", 10, 0.25, constant.ApplicationType)
+	inSeconds.Units = map[string]string{constant.Latency: "s"}
+	unknown := newMetric("5.6.7.8", 10, 0.25, constant.ApplicationType)
+	unknown.Units = map[string]string{constant.Latency: "fortnights"}
+
+	exporter1 := &mockExporter{
+		metrics: []*exporter.EntityMetric{inSeconds, unknown},
+	}
+
+	d := NewDiscoveryClient(targetAddr, scope, []exporter.MetricExporter{exporter1}, conf.DefaultMetricConf(), time.Minute, 2, nil)
+
+	res, err := d.Discover([]*proto.AccountValue{})
+	if err != nil {
+		t.Fatalf("P8sDiscoveryClient.Discover() error = %v", err)
+	}
+	if len(res.EntityDTO) != 2 {
+		t.Fatalf("Expected 2 entities but got %d entities", len(res.EntityDTO))
+	}
+
+	// The response time is converted to milliseconds
+	if err := checkAppResult(newMetric("1.2.3.4", 10, 250, constant.ApplicationType), res.EntityDTO[0]); err != nil {
+		t.Error(err)
+	}
+
+	// The metric in an unknown unit is rejected
+	if commodities := res.EntityDTO[1].GetCommoditiesSold(); len(commodities) != 1 ||
+		commodities[0].GetCommodityType() != proto.CommodityDTO_TRANSACTION {
+		t.Errorf("Expected only the transaction commodity but got %v", commodities)
+	}
+}
+
+func TestP8sDiscoveryClient_Discover_Capacities(t *testing.T) {
+	metricConf := conf.DefaultMetricConf()
+	entity := metricConf.Entities[0]
+	entity.Commodities[1].CapacityLabel = "slo_latency"
+	entity.CapacityOverrides = []*conf.CapacityOverride{
+		{Selector: map[string]string{"app": "checkout"}, Capacities: map[string]float64{constant.Latency: 300}},
+	}
+
+	reported := newMetric("1.2.3.4", 10, 100, constant.ApplicationType)
+	reported.Metrics[constant.Latency+constant.CapacitySuffix] = 1000
+	reported.Labels = map[string]string{"app": "checkout", "slo_latency": "800"}
+	labeled := newMetric("1.2.3.5", 10, 100, constant.ApplicationType)
+	labeled.Labels = map[string]string{"app": "checkout", "slo_latency": "800"}
+	overridden := newMetric("1.2.3.6", 10, 100, constant.ApplicationType)
+	overridden.Labels = map[string]string{"app": "checkout"}
+	configured := newMetric("1.2.3.7", 10, 100, constant.ApplicationType)
+
+	exporter1 := &mockExporter{
+		metrics: []*exporter.EntityMetric{reported, labeled, overridden, configured},
+	}
+
+	d := NewDiscoveryClient(targetAddr, scope, []exporter.MetricExporter{exporter1}, metricConf, time.Minute, 2, nil)
+
+	res, err := d.Discover([]*proto.AccountValue{})
+	if err != nil {
+		t.Fatalf("P8sDiscoveryClient.Discover() error = %v", err)
+	}
+
+	expected := []float64{1000, 800, 300, constant.LatencyCap}
+	if len(res.EntityDTO) != len(expected) {
+		t.Fatalf("Expected %d entities but got %d entities", len(expected), len(res.EntityDTO))
+	}
+	for i, entity := range res.EntityDTO {
+		for _, comm := range entity.GetCommoditiesSold() {
+			if comm.GetCommodityType() == proto.CommodityDTO_RESPONSE_TIME && comm.GetCapacity() != expected[i] {
+				t.Errorf("Expected capacity %v of %s but got %v", expected[i], entity.GetId(), comm.GetCapacity())
+			}
+		}
+	}
+}
+
+func TestP8sDiscoveryClient_Discover_SLO_Capacities(t *testing.T) {
+	metricConf := conf.DefaultMetricConf()
+	metricConf.Entities[0].CapacityOverrides = []*conf.CapacityOverride{
+		{Selector: map[string]string{"app": "checkout"}, Capacities: map[string]float64{constant.Latency: 800}},
+	}
+	metricConf.SLOs = []*conf.SLO{
+		{Name: "checkout-latency", Selector: map[string]string{"app": "checkout"}, ResponseTime: 300},
+	}
+
+	matched := newMetric("1.2.3.4", 10, 100, constant.ApplicationType)
+	matched.Labels = map[string]string{"app": "checkout"}
+	unmatched := newMetric("1.2.3.5", 10, 100, constant.ApplicationType)
+
+	exporter1 := &mockExporter{
+		metrics: []*exporter.EntityMetric{matched, unmatched},
+	}
+	d := NewDiscoveryClient(targetAddr, scope, []exporter.MetricExporter{exporter1}, metricConf, time.Minute, 2, nil)
+
+	res, err := d.Discover([]*proto.AccountValue{})
+	if err != nil || len(res.EntityDTO) != 2 {
+		t.Fatalf("P8sDiscoveryClient.Discover() = %v, %v", res, err)
+	}
+
+	tests := []struct {
+		capacities map[proto.CommodityDTO_CommodityType]float64
+		slo        string
+	}{
+		// The SLO has no throughput budget, so the default capacity applies to the transactions
+		{map[proto.CommodityDTO_CommodityType]float64{
+			proto.CommodityDTO_RESPONSE_TIME: 300,
+			proto.CommodityDTO_TRANSACTION:   constant.TPSCap,
+		}, "checkout-latency"},
+		{map[proto.CommodityDTO_CommodityType]float64{
+			proto.CommodityDTO_RESPONSE_TIME: constant.LatencyCap,
+			proto.CommodityDTO_TRANSACTION:   constant.TPSCap,
+		}, ""},
+	}
+	for i, test := range tests {
+		entity := res.EntityDTO[i]
+		for _, comm := range entity.GetCommoditiesSold() {
+			if expected := test.capacities[comm.GetCommodityType()]; comm.GetCapacity() != expected {
+				t.Errorf("Expected capacity %v of %v of %s but got %v",
+					expected, comm.GetCommodityType(), entity.GetId(), comm.GetCapacity())
+			}
+		}
+
+		slo := ""
+		for _, prop := range entity.GetEntityProperties() {
+			if prop.GetName() == constant.SLOProperty {
+				slo = prop.GetValue()
+			}
+		}
+		if slo != test.slo {
+			t.Errorf("Expected SLO %q of %s but got %q", test.slo, entity.GetId(), slo)
+		}
+	}
+}
+
+func TestP8sDiscoveryClient_Discover_VirtualApplications(t *testing.T) {
+	metricConf := conf.DefaultMetricConf()
+	metricConf.Entities[0].ServiceLabel = "service"
+
+	app1 := newMetric("1.2.3.4", 10, 100, constant.ApplicationType)
+	app1.Labels = map[string]string{"service": "checkout"}
+	app2 := newMetric("1.2.3.5", 30, 200, constant.ApplicationType)
+	app2.Labels = map[string]string{"service": "checkout"}
+	standalone := newMetric("1.2.3.6", 10, 100, constant.ApplicationType)
+
+	exporter1 := &mockExporter{
+		metrics: []*exporter.EntityMetric{app1, app2, standalone},
+	}
+	d := NewDiscoveryClient(targetAddr, scope, []exporter.MetricExporter{exporter1}, metricConf, time.Minute, 2, nil)
+
+	res, err := d.Discover([]*proto.AccountValue{})
+	if err != nil || len(res.EntityDTO) != 4 {
+		t.Fatalf("P8sDiscoveryClient.Discover() = %v, %v", res, err)
+	}
+
+	vapp := res.EntityDTO[3]
+	if vapp.GetEntityType() != proto.EntityDTO_VIRTUAL_APPLICATION || vapp.GetDisplayName() != "checkout" {
+		t.Fatalf("Expected the virtual application of checkout but got %v", vapp)
+	}
+
+	// The transactions are summed up and the response times are weighted by the transactions
+	expected := map[proto.CommodityDTO_CommodityType]float64{
+		proto.CommodityDTO_TRANSACTION:   40,
+		proto.CommodityDTO_RESPONSE_TIME: 175,
+	}
+	for _, comm := range vapp.GetCommoditiesSold() {
+		if comm.GetUsed() != expected[comm.GetCommodityType()] {
+			t.Errorf("Expected %v of %v but got %v", expected[comm.GetCommodityType()], comm.GetCommodityType(), comm.GetUsed())
+		}
+	}
+
+	var providers []string
+	for _, bought := range vapp.GetCommoditiesBought() {
+		providers = append(providers, bought.GetProviderId())
+		if len(bought.GetBought()) != 2 {
+			t.Errorf("Expected 2 commodities bought from %s but got %v", bought.GetProviderId(), bought.GetBought())
+		}
+	}
+	// The SDK builder keeps the providers in a map, so they are bought from in no particular order
+	sort.Strings(providers)
+	expectedProviders := []string{res.EntityDTO[0].GetId(), res.EntityDTO[1].GetId()}
+	if !reflect.DeepEqual(providers, expectedProviders) {
+		t.Errorf("Expected providers %v but got %v", expectedProviders, providers)
+	}
+}
+
+func TestP8sDiscoveryClient_Discover_VirtualMachines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometurbo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := map[string]struct {
+		metricConf string
+		attr       string
+		value      string
+		external   string
+	}{
+		"node-exporter preset stitched by IP": {
+			metricConf: `
+presets: [node-exporter]
+`,
+			attr:     "IP",
+			value:    "10.0.0.1",
+			external: "UsesEndPoints",
+		},
+		"stitched by hostname": {
+			metricConf: `
+entities:
+- type: VIRTUAL_MACHINE
+  uidLabel: ip
+  stitchingLabel: nodename
+  stitchingAttr: hostname
+  commodities:
+  - {name: memory, type: VMEM, capacity: 1073741824, unit: bytes}
+`,
+			attr:     "hostname",
+			value:    "node-1",
+			external: "displayName",
+		},
+	}
+
+	for name, tt := range tests {
+		path := filepath.Join(dir, "metrics.yaml")
+		if err := ioutil.WriteFile(path, []byte(tt.metricConf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		metricConf, err := conf.NewMetricConf(path)
+		if err != nil {
+			t.Fatalf("%s: NewMetricConf() error = %v", name, err)
+		}
+
+		vm := &exporter.EntityMetric{
+			UID:  "10.0.0.1",
+			Type: int32(proto.EntityDTO_VIRTUAL_MACHINE),
+			Metrics: map[string]float64{
+				"memory":                           2 << 30,
+				"memory" + constant.CapacitySuffix: 4 << 30,
+			},
+			Labels: map[string]string{"ip": "10.0.0.1", "nodename": "node-1"},
+		}
+		exporter1 := &mockExporter{
+			metrics: []*exporter.EntityMetric{vm},
+		}
+		d := NewDiscoveryClient(targetAddr, scope, []exporter.MetricExporter{exporter1}, metricConf, time.Minute, 2, nil)
+
+		res, err := d.Discover([]*proto.AccountValue{})
+		if err != nil || len(res.EntityDTO) != 1 {
+			t.Fatalf("%s: P8sDiscoveryClient.Discover() = %v, %v", name, res, err)
+		}
+		entity := res.EntityDTO[0]
+
+		// The memory is converted to KB
+		commodities := entity.GetCommoditiesSold()
+		if len(commodities) != 1 || commodities[0].GetCommodityType() != proto.CommodityDTO_VMEM ||
+			commodities[0].GetUsed() != 2<<20 || commodities[0].GetCapacity() != 4<<20 {
+			t.Errorf("%s: Unexpected commodities %v", name, commodities)
+		}
+
+		props := entity.GetEntityProperties()
+		if len(props) != 1 || props[0].GetName() != tt.attr || props[0].GetValue() != tt.value {
+			t.Errorf("%s: Expected property %s=%s but got %v", name, tt.attr, tt.value, props)
+		}
+
+		metaData := entity.GetReplacementEntityData()
+		if !reflect.DeepEqual(metaData.GetIdentifyingProp(), []string{tt.attr}) ||
+			len(metaData.GetExtEntityPropDef()) != 1 ||
+			metaData.GetExtEntityPropDef()[0].GetEntity() != proto.EntityDTO_VIRTUAL_MACHINE ||
+			metaData.GetExtEntityPropDef()[0].GetAttribute() != tt.external {
+			t.Errorf("%s: Unexpected replacement metadata %v", name, metaData)
+		}
+	}
+}
+
+func TestP8sDiscoveryClient_Discover_Hosted_DatabaseServers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometurbo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "metrics.yaml")
+	if err := ioutil.WriteFile(path, []byte(`
+presets: [cadvisor, mysqld-exporter]
+entities:
+- type: DATABASE_SERVER
+  provider: {type: CONTAINER, label: namespace_pod_container}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	metricConf, err := conf.NewMetricConf(path)
+	if err != nil {
+		t.Fatalf("NewMetricConf() error = %v", err)
+	}
+
+	// The labels of the series of the presets, where the UIDs of the containers are in namespace_pod_container
+	container := &exporter.EntityMetric{
+		UID:     "db/mysql-0/mysql",
+		Type:    int32(proto.EntityDTO_CONTAINER),
+		Metrics: map[string]float64{"cpu": 200, "memory": 4096},
+		Labels: map[string]string{"namespace": "db", "pod": "mysql-0", "container": "mysql",
+			"namespace_pod_container": "db/mysql-0/mysql"},
+	}
+	hosted := &exporter.EntityMetric{
+		UID:     "10.0.0.1",
+		Type:    int32(proto.EntityDTO_DATABASE_SERVER),
+		Metrics: map[string]float64{"connections": 10, "cacheHitRate": 99},
+		Labels: map[string]string{"ip": "10.0.0.1", "instance": "10.0.0.1:9104", "namespace": "db",
+			"pod": "mysql-0", "container": "mysql", "namespace_pod_container": "db/mysql-0/mysql"},
+	}
+	unhosted := &exporter.EntityMetric{
+		UID:     "10.0.0.2",
+		Type:    int32(proto.EntityDTO_DATABASE_SERVER),
+		Metrics: map[string]float64{"connections": 10},
+		Labels: map[string]string{"ip": "10.0.0.2", "instance": "10.0.0.2:9104", "namespace": "db",
+			"pod": "mysql-gone", "container": "mysql", "namespace_pod_container": "db/mysql-gone/mysql"},
+	}
+	exporter1 := &mockExporter{
+		metrics: []*exporter.EntityMetric{container, hosted, unhosted},
+	}
+	d := NewDiscoveryClient(targetAddr, scope, []exporter.MetricExporter{exporter1}, metricConf, time.Minute, 2, nil)
+
+	warnings := glog.Stats.Warning.Lines()
+	res, err := d.Discover([]*proto.AccountValue{})
+	if err != nil || len(res.EntityDTO) != 3 {
+		t.Fatalf("P8sDiscoveryClient.Discover() = %v, %v", res, err)
+	}
+
+	// The database server is stitched by the IP of the instance without the port
+	db := res.EntityDTO[1]
+	if props := db.GetEntityProperties(); len(props) != 1 || props[0].GetName() != ipAttr ||
+		props[0].GetValue() != "10.0.0.1" {
+		t.Errorf("Expected the IP 10.0.0.1 of the database server but got %v", props)
+	}
+
+	// The database server buys the commodities sold by its container
+	bought := db.GetCommoditiesBought()
+	if len(bought) != 1 || bought[0].GetProviderId() != res.EntityDTO[0].GetId() ||
+		bought[0].GetProviderType() != proto.EntityDTO_CONTAINER || len(bought[0].GetBought()) != 2 {
+		t.Errorf("Expected VCPU and VMEM bought from the container but got %v", bought)
+	}
+
+	// The database server hosted by an undiscovered container buys nothing, with a warning
+	if bought := res.EntityDTO[2].GetCommoditiesBought(); len(bought) != 0 {
+		t.Errorf("Expected nothing bought but got %v", bought)
+	}
+	if glog.Stats.Warning.Lines() == warnings {
+		t.Errorf("Expected a warning of the undiscovered container")
+	}
+}
+
+func TestP8sDiscoveryClient_Discover_JVM_Applications(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometurbo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "metrics.yaml")
+	if err := ioutil.WriteFile(path, []byte(`
+presets: [jmx-exporter]
+entities:
+- type: APPLICATION
+  uidLabel: destination_ip
+  commodities:
+  - {name: tps, type: TRANSACTION, capacity: 20}
+  - {name: latency, type: RESPONSE_TIME, capacity: 500, unit: ms}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	metricConf, err := conf.NewMetricConf(path)
+	if err != nil {
+		t.Fatalf("NewMetricConf() error = %v", err)
+	}
+
+	// The JVM metrics carry the IP of the instance of jmx_exporter in the UID label of the applications
+	app := newMetric("10.1.2.3", 10, 100, constant.ApplicationType)
+	app.Labels = map[string]string{"destination_ip": "10.1.2.3", "ip": "10.1.2.3", "instance": "10.1.2.3:9404"}
+	app.Metrics["heap"] = 256 << 20
+	app.Metrics["heap"+constant.CapacitySuffix] = 512 << 20
+	app.Metrics["gcTime"] = 0.05
+	app.Metrics["threads"] = 40
+	exporter1 := &mockExporter{
+		metrics: []*exporter.EntityMetric{app},
+	}
+	d := NewDiscoveryClient(targetAddr, scope, []exporter.MetricExporter{exporter1}, metricConf, time.Minute, 2, nil)
+
+	res, err := d.Discover([]*proto.AccountValue{})
+	if err != nil || len(res.EntityDTO) != 1 {
+		t.Fatalf("P8sDiscoveryClient.Discover() = %v, %v", res, err)
+	}
+
+	// The heap is in KB with the capacity of the max heap, and the GC time is in %
+	expected := map[proto.CommodityDTO_CommodityType][2]float64{
+		proto.CommodityDTO_TRANSACTION:     {10, 20},
+		proto.CommodityDTO_RESPONSE_TIME:   {100, 500},
+		proto.CommodityDTO_HEAP:            {256 << 10, 512 << 10},
+		proto.CommodityDTO_COLLECTION_TIME: {5, 100},
+		proto.CommodityDTO_THREADS:         {40, 1000},
+	}
+	commodities := res.EntityDTO[0].GetCommoditiesSold()
+	if len(commodities) != len(expected) {
+		t.Fatalf("Expected %d commodities but got %v", len(expected), commodities)
+	}
+	if props := res.EntityDTO[0].GetEntityProperties(); len(props) != 1 || props[0].GetName() != ipAttr ||
+		props[0].GetValue() != "10.1.2.3" {
+		t.Errorf("Expected the IP 10.1.2.3 of the application but got %v", props)
+	}
+	for _, comm := range commodities {
+		values := expected[comm.GetCommodityType()]
+		if math.Abs(comm.GetUsed()-values[0]) > 1e-9 || comm.GetCapacity() != values[1] {
+			t.Errorf("Expected %v of %v but got %v", values, comm.GetCommodityType(), comm)
+		}
+	}
+}
+
+func TestP8sDiscoveryClient_Discover_Containers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometurbo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "metrics.yaml")
+	if err := ioutil.WriteFile(path, []byte(`
+presets: [cadvisor]
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	metricConf, err := conf.NewMetricConf(path)
+	if err != nil {
+		t.Fatalf("NewMetricConf() error = %v", err)
+	}
+
+	container := &exporter.EntityMetric{
+		UID:  "shop/checkout-0/app",
+		Type: int32(proto.EntityDTO_CONTAINER),
+		Metrics: map[string]float64{
+			"cpu":                           250,
+			"cpu" + constant.PeakSuffix:     400,
+			"cpu" + constant.CapacitySuffix: 500,
+			"memory":                        256 << 20,
+		},
+		Labels: map[string]string{"namespace": "shop", "pod": "checkout-0", "container": "app"},
+	}
+	exporter1 := &mockExporter{
+		metrics: []*exporter.EntityMetric{container},
+	}
+	d := NewDiscoveryClient(targetAddr, scope, []exporter.MetricExporter{exporter1}, metricConf, time.Minute, 2, nil)
+
+	res, err := d.Discover([]*proto.AccountValue{})
+	if err != nil || len(res.EntityDTO) != 1 {
+		t.Fatalf("P8sDiscoveryClient.Discover() = %v, %v", res, err)
+	}
+	entity := res.EntityDTO[0]
+
+	expectedProps := map[string]string{
+		"KubernetesNamespace":     "shop",
+		"KubernetesPodName":       "checkout-0",
+		"KubernetesContainerName": "app",
+	}
+	props := entity.GetEntityProperties()
+	if len(props) != len(expectedProps) {
+		t.Fatalf("Expected properties %v but got %v", expectedProps, props)
+	}
+	for _, prop := range props {
+		if expectedProps[prop.GetName()] != prop.GetValue() {
+			t.Errorf("Expected property %s=%s but got %s", prop.GetName(), expectedProps[prop.GetName()], prop.GetValue())
+		}
+	}
+
+	// The containers of kubeturbo are matched by all the properties, and patched by the used values and the peaks
+	containerType := proto.EntityDTO_CONTAINER
+	expectedBuilder := builder.NewReplacementEntityMetaDataBuilder()
+	for _, name := range []string{"KubernetesNamespace", "KubernetesPodName", "KubernetesContainerName"} {
+		name := name
+		expectedBuilder.Matching(name).
+			MatchingExternal(&proto.ServerEntityPropDef{
+				Entity:    &containerType,
+				Attribute: &name,
+			})
+	}
+	expected := expectedBuilder.
+		PatchSellingWithProperty(proto.CommodityDTO_VCPU, []string{constant.Used, constant.Peak}).
+		PatchSellingWithProperty(proto.CommodityDTO_VMEM, []string{constant.Used}).
+		Build()
+	if !reflect.DeepEqual(entity.GetReplacementEntityData(), expected) {
+		t.Errorf("Expected replacement metadata %v but got %v", expected, entity.GetReplacementEntityData())
+	}
+}
+
+func TestP8sDiscoveryClient_Discover_CallGraph(t *testing.T) {
+	metricConf := conf.DefaultMetricConf()
+	metricConf.CallGraph = &conf.CallGraphConf{Query: "calls", LatencyUnit: "s"}
+
+	frontend := &exporter.EntityMetric{
+		UID:     "frontend",
+		Type:    constant.ApplicationType,
+		Metrics: map[string]float64{},
+		Calls: map[string]map[string]float64{
+			"checkout": {constant.TPS: 4, constant.Latency: 0.025},
+			"gone":     {constant.TPS: 1},
+		},
+	}
+	checkout := newMetric("checkout", 10, 100, constant.ApplicationType)
+
+	exporter1 := &mockExporter{
+		metrics: []*exporter.EntityMetric{frontend, checkout},
+	}
+	d := NewDiscoveryClient(targetAddr, scope, []exporter.MetricExporter{exporter1}, metricConf, time.Minute, 2, nil)
+
+	res, err := d.Discover([]*proto.AccountValue{})
+	if err != nil || len(res.EntityDTO) != 2 {
+		t.Fatalf("P8sDiscoveryClient.Discover() = %v, %v", res, err)
+	}
+	caller, callee := res.EntityDTO[0], res.EntityDTO[1]
+
+	// The callee sells the commodities of the call along with its own
+	key := "frontend->checkout"
+	expected := map[proto.CommodityDTO_CommodityType]float64{
+		proto.CommodityDTO_TRANSACTION:   4,
+		proto.CommodityDTO_RESPONSE_TIME: 25,
+	}
+	sold := 0
+	for _, comm := range callee.GetCommoditiesSold() {
+		if comm.GetKey() != key {
+			continue
+		}
+		sold++
+		if comm.GetUsed() != expected[comm.GetCommodityType()] || comm.GetCapacity() < comm.GetUsed() {
+			t.Errorf("Unexpected commodity %v of call %s", comm, key)
+		}
+	}
+	if sold != 2 {
+		t.Errorf("Expected 2 commodities of call %s sold by %s but got %d", key, callee.GetId(), sold)
+	}
+
+	// The call to the undiscovered application is dropped
+	bought := caller.GetCommoditiesBought()
+	if len(bought) != 1 || bought[0].GetProviderId() != callee.GetId() || len(bought[0].GetBought()) != 2 {
+		t.Fatalf("Unexpected commodities bought by %s: %v", caller.GetId(), bought)
+	}
+	for _, comm := range bought[0].GetBought() {
+		if comm.GetKey() != key || comm.GetUsed() != expected[comm.GetCommodityType()] {
+			t.Errorf("Unexpected commodity %v bought by %s", comm, caller.GetId())
+		}
+	}
+}
+
+func TestP8sDiscoveryClient_Discover_Inferred_Capacities(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometurbo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history.json")
+
+	metricConf := conf.DefaultMetricConf()
+	metricConf.Entities[0].Commodities[1].CapacityInference = &conf.CapacityInferenceConf{
+		Method:   conf.AggregationMax,
+		Headroom: 1.5,
+		Floor:    200,
+	}
+
+	discover := func(history *dtofactory.CapacityHistory, latency float64) float64 {
+		exporter1 := &mockExporter{
+			metrics: []*exporter.EntityMetric{newMetric("1.2.3.4", 10, latency, constant.ApplicationType)},
+		}
+		d := NewDiscoveryClient(targetAddr, scope, []exporter.MetricExporter{exporter1}, metricConf, time.Minute, 2, history)
+
+		res, err := d.Discover([]*proto.AccountValue{})
+		if err != nil || len(res.EntityDTO) != 1 {
+			t.Fatalf("P8sDiscoveryClient.Discover() = %v, %v", res, err)
+		}
+		for _, comm := range res.EntityDTO[0].GetCommoditiesSold() {
+			if comm.GetCommodityType() == proto.CommodityDTO_RESPONSE_TIME {
+				return comm.GetCapacity()
+			}
+		}
+		t.Fatalf("No response time commodity in %v", res.EntityDTO[0])
+		return 0
+	}
+
+	history := dtofactory.NewCapacityHistory(path)
+	// The floor applies to the short history
+	if capacity := discover(history, 100); capacity != 200 {
+		t.Errorf("Expected capacity 200 but got %v", capacity)
+	}
+	if capacity := discover(history, 300); capacity != 450 {
+		t.Errorf("Expected capacity 450 but got %v", capacity)
+	}
+
+	// The high-water mark survives a restart
+	if capacity := discover(dtofactory.NewCapacityHistory(path), 50); capacity != 450 {
+		t.Errorf("Expected capacity 450 after a restart but got %v", capacity)
+	}
+}
+
+func TestP8sDiscoveryClient_Discover_Inferred_Capacities_Below_Used(t *testing.T) {
+	metricConf := conf.DefaultMetricConf()
+	metricConf.Entities[0].Commodities[1].CapacityInference = &conf.CapacityInferenceConf{
+		Method:   conf.AggregationAvg,
+		Headroom: 1,
+	}
+	history := dtofactory.NewCapacityHistory("")
+
+	discover := func(latency float64, err error) *proto.CommodityDTO {
+		exporter1 := &mockExporter{
+			metrics: []*exporter.EntityMetric{newMetric("1.2.3.4", 10, latency, constant.ApplicationType)},
+			err:     err,
+		}
+		d := NewDiscoveryClient(targetAddr, scope, []exporter.MetricExporter{exporter1}, metricConf, time.Minute, 2, history)
+
+		res, err := d.Discover([]*proto.AccountValue{})
+		if err != nil || len(res.EntityDTO) != 1 {
+			t.Fatalf("P8sDiscoveryClient.Discover() = %v, %v", res, err)
+		}
+		for _, comm := range res.EntityDTO[0].GetCommoditiesSold() {
+			if comm.GetCommodityType() == proto.CommodityDTO_RESPONSE_TIME {
+				return comm
+			}
+		}
+		t.Fatalf("No response time commodity in %v", res.EntityDTO[0])
+		return nil
+	}
+
+	discover(100, nil)
+	discover(100, nil)
+
+	// The inferred capacity below the used value is kept, with a warning
+	warnings := glog.Stats.Warning.Lines()
+	if comm := discover(400, nil); comm.GetUsed() != 400 || comm.GetCapacity() != 200 {
+		t.Errorf("Expected used 400 of capacity 200 but got %v", comm)
+	}
+	if glog.Stats.Warning.Lines() == warnings {
+		t.Errorf("Expected a warning of the used value above the capacity")
+	}
+
+	// The stale metrics are not recorded in the history, but the capacity is still inferred from it
+	stale := &exporter.StaleMetricsError{Age: time.Minute, Err: fmt.Errorf("Query failed with the mocked exporter")}
+	if comm := discover(1000, stale); comm.GetUsed() != 1000 || comm.GetCapacity() != 200 {
+		t.Errorf("Expected used 1000 of capacity 200 of the stale metrics but got %v", comm)
+	}
+	if comm := discover(100, nil); comm.GetCapacity() != 175 {
+		t.Errorf("Expected capacity 175 without the stale value but got %v", comm.GetCapacity())
+	}
+}
+
 type mockExporter struct {
 	metrics []*exporter.EntityMetric
 	err     error
+	// Never returns until the context is done
+	hang bool
+	// The time taken by the query
+	delay time.Duration
+	// The counters of the queries in flight shared by the exporters
+	inFlight    *int32
+	maxInFlight *int32
 }
 
-func (m *mockExporter) Query() ([]*exporter.EntityMetric, error) {
+func (m *mockExporter) Query(ctx context.Context) ([]*exporter.EntityMetric, error) {
+	if m.inFlight != nil {
+		n := atomic.AddInt32(m.inFlight, 1)
+		defer atomic.AddInt32(m.inFlight, -1)
+		for {
+			max := atomic.LoadInt32(m.maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(m.maxInFlight, max, n) {
+				break
+			}
+		}
+	}
+	if m.hang {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	time.Sleep(m.delay)
 	return m.metrics, m.err
 }
 
@@ -0,0 +1,149 @@
+package dtofactory
+
+import (
+	"github.com/golang/glog"
+	"github.com/turbonomic/prometurbo/pkg/conf"
+	"github.com/turbonomic/prometurbo/pkg/discovery/constant"
+	"github.com/turbonomic/prometurbo/pkg/discovery/exporter"
+	"github.com/turbonomic/turbo-go-sdk/pkg/proto"
+	"sort"
+	"sync"
+)
+
+// CallGraphBuilder connects the applications by their calls. The called application sells the transactions and
+// the response times of each call keyed by the call, which the calling application buys.
+type CallGraphBuilder struct {
+	metricConf *conf.MetricConf
+
+	// The applications and the calls are added concurrently from the exporters
+	lock sync.Mutex
+	// The applications keyed by their IDs
+	apps  map[string]*proto.EntityDTO
+	calls []*call
+}
+
+type call struct {
+	// The IDs of the calling and the called applications
+	source, destination string
+	// The key of the commodities of the call
+	key     string
+	metrics map[string]float64
+}
+
+func NewCallGraphBuilder(metricConf *conf.MetricConf) *CallGraphBuilder {
+	return &CallGraphBuilder{
+		metricConf: metricConf,
+		apps:       make(map[string]*proto.EntityDTO),
+	}
+}
+
+// Add adds the applications built from the metric, along with the calls from the application of the metric
+func (b *CallGraphBuilder) Add(scope string, metric *exporter.EntityMetric, dtos []*proto.EntityDTO) {
+	if metric.Type != constant.ApplicationType {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, dto := range dtos {
+		b.apps[dto.GetId()] = dto
+	}
+
+	for destination, metrics := range metric.Calls {
+		b.calls = append(b.calls, &call{
+			source:      entityId(proto.EntityDTO_APPLICATION, scope, metric.UID),
+			destination: entityId(proto.EntityDTO_APPLICATION, scope, destination),
+			key:         metric.UID + "->" + destination,
+			metrics:     metrics,
+		})
+	}
+}
+
+// Build adds the commodities of the calls to the applications, in the order of the calls. The calls from or to
+// the applications which are not discovered are dropped.
+func (b *CallGraphBuilder) Build() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	sort.Slice(b.calls, func(i, j int) bool {
+		if b.calls[i].source != b.calls[j].source {
+			return b.calls[i].source < b.calls[j].source
+		}
+		return b.calls[i].destination < b.calls[j].destination
+	})
+
+	for _, c := range b.calls {
+		source, ok := b.apps[c.source]
+		if !ok {
+			glog.V(3).Infof("Skipping call %s from the undiscovered application %s", c.key, c.source)
+			continue
+		}
+		destination, ok := b.apps[c.destination]
+		if !ok {
+			glog.V(3).Infof("Skipping call %s to the undiscovered application %s", c.key, c.destination)
+			continue
+		}
+
+		if err := b.addCall(c, source, destination); err != nil {
+			glog.Errorf("Error building the commodities of call %s: %v", c.key, err)
+		}
+	}
+}
+
+// addCall adds the commodities of the call sold by the called application and bought by the calling application.
+// The capacities are the ones of the commodities sold by the called application, or else the default capacities.
+func (b *CallGraphBuilder) addCall(c *call, source, destination *proto.EntityDTO) error {
+	values := make(map[proto.CommodityDTO_CommodityType]float64)
+	if tps, ok := c.metrics[constant.TPS]; ok {
+		values[proto.CommodityDTO_TRANSACTION] = tps
+	}
+	if latency, ok := c.metrics[constant.Latency]; ok {
+		target, _ := conf.CommodityUnit(proto.CommodityDTO_RESPONSE_TIME)
+		converted, err := conf.ConvertUnit(latency, b.metricConf.CallGraph.LatencyUnit, target)
+		if err != nil {
+			return err
+		}
+		values[proto.CommodityDTO_RESPONSE_TIME] = converted
+	}
+
+	sold := soldCommodities(destination)
+	var bought []*proto.CommodityDTO
+	for _, commType := range []proto.CommodityDTO_CommodityType{
+		proto.CommodityDTO_TRANSACTION,
+		proto.CommodityDTO_RESPONSE_TIME,
+	} {
+		used, ok := values[commType]
+		if !ok {
+			continue
+		}
+
+		capacity := used
+		if commodity, ok := sold[commType]; ok {
+			capacity = commodity.GetCapacity()
+		} else if defaultCapacity, ok := b.metricConf.DefaultCapacity(commType); ok {
+			capacity = defaultCapacity
+		}
+
+		commodity, err := newSoldCommodity(commType, c.key, used, capacity)
+		if err != nil {
+			return err
+		}
+		destination.CommoditiesSold = append(destination.CommoditiesSold, commodity)
+		bought = append(bought, newBoughtCommodity(commodity))
+	}
+
+	if len(bought) == 0 {
+		return nil
+	}
+
+	providerId := destination.GetId()
+	providerType := proto.EntityDTO_APPLICATION
+	source.CommoditiesBought = append(source.CommoditiesBought, &proto.EntityDTO_CommodityBought{
+		ProviderId:   &providerId,
+		ProviderType: &providerType,
+		Bought:       bought,
+	})
+
+	return nil
+}
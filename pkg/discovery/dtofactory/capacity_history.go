@@ -0,0 +1,152 @@
+package dtofactory
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// CapacityHistory keeps the values of the commodities of the entities observed across the discoveries,
+// from which the capacities are inferred. The history is persisted in a file if a path is given,
+// so that the inferred capacities survive the restarts.
+type CapacityHistory struct {
+	path string
+
+	lock   sync.Mutex
+	series map[string]*historySeries
+}
+
+// historySeries is the values of a commodity of an entity within the window, in time order
+type historySeries struct {
+	// The window in seconds
+	Window  int64           `json:"window"`
+	Samples []historySample `json:"samples"`
+}
+
+type historySample struct {
+	// The unix time in seconds
+	Timestamp int64   `json:"t"`
+	Value     float64 `json:"v"`
+}
+
+// NewCapacityHistory creates the history, loading the persisted one from the file at the path if it exists
+func NewCapacityHistory(path string) *CapacityHistory {
+	h := &CapacityHistory{
+		path:   path,
+		series: make(map[string]*historySeries),
+	}
+
+	if path == "" {
+		return h
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		glog.Infof("Capacity history file %s doesn't exist; starting with an empty history", path)
+		return h
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &h.series)
+	}
+	if err != nil {
+		glog.Errorf("Failed to load the capacity history from %s; starting with an empty history: %v", path, err)
+		h.series = make(map[string]*historySeries)
+		return h
+	}
+
+	glog.Infof("Loaded the capacity history of %d commodities from %s", len(h.series), path)
+	return h
+}
+
+// record adds the value observed at the time to the history of the key, and returns the values within the window
+func (h *CapacityHistory) record(key string, value float64, now time.Time, window time.Duration) []float64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &historySeries{}
+		h.series[key] = s
+	}
+	s.Window = int64(window / time.Second)
+	s.Samples = append(s.Samples, historySample{Timestamp: now.Unix(), Value: value})
+
+	return s.values(now)
+}
+
+// values returns the values within the window of the history of the key without recording any, or nil if none
+func (h *CapacityHistory) values(key string, now time.Time) []float64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		return nil
+	}
+	return s.values(now)
+}
+
+// values drops the samples out of the window and returns the values of the rest
+func (s *historySeries) values(now time.Time) []float64 {
+	s.expire(now)
+
+	values := make([]float64, len(s.Samples))
+	for i, sample := range s.Samples {
+		values[i] = sample.Value
+	}
+	return values
+}
+
+// expire drops the samples out of the window
+func (s *historySeries) expire(now time.Time) {
+	start := now.Unix() - s.Window
+	i := 0
+	for i < len(s.Samples) && s.Samples[i].Timestamp < start {
+		i++
+	}
+	s.Samples = s.Samples[i:]
+}
+
+// Save drops the expired history, e.g., of the entities which are gone, and persists the rest in the file,
+// if any. The file is replaced atomically so that it is never left partially written.
+func (h *CapacityHistory) Save() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	now := time.Now()
+	for key, s := range h.series {
+		s.expire(now)
+		if len(s.Samples) == 0 {
+			delete(h.series, key)
+		}
+	}
+
+	if h.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(h.series)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(h.path), filepath.Base(h.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), h.path)
+}
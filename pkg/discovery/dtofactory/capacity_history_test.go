@@ -0,0 +1,58 @@
+package dtofactory
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCapacityHistory_Record(t *testing.T) {
+	h := NewCapacityHistory("")
+	now := time.Now()
+
+	h.record("a", 1, now.Add(-2*time.Hour), time.Hour)
+	h.record("a", 2, now.Add(-30*time.Minute), time.Hour)
+	values := h.record("a", 3, now, time.Hour)
+
+	// The value older than the window is dropped
+	if expected := []float64{2, 3}; !reflect.DeepEqual(values, expected) {
+		t.Errorf("record() = %v, want %v", values, expected)
+	}
+}
+
+func TestCapacityHistory_Save(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometurbo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history.json")
+
+	h := NewCapacityHistory(path)
+	now := time.Now()
+	h.record("a", 1, now, time.Hour)
+	h.record("b", 1, now.Add(-2*time.Hour), time.Hour)
+	if err := h.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	// The history is loaded after a restart, without the expired series
+	loaded := NewCapacityHistory(path)
+	if len(loaded.series) != 1 {
+		t.Fatalf("Expected 1 series but got %v", loaded.series)
+	}
+	if values := loaded.record("a", 2, now, time.Hour); !reflect.DeepEqual(values, []float64{1, 2}) {
+		t.Errorf("record() = %v, want [1 2]", values)
+	}
+
+	// A corrupted file is ignored
+	if err := ioutil.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if corrupted := NewCapacityHistory(path); len(corrupted.series) != 0 {
+		t.Errorf("Expected an empty history but got %v", corrupted.series)
+	}
+}
@@ -3,88 +3,171 @@ package dtofactory
 import (
 	"fmt"
 	"github.com/golang/glog"
+	"github.com/turbonomic/prometurbo/pkg/conf"
 	"github.com/turbonomic/prometurbo/pkg/discovery/constant"
 	"github.com/turbonomic/prometurbo/pkg/discovery/exporter"
 	"github.com/turbonomic/turbo-go-sdk/pkg/builder"
 	"github.com/turbonomic/turbo-go-sdk/pkg/proto"
+	"github.com/turbonomic/turbo-go-sdk/pkg/supplychain"
+	"math"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type entityBuilder struct {
 	// TODO: Add the scope to the property for stitching, which needs corresponding change at kubeturbo side
 	scope string
 
-	metric *exporter.EntityMetric
+	metric     *exporter.EntityMetric
+	metricConf *conf.MetricConf
+	// The history of the commodities for the capacity inference; the capacities are not inferred if nil
+	history *CapacityHistory
+	// Whether the metrics are the cached ones of a failed query, whose values are not recorded in the history
+	stale bool
+
+	// The SLO matching the entity, and whether any of its targets is applied to the capacities
+	slo        *conf.SLO
+	sloApplied bool
 }
 
-func NewEntityBuilder(scope string, metric *exporter.EntityMetric) *entityBuilder {
+func NewEntityBuilder(scope string, metric *exporter.EntityMetric, metricConf *conf.MetricConf) *entityBuilder {
 	return &entityBuilder{
-		scope:  scope,
-		metric: metric,
+		scope:      scope,
+		metric:     metric,
+		metricConf: metricConf,
 	}
 }
 
+// WithCapacityHistory sets the history of the commodities, from which the capacities are inferred
+func (b *entityBuilder) WithCapacityHistory(history *CapacityHistory) *entityBuilder {
+	b.history = history
+	return b
+}
+
+// WithStaleMetrics marks the metrics as the cached ones of a failed query, so that the same values are not
+// recorded in the history again and again
+func (b *entityBuilder) WithStaleMetrics(stale bool) *entityBuilder {
+	b.stale = stale
+	return b
+}
+
 func (b *entityBuilder) Build() ([]*proto.EntityDTO, error) {
 	metric := b.metric
 
-	entityType, ok := constant.EntityTypeMap[metric.Type]
+	entityConf, ok := b.metricConf.Entity(proto.EntityDTO_EntityType(metric.Type))
 	if !ok {
 		err := fmt.Errorf("Unsupported entity type %v", metric.Type)
 		glog.Errorf(err.Error())
 		return nil, err
 	}
+	entityType := entityConf.EntityType()
 
 	ip := metric.UID
+	id := b.getEntityId(entityType, ip)
+	b.slo, _ = b.metricConf.SLO(metric.Labels)
+
+	for key := range metric.Metrics {
+		name := strings.TrimSuffix(strings.TrimSuffix(key, constant.PeakSuffix), constant.CapacitySuffix)
+		if _, ok := entityConf.Commodity(name); !ok {
+			glog.Errorf("Unsupported commodity type %s", key)
+		}
+	}
 
 	commodities := []*proto.CommodityDTO{}
 	commTypes := []proto.CommodityDTO_CommodityType{}
-	commMetrics := metric.Metrics
-	for key, value := range commMetrics {
-		var commType proto.CommodityDTO_CommodityType
-		commType, ok := constant.CommodityTypeMap[key]
-
+	commProps := [][]string{}
+	for _, commConf := range entityConf.Commodities {
+		value, ok := metric.Metrics[commConf.Name]
 		if !ok {
-			err := fmt.Errorf("Unsupported commodity type %s", key)
-			glog.Errorf(err.Error())
 			continue
 		}
 
-		capacity, ok := constant.CommodityCapMap[commType]
-		if !ok {
-			err := fmt.Errorf("Missing commodity capacity for type %s", commType)
-			glog.Errorf(err.Error())
+		commType := commConf.CommodityType()
+
+		unit := commConf.Unit
+		if reported, ok := metric.Units[commConf.Name]; ok {
+			unit = reported
+		}
+		convert, err := newUnitConverter(commType, unit)
+		if err != nil {
+			glog.Errorf("Skipping metric %s of %s: %v", commConf.Name, metric.UID, err)
+			continue
+		}
+		value = convert(value)
+
+		// The capacities in the metric config are in the unit of the metric config
+		configConvert, err := newUnitConverter(commType, commConf.Unit)
+		if err != nil {
+			// Should never happen as the unit is validated in the metric config
+			glog.Errorf("Skipping metric %s of %s: %v", commConf.Name, metric.UID, err)
 			continue
 		}
 
-		// TODO: Remove this if using 'millisec' unit at exporter side
-		if commType == proto.CommodityDTO_RESPONSE_TIME {
-			//value *= 1000 // Convert second to millisecond
+		// The peak value is observed for the capacity inference if reported
+		peak, hasPeak := metric.Metrics[commConf.Name+constant.PeakSuffix]
+		observed := value
+		if hasPeak {
+			peak = math.Max(convert(peak), value)
+			observed = peak
+		}
+
+		capacity, fallback := b.capacity(id, entityConf, commConf, observed, convert, configConvert)
+
+		// Only the fallback capacity is adjusted in case utilization > 1, while the capacities specific to the
+		// entity are kept so that its overutilization is reported
+		if observed > capacity {
+			if fallback {
+				capacity = observed
+			} else if value > capacity {
+				glog.Warningf("Metric %s of %s is %v, above its capacity %v", commConf.Name, metric.UID,
+					value, capacity)
+			}
+		}
+
+		commBuilder := builder.NewCommodityDTOBuilder(commType).
+			Used(value).Key(ip)
+		props := []string{constant.Used, constant.Capacity}
+		// The capacities of the containers of kubeturbo are their limits
+		if entityConf.StitchingAttr == constant.K8sStitchingAttr {
+			props = []string{constant.Used}
 		}
 
-		// Adjust the capacity in case utilization > 1
-		if value >= capacity {
-			capacity = value // + 1
+		if hasPeak {
+			props = append(props, constant.Peak)
 		}
 
-		commodity, err := builder.NewCommodityDTOBuilder(commType).
-			Used(value).Capacity(capacity).Key(ip).Create()
+		commodity, err := commBuilder.Capacity(capacity).Create()
 
 		if err != nil {
 			glog.Errorf("Error building a commodity: %s", err)
 			continue
 		}
 
+		// The commodity builder doesn't set the peak
+		if hasPeak {
+			commodity.Peak = &peak
+		}
+
 		commodities = append(commodities, commodity)
 		commTypes = append(commTypes, commType)
+		commProps = append(commProps, props)
 	}
 
-	id := b.getEntityId(entityType, ip)
-
-	dto, err := builder.NewEntityDTOBuilder(entityType, id).
+	entityBuilder := builder.NewEntityDTOBuilder(entityType, id).
 		DisplayName(id).
-		SellsCommodities(commodities).
-		WithProperty(getEntityProperty(ip)).
-		ReplacedBy(getReplacementMetaData(entityType, commTypes)).
-		Create()
+		SellsCommodities(commodities)
+	var propNames []string
+	for _, prop := range b.stitchingProperties(entityConf) {
+		entityBuilder.WithProperty(prop)
+		propNames = append(propNames, prop.GetName())
+	}
+	entityBuilder.ReplacedBy(getReplacementMetaData(entityType, entityConf.StitchingAttr, propNames, commTypes, commProps))
+	if b.sloApplied {
+		entityBuilder.WithProperty(newEntityProperty(constant.SLOProperty, b.slo.Name))
+	}
+
+	dto, err := entityBuilder.Create()
 
 	if err != nil {
 		glog.Errorf("Error building EntityDTO from metric %v: %s", metric, err)
@@ -96,38 +179,208 @@ func (b *entityBuilder) Build() ([]*proto.EntityDTO, error) {
 	return dtos, nil
 }
 
+// capacity resolves the capacity of a commodity of the entity in the order of precedence:
+//  1. the capacity reported along with the metric, in the unit of the metric
+//  2. the value of the capacity label of the entity
+//  3. the response time target or the throughput budget of the SLO matching the entity
+//  4. the capacity inferred from the history of the commodity of the entity, if configured
+//  5. the capacity of the first capacity override matching the labels of the entity
+//  6. the capacity of the commodity of the entity type
+//  7. the default capacity of the commodity type, in the unit expected by Turbo
+//
+// It also returns whether the capacity is a fallback, i.e., of the entity type or the commodity type rather than
+// specific to the entity. The observed value is recorded in the history
+// regardless of the capacity in use, unless the metrics are stale.
+func (b *entityBuilder) capacity(id string, entityConf *conf.EntityConf, commConf *conf.CommodityConf,
+	observed float64, convert, configConvert func(float64) float64) (float64, bool) {
+	metric := b.metric
+
+	inferred := b.inferCapacity(id, commConf, observed, configConvert)
+
+	if capacity, ok := metric.Metrics[commConf.Name+constant.CapacitySuffix]; ok && capacity > 0 {
+		return convert(capacity), false
+	}
+
+	if value, ok := metric.Labels[commConf.CapacityLabel]; ok && commConf.CapacityLabel != "" {
+		capacity, err := strconv.ParseFloat(value, 64)
+		if err == nil && capacity > 0 {
+			return configConvert(capacity), false
+		}
+		glog.Warningf("Ignoring invalid capacity %q in label %s of %s", value, commConf.CapacityLabel, metric.UID)
+	}
+
+	if capacity := b.sloCapacity(commConf.CommodityType()); capacity > 0 {
+		b.sloApplied = true
+		return capacity, false
+	}
+
+	if inferred > 0 {
+		return inferred, false
+	}
+
+	if capacity, ok := entityConf.OverriddenCapacity(commConf.Name, metric.Labels); ok {
+		return configConvert(capacity), false
+	}
+
+	if commConf.Capacity > 0 {
+		return configConvert(commConf.Capacity), true
+	}
+
+	// Either the capacity of the commodity or the default capacity is validated in the metric config
+	capacity, _ := b.metricConf.DefaultCapacity(commConf.CommodityType())
+	return capacity, true
+}
+
+// sloCapacity returns the target of the SLO matching the entity for the commodity type, in the unit expected
+// by Turbo, or 0 if none
+func (b *entityBuilder) sloCapacity(commType proto.CommodityDTO_CommodityType) float64 {
+	if b.slo == nil {
+		return 0
+	}
+	switch commType {
+	case proto.CommodityDTO_RESPONSE_TIME:
+		return b.slo.ResponseTime
+	case proto.CommodityDTO_TRANSACTION:
+		return b.slo.Transactions
+	}
+	return 0
+}
+
+// inferCapacity records the observed value of the commodity of the entity unless stale, and infers the capacity
+// by aggregating the history with headroom, which is at least the floor. It returns 0 if the inference is not
+// configured, or if there is no history of the stale metrics.
+func (b *entityBuilder) inferCapacity(id string, commConf *conf.CommodityConf, observed float64,
+	configConvert func(float64) float64) float64 {
+	inference := commConf.CapacityInference
+	if inference == nil || b.history == nil {
+		return 0
+	}
+
+	key := id + "/" + commConf.Name
+	var values []float64
+	if b.stale {
+		values = b.history.values(key, time.Now())
+	} else {
+		values = b.history.record(key, observed, time.Now(), inference.HistoryWindow())
+	}
+	if len(values) == 0 {
+		return 0
+	}
+	capacity := exporter.Aggregate(values, inference.Method) * inference.Headroom
+
+	return math.Max(capacity, configConvert(inference.Floor))
+}
+
+// newUnitConverter returns the function converting the values in the unit to the one expected by Turbo
+// for the commodity type. The values are not converted if either unit is not known, except that an unknown
+// unit of the metric is an error.
+func newUnitConverter(commType proto.CommodityDTO_CommodityType, unit string) (func(float64) float64, error) {
+	noConversion := func(value float64) float64 { return value }
+	if unit == "" {
+		return noConversion, nil
+	}
+
+	if err := conf.ValidateUnit(unit); err != nil {
+		return nil, err
+	}
+
+	target, ok := conf.CommodityUnit(commType)
+	if !ok {
+		return noConversion, nil
+	}
+
+	// Fail fast if the units are not compatible
+	if _, err := conf.ConvertUnit(0, unit, target); err != nil {
+		return nil, err
+	}
+
+	return func(value float64) float64 {
+		converted, _ := conf.ConvertUnit(value, unit, target)
+		return converted
+	}, nil
+}
+
 func (b *entityBuilder) getEntityId(entityType proto.EntityDTO_EntityType, entityName string) string {
+	return entityId(entityType, b.scope, entityName)
+}
+
+func entityId(entityType proto.EntityDTO_EntityType, scope, entityName string) string {
 	eType := proto.EntityDTO_EntityType_name[int32(entityType)]
 
-	return fmt.Sprintf("%s-%s/%s", eType, b.scope, entityName)
+	return fmt.Sprintf("%s-%s/%s", eType, scope, entityName)
 }
 
-func getReplacementMetaData(entityType proto.EntityDTO_EntityType, commTypes []proto.CommodityDTO_CommodityType) *proto.EntityDTO_ReplacementEntityMetaData {
-	attr := constant.StitchingAttr
-	useTopoExt := true
+// stitchingProperties returns the properties stitching the entity, which are the namespace, the pod and the name
+// of a container of kubeturbo, or else the value of the stitching label of the entity, or else its UID
+func (b *entityBuilder) stitchingProperties(entityConf *conf.EntityConf) []*proto.EntityDTO_EntityProperty {
+	labels := b.metric.Labels
+
+	if entityConf.StitchingAttr == constant.K8sStitchingAttr {
+		var props []*proto.EntityDTO_EntityProperty
+		for _, prop := range constant.K8sContainerProperties {
+			props = append(props, newEntityProperty(prop.Name, labels[prop.Label]))
+		}
+		return props
+	}
+
+	value := b.metric.UID
+	if labelValue, ok := labels[entityConf.StitchingLabel]; ok && labelValue != "" {
+		value = labelValue
+	}
+	return []*proto.EntityDTO_EntityProperty{newEntityProperty(entityConf.StitchingAttr, value)}
+}
 
-	b := builder.NewReplacementEntityMetaDataBuilder().
-		Matching(attr).
-		MatchingExternal(&proto.ServerEntityPropDef{
-			Entity:     &entityType,
-			Attribute:  &attr,
-			UseTopoExt: &useTopoExt,
-		})
+// getReplacementMetaData patches the given properties of each type of the commodities sold by the replaced entity,
+// which is matched by the given entity properties of the stitching attribute
+func getReplacementMetaData(entityType proto.EntityDTO_EntityType, attr string, props []string,
+	commTypes []proto.CommodityDTO_CommodityType, commProps [][]string) *proto.EntityDTO_ReplacementEntityMetaData {
+	b := builder.NewReplacementEntityMetaDataBuilder()
+	for _, prop := range props {
+		b.Matching(prop).
+			MatchingExternal(getExternalPropDef(entityType, attr, prop))
+	}
 
-	for _, commType := range commTypes {
-		b.PatchSellingWithProperty(commType, []string{constant.Used, constant.Capacity})
+	for i, commType := range commTypes {
+		b.PatchSellingWithProperty(commType, commProps[i])
 	}
 
 	return b.Build()
 }
 
-func getEntityProperty(value string) *proto.EntityDTO_EntityProperty {
-	attr := constant.StitchingAttr
+// getExternalPropDef returns the attribute of the replaced entity matched by the property. The containers are
+// matched by the properties of the containers of kubeturbo, the VMs by the IPs or the display names of the VMs of
+// the hypervisors, and the other entities by the attribute of their topology extensions.
+func getExternalPropDef(entityType proto.EntityDTO_EntityType, attr, prop string) *proto.ServerEntityPropDef {
+	switch {
+	case attr == constant.K8sStitchingAttr:
+		return &proto.ServerEntityPropDef{
+			Entity:    &entityType,
+			Attribute: &prop,
+		}
+	case entityType == proto.EntityDTO_VIRTUAL_MACHINE && attr == constant.HostnameStitchingAttr:
+		displayName := constant.VMDisplayNameAttr
+		return &proto.ServerEntityPropDef{
+			Entity:    &entityType,
+			Attribute: &displayName,
+		}
+	case entityType == proto.EntityDTO_VIRTUAL_MACHINE:
+		return supplychain.VM_IP
+	}
+
+	useTopoExt := true
+	return &proto.ServerEntityPropDef{
+		Entity:     &entityType,
+		Attribute:  &prop,
+		UseTopoExt: &useTopoExt,
+	}
+}
+
+func newEntityProperty(name, value string) *proto.EntityDTO_EntityProperty {
 	ns := constant.DefaultPropertyNamespace
 
 	return &proto.EntityDTO_EntityProperty{
 		Namespace: &ns,
-		Name:      &attr,
+		Name:      &name,
 		Value:     &value,
 	}
 }
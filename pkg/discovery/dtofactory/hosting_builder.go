@@ -0,0 +1,112 @@
+package dtofactory
+
+import (
+	"github.com/golang/glog"
+	"github.com/turbonomic/prometurbo/pkg/conf"
+	"github.com/turbonomic/prometurbo/pkg/discovery/exporter"
+	"github.com/turbonomic/turbo-go-sdk/pkg/proto"
+	"sort"
+	"sync"
+)
+
+// HostingBuilder connects the entities to the entities hosting them, e.g., the database servers to their
+// containers, by the provider label of the entities. The hosted entity buys the commodities sold by its host.
+type HostingBuilder struct {
+	metricConf *conf.MetricConf
+
+	// The entities and the hostings are added concurrently from the exporters
+	lock sync.Mutex
+	// The entities keyed by their IDs
+	entities map[string]*proto.EntityDTO
+	hostings []*hosting
+}
+
+type hosting struct {
+	// The IDs of the hosted and the hosting entities
+	consumer, provider string
+}
+
+func NewHostingBuilder(metricConf *conf.MetricConf) *HostingBuilder {
+	return &HostingBuilder{
+		metricConf: metricConf,
+		entities:   make(map[string]*proto.EntityDTO),
+	}
+}
+
+// Add adds the entities built from the metric, along with the hosting of the entity of the metric if its entity
+// type has a provider
+func (b *HostingBuilder) Add(scope string, metric *exporter.EntityMetric, dtos []*proto.EntityDTO) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, dto := range dtos {
+		b.entities[dto.GetId()] = dto
+	}
+
+	entityConf, ok := b.metricConf.Entity(proto.EntityDTO_EntityType(metric.Type))
+	if !ok || entityConf.Provider == nil {
+		return
+	}
+	providerUID, ok := metric.Labels[entityConf.Provider.Label]
+	if !ok || providerUID == "" {
+		glog.V(3).Infof("Missing provider label %s of %s", entityConf.Provider.Label, metric.UID)
+		return
+	}
+
+	b.hostings = append(b.hostings, &hosting{
+		consumer: entityId(entityConf.EntityType(), scope, metric.UID),
+		provider: entityId(entityConf.Provider.EntityType(), scope, providerUID),
+	})
+}
+
+// Build adds the commodities bought from the hosting entities, in the order of the hosted entities. The hostings
+// by the entities which are not discovered are dropped with a warning, as the provider label of the hosted
+// entities may not match the UIDs of the providers.
+func (b *HostingBuilder) Build() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	sort.Slice(b.hostings, func(i, j int) bool {
+		return b.hostings[i].consumer < b.hostings[j].consumer
+	})
+
+	var undiscovered []*hosting
+	for _, h := range b.hostings {
+		consumer, ok := b.entities[h.consumer]
+		if !ok {
+			continue
+		}
+		provider, ok := b.entities[h.provider]
+		if !ok {
+			glog.V(3).Infof("Skipping the undiscovered provider %s of %s", h.provider, h.consumer)
+			undiscovered = append(undiscovered, h)
+			continue
+		}
+
+		// The first commodity of each type is the one of the provider itself rather than of, e.g., a call
+		sold := soldCommodities(provider)
+		var bought []*proto.CommodityDTO
+		for _, commodity := range provider.GetCommoditiesSold() {
+			if sold[commodity.GetCommodityType()] == commodity {
+				bought = append(bought, newBoughtCommodity(commodity))
+			}
+		}
+		if len(bought) == 0 {
+			continue
+		}
+
+		providerId := provider.GetId()
+		providerType := provider.GetEntityType()
+		consumer.CommoditiesBought = append(consumer.CommoditiesBought, &proto.EntityDTO_CommodityBought{
+			ProviderId:   &providerId,
+			ProviderType: &providerType,
+			Bought:       bought,
+		})
+	}
+
+	if len(undiscovered) > 0 {
+		glog.Warningf("%d of %d hosted entities have undiscovered providers, e.g., %s of %s; check that the "+
+			"provider labels are the UIDs of the providers", len(undiscovered), len(b.hostings),
+			undiscovered[0].provider, undiscovered[0].consumer)
+	}
+}
@@ -0,0 +1,199 @@
+package dtofactory
+
+import (
+	"github.com/golang/glog"
+	"github.com/turbonomic/prometurbo/pkg/conf"
+	"github.com/turbonomic/prometurbo/pkg/discovery/constant"
+	"github.com/turbonomic/turbo-go-sdk/pkg/builder"
+	"github.com/turbonomic/turbo-go-sdk/pkg/proto"
+	"sort"
+	"sync"
+)
+
+// VirtualAppBuilder groups the applications by the value of the service label into the virtual applications
+// of the services, which sell the transactions and the response times aggregated over their applications
+type VirtualAppBuilder struct {
+	serviceLabel string
+	metricConf   *conf.MetricConf
+
+	// The applications are added concurrently from the exporters
+	lock sync.Mutex
+	// The applications of the services keyed by the IDs of the virtual applications
+	services map[string]*service
+}
+
+type service struct {
+	name string
+	apps []*proto.EntityDTO
+}
+
+func NewVirtualAppBuilder(serviceLabel string, metricConf *conf.MetricConf) *VirtualAppBuilder {
+	return &VirtualAppBuilder{
+		serviceLabel: serviceLabel,
+		metricConf:   metricConf,
+		services:     make(map[string]*service),
+	}
+}
+
+// Add adds the application to the service named by the service label of the application, if any
+func (b *VirtualAppBuilder) Add(scope string, labels map[string]string, app *proto.EntityDTO) {
+	name, ok := labels[b.serviceLabel]
+	if !ok || name == "" || app.GetEntityType() != proto.EntityDTO_APPLICATION {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	id := entityId(proto.EntityDTO_VIRTUAL_APPLICATION, scope, name)
+	s, ok := b.services[id]
+	if !ok {
+		s = &service{name: name}
+		b.services[id] = s
+	}
+	s.apps = append(s.apps, app)
+}
+
+// Build builds the virtual applications of the services in the order of their IDs
+func (b *VirtualAppBuilder) Build() []*proto.EntityDTO {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var ids []string
+	for id := range b.services {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var dtos []*proto.EntityDTO
+	for _, id := range ids {
+		dto, err := b.buildVirtualApp(id, b.services[id])
+		if err != nil {
+			glog.Errorf("Error building the virtual application %s: %v", id, err)
+			continue
+		}
+		dtos = append(dtos, dto)
+	}
+	return dtos
+}
+
+// buildVirtualApp builds the virtual application selling the sum of the transactions of the applications, and
+// the average of their response times weighted by their transactions. The capacities are the targets of the SLO
+// matching the service if any, or else the sum of the transaction capacities and the max response time capacity
+// of the applications. The virtual application buys the commodities from each application.
+func (b *VirtualAppBuilder) buildVirtualApp(id string, s *service) (*proto.EntityDTO, error) {
+	sort.Slice(s.apps, func(i, j int) bool { return s.apps[i].GetId() < s.apps[j].GetId() })
+
+	entityBuilder := builder.NewEntityDTOBuilder(proto.EntityDTO_VIRTUAL_APPLICATION, id).
+		DisplayName(s.name)
+
+	var tps, tpsCapacity, weightedLatency, latencySum, latencyCapacity, weight float64
+	var hasTPS, hasLatency bool
+	var latencies int
+	for _, app := range s.apps {
+		sold := soldCommodities(app)
+
+		var bought []*proto.CommodityDTO
+		appTPS, ok := sold[proto.CommodityDTO_TRANSACTION]
+		if ok {
+			hasTPS = true
+			tps += appTPS.GetUsed()
+			tpsCapacity += appTPS.GetCapacity()
+			bought = append(bought, newBoughtCommodity(appTPS))
+		}
+		if latency, ok := sold[proto.CommodityDTO_RESPONSE_TIME]; ok {
+			hasLatency = true
+			latencies++
+			latencySum += latency.GetUsed()
+			if appTPS != nil {
+				weightedLatency += latency.GetUsed() * appTPS.GetUsed()
+				weight += appTPS.GetUsed()
+			}
+			if latency.GetCapacity() > latencyCapacity {
+				latencyCapacity = latency.GetCapacity()
+			}
+			bought = append(bought, newBoughtCommodity(latency))
+		}
+
+		if len(bought) > 0 {
+			entityBuilder.Provider(builder.CreateProvider(proto.EntityDTO_APPLICATION, app.GetId())).
+				BuysCommodities(bought)
+		}
+	}
+
+	slo, _ := b.metricConf.SLO(map[string]string{b.serviceLabel: s.name})
+	sloApplied := false
+
+	var commodities []*proto.CommodityDTO
+	if hasTPS {
+		if slo != nil && slo.Transactions > 0 {
+			tpsCapacity = slo.Transactions
+			sloApplied = true
+		}
+		commodity, err := newSoldCommodity(proto.CommodityDTO_TRANSACTION, s.name, tps, tpsCapacity)
+		if err != nil {
+			return nil, err
+		}
+		commodities = append(commodities, commodity)
+	}
+	if hasLatency {
+		// The response times are not weighted if none of the applications has transactions
+		latency := latencySum / float64(latencies)
+		if weight > 0 {
+			latency = weightedLatency / weight
+		}
+		if slo != nil && slo.ResponseTime > 0 {
+			latencyCapacity = slo.ResponseTime
+			sloApplied = true
+		}
+		commodity, err := newSoldCommodity(proto.CommodityDTO_RESPONSE_TIME, s.name, latency, latencyCapacity)
+		if err != nil {
+			return nil, err
+		}
+		commodities = append(commodities, commodity)
+	}
+
+	entityBuilder.SellsCommodities(commodities)
+	if sloApplied {
+		entityBuilder.WithProperty(newEntityProperty(constant.SLOProperty, slo.Name))
+	}
+
+	return entityBuilder.Create()
+}
+
+// soldCommodities returns the first commodity of each type sold by the entity
+func soldCommodities(dto *proto.EntityDTO) map[proto.CommodityDTO_CommodityType]*proto.CommodityDTO {
+	sold := make(map[proto.CommodityDTO_CommodityType]*proto.CommodityDTO)
+	for _, commodity := range dto.GetCommoditiesSold() {
+		if _, ok := sold[commodity.GetCommodityType()]; !ok {
+			sold[commodity.GetCommodityType()] = commodity
+		}
+	}
+	return sold
+}
+
+// newBoughtCommodity returns the commodity bought from the seller of the sold commodity
+func newBoughtCommodity(sold *proto.CommodityDTO) *proto.CommodityDTO {
+	commType := sold.GetCommodityType()
+	key := sold.GetKey()
+	used := sold.GetUsed()
+
+	return &proto.CommodityDTO{
+		CommodityType: &commType,
+		Key:           &key,
+		Used:          &used,
+	}
+}
+
+// newSoldCommodity returns the commodity with the capacity adjusted to the used value in case utilization > 1
+func newSoldCommodity(commType proto.CommodityDTO_CommodityType, key string,
+	used, capacity float64) (*proto.CommodityDTO, error) {
+	if used > capacity {
+		capacity = used
+	}
+	return builder.NewCommodityDTOBuilder(commType).
+		Key(key).
+		Used(used).
+		Capacity(capacity).
+		Create()
+}
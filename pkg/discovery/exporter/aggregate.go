@@ -0,0 +1,85 @@
+package exporter
+
+import (
+	"github.com/golang/glog"
+	"github.com/turbonomic/prometurbo/pkg/conf"
+	"github.com/turbonomic/prometurbo/pkg/discovery/constant"
+	"math"
+	"sort"
+)
+
+// addAggregated adds the used value, and the peak value if requested, aggregated from the samples of a series
+// in time order. The series is skipped if it has no valid sample.
+func (s *entityMetricSet) addAggregated(entityType int32, uid, metric string, values []float64,
+	aggregation *conf.AggregationConf, labels map[string]string) {
+	if len(values) == 0 {
+		glog.V(3).Infof("Skipping series %v of metric %s: no valid value", labels, metric)
+		return
+	}
+
+	s.add(entityType, uid, metric, Aggregate(values, aggregation.Used), labels)
+	if aggregation.Peak != "" {
+		s.add(entityType, uid, metric+constant.PeakSuffix, Aggregate(values, aggregation.Peak), labels)
+	}
+}
+
+// Aggregate aggregates the non-empty values in time order with the function validated in the metric config
+func Aggregate(values []float64, fn string) float64 {
+	switch fn {
+	case conf.AggregationAvg:
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		return sum / float64(len(values))
+	case conf.AggregationMax:
+		max := values[0]
+		for _, v := range values[1:] {
+			max = math.Max(max, v)
+		}
+		return max
+	case conf.AggregationMin:
+		min := values[0]
+		for _, v := range values[1:] {
+			min = math.Min(min, v)
+		}
+		return min
+	case conf.AggregationLast:
+		return values[len(values)-1]
+	}
+
+	p, ok := conf.ParsePercentile(fn)
+	if !ok {
+		// Should never happen as the aggregation is validated in the metric config
+		glog.Errorf("Unknown aggregation %q; using the latest value", fn)
+		return values[len(values)-1]
+	}
+	return percentile(values, p)
+}
+
+// percentile returns the p-th percentile of the values, interpolated linearly between the closest ranks
+func percentile(values []float64, p float64) float64 {
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	if lower == upper {
+		return sorted[lower]
+	}
+
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+// validValues returns the values which are neither NaN nor infinite
+func validValues(values []float64) []float64 {
+	var valid []float64
+	for _, v := range values {
+		if !math.IsNaN(v) && !math.IsInf(v, 0) {
+			valid = append(valid, v)
+		}
+	}
+	return valid
+}
@@ -0,0 +1,31 @@
+package exporter
+
+import (
+	"testing"
+)
+
+func TestAggregate(t *testing.T) {
+	values := []float64{4, 1, 10, 2, 3}
+
+	tests := map[string]float64{
+		"avg":  4,
+		"max":  10,
+		"min":  1,
+		"last": 3,
+		"p50":  3,
+		"p100": 10,
+		"p75":  4,
+		"p90":  7.6,
+	}
+
+	for fn, expected := range tests {
+		if got := Aggregate(values, fn); got < expected-1e-9 || got > expected+1e-9 {
+			t.Errorf("Aggregate(%v, %s) = %v, want %v", values, fn, got, expected)
+		}
+	}
+
+	// The values are not reordered by the percentiles
+	if values[0] != 4 || values[4] != 3 {
+		t.Errorf("Aggregate() modified the values: %v", values)
+	}
+}
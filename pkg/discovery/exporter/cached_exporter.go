@@ -0,0 +1,87 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"sync"
+	"time"
+)
+
+// StaleMetricsError is returned along with the cached metrics when the query of the exporter fails
+type StaleMetricsError struct {
+	// The time since the cached metrics were collected
+	Age time.Duration
+	// The error of the failed query
+	Err error
+}
+
+func (e *StaleMetricsError) Error() string {
+	return fmt.Sprintf("serving the metrics cached %v ago: %v", e.Age, e.Err)
+}
+
+// cachedExporter keeps the metrics of the last successful query of an exporter. If a query fails, it returns
+// the cached metrics with a StaleMetricsError until they are older than the TTL, after which the error of the query.
+type cachedExporter struct {
+	exporter MetricExporter
+	ttl      time.Duration
+
+	lock      sync.Mutex
+	metrics   []*EntityMetric
+	updatedAt time.Time
+	// Whether the last query failed
+	failing bool
+}
+
+func NewCachedExporter(exporter MetricExporter, ttl time.Duration) *cachedExporter {
+	return &cachedExporter{
+		exporter: exporter,
+		ttl:      ttl,
+	}
+}
+
+func (c *cachedExporter) String() string {
+	return fmt.Sprint(c.exporter)
+}
+
+// Ready checks the readiness of the exporter if it is a ReadinessChecker
+func (c *cachedExporter) Ready(ctx context.Context) error {
+	if checker, ok := c.exporter.(ReadinessChecker); ok {
+		return checker.Ready(ctx)
+	}
+	return nil
+}
+
+func (c *cachedExporter) Query(ctx context.Context) ([]*EntityMetric, error) {
+	metrics, err := c.exporter.Query(ctx)
+	return c.update(metrics, err, time.Now())
+}
+
+// update caches the metrics of a successful query, or returns the cached metrics if the query failed
+func (c *cachedExporter) update(metrics []*EntityMetric, err error, now time.Time) ([]*EntityMetric, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err == nil {
+		if c.failing {
+			glog.Infof("Query of %v succeeded again; refreshed the metric cache", c)
+		}
+		c.metrics, c.updatedAt, c.failing = metrics, now, false
+		return metrics, nil
+	}
+
+	c.failing = true
+	if c.metrics == nil {
+		return nil, err
+	}
+
+	age := now.Sub(c.updatedAt)
+	if age > c.ttl {
+		glog.Warningf("The metrics of %v cached %v ago expired; dropping them", c, age)
+		c.metrics = nil
+		return nil, err
+	}
+
+	glog.Warningf("Query of %v failed; serving the metrics cached %v ago: %v", c, age, err)
+	return c.metrics, &StaleMetricsError{Age: age, Err: err}
+}
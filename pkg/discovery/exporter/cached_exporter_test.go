@@ -0,0 +1,42 @@
+package exporter
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCachedExporter_Update(t *testing.T) {
+	c := NewCachedExporter(nil, 10*time.Minute)
+	metrics := []*EntityMetric{{UID: "1.2.3.4", Metrics: map[string]float64{"tps": 1}}}
+	queryErr := fmt.Errorf("connection refused")
+	start := time.Now()
+
+	// No cache before any successful query
+	if got, err := c.update(nil, queryErr, start); got != nil || err != queryErr {
+		t.Errorf("update() = %v, %v, want the query error", got, err)
+	}
+
+	if got, err := c.update(metrics, nil, start); err != nil || !reflect.DeepEqual(got, metrics) {
+		t.Errorf("update() = %v, %v, want %v", got, err, metrics)
+	}
+
+	// The cached metrics are served as stale within the TTL
+	got, err := c.update(nil, queryErr, start.Add(5*time.Minute))
+	if !reflect.DeepEqual(got, metrics) {
+		t.Errorf("update() = %v, want the cached %v", got, metrics)
+	}
+	staleErr, ok := err.(*StaleMetricsError)
+	if !ok || staleErr.Err != queryErr || staleErr.Age != 5*time.Minute {
+		t.Errorf("update() error = %v, want a StaleMetricsError of age 5m", err)
+	}
+
+	// The cached metrics are dropped after the TTL
+	if got, err := c.update(nil, queryErr, start.Add(11*time.Minute)); got != nil || err != queryErr {
+		t.Errorf("update() = %v, %v, want the query error", got, err)
+	}
+	if got, err := c.update(nil, queryErr, start.Add(12*time.Minute)); got != nil || err != queryErr {
+		t.Errorf("update() = %v, %v, want the query error", got, err)
+	}
+}
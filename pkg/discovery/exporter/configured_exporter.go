@@ -0,0 +1,59 @@
+package exporter
+
+import (
+	"context"
+	"time"
+)
+
+// ScopedExporter is a MetricExporter whose entities belong to a scope other than the one of the target
+type ScopedExporter interface {
+	MetricExporter
+	// Scope returns the scope of the entities, or "" for the scope of the target
+	Scope() string
+}
+
+// configuredExporter applies the per-exporter settings in the config to a metric exporter
+type configuredExporter struct {
+	name     string
+	exporter MetricExporter
+	timeout  time.Duration
+	scope    string
+}
+
+// NewConfiguredExporter names the exporter, bounds its queries by the timeout if it is positive,
+// and overrides the scope of its entities if the scope is not empty
+func NewConfiguredExporter(name string, exporter MetricExporter, timeout time.Duration,
+	scope string) *configuredExporter {
+	return &configuredExporter{
+		name:     name,
+		exporter: exporter,
+		timeout:  timeout,
+		scope:    scope,
+	}
+}
+
+func (c *configuredExporter) String() string {
+	return c.name
+}
+
+func (c *configuredExporter) Scope() string {
+	return c.scope
+}
+
+// Ready checks the readiness of the exporter if it is a ReadinessChecker
+func (c *configuredExporter) Ready(ctx context.Context) error {
+	if checker, ok := c.exporter.(ReadinessChecker); ok {
+		return checker.Ready(ctx)
+	}
+	return nil
+}
+
+func (c *configuredExporter) Query(ctx context.Context) ([]*EntityMetric, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	return c.exporter.Query(ctx)
+}
@@ -0,0 +1,92 @@
+package exporter
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"sync"
+	"time"
+)
+
+// counterRates keeps the previous sample of each counter series across the discoveries,
+// and computes the per-second rates of the counters from the samples of the next discoveries
+type counterRates struct {
+	lock     sync.Mutex
+	previous map[string]*counterSample
+}
+
+// counterSample is the latest sample of a counter series, and the rate since the sample before it, if known
+type counterSample struct {
+	value     float64
+	timestamp time.Time
+	rate      float64
+	hasRate   bool
+	// The time of the discovery which has seen the series last
+	seenAt time.Time
+}
+
+func newCounterRates() *counterRates {
+	return &counterRates{
+		previous: make(map[string]*counterSample),
+	}
+}
+
+// rate records the sample of the counter series taken at the timestamp, and returns the per-second rate since
+// the previous sample. A counter smaller than the previous sample is considered reset to 0 in between.
+// The rate is unknown for the first sample of a series. If the sample is not newer than the previous one,
+// the rate computed before, if any, is returned.
+func (c *counterRates) rate(key string, value float64, timestamp, now time.Time) (float64, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	previous, ok := c.previous[key]
+	if !ok {
+		c.previous[key] = &counterSample{value: value, timestamp: timestamp, seenAt: now}
+		return 0, false
+	}
+	previous.seenAt = now
+
+	if !timestamp.After(previous.timestamp) {
+		return previous.rate, previous.hasRate
+	}
+
+	increase := value - previous.value
+	if value < previous.value {
+		glog.V(3).Infof("Counter %q is reset from %v to %v", key, previous.value, value)
+		increase = value
+	}
+
+	rate := increase / timestamp.Sub(previous.timestamp).Seconds()
+	c.previous[key] = &counterSample{
+		value:     value,
+		timestamp: timestamp,
+		rate:      rate,
+		hasRate:   true,
+		seenAt:    now,
+	}
+	return rate, true
+}
+
+// forgetBefore drops the series which are not seen since the time, i.e., the ones which disappeared
+func (c *counterRates) forgetBefore(t time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for key, sample := range c.previous {
+		if sample.seenAt.Before(t) {
+			delete(c.previous, key)
+		}
+	}
+}
+
+// addCounter adds the per-second rate of a counter series to the metric of an entity. The metric of the entity
+// is unavailable in this discovery if the rate of any of its series is unknown, e.g., on the first observation.
+func (s *entityMetricSet) addCounter(rates *counterRates, entityType int32, uid, metric string, value float64,
+	labels map[string]string, timestamp, now time.Time) {
+	rate, ok := rates.rate(fmt.Sprintf("%d/%s/%s", entityType, metric, labelSetKey(labels)), value, timestamp, now)
+	if !ok {
+		glog.V(3).Infof("Rate of metric %s of series %v is unavailable until the next discovery", metric, labels)
+		s.markUnavailable(entityType, uid, metric)
+		return
+	}
+	s.add(entityType, uid, metric, rate, labels)
+}
@@ -0,0 +1,75 @@
+package exporter
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/turbonomic/prometurbo/pkg/discovery/constant"
+)
+
+func TestCounterRates_Rate(t *testing.T) {
+	rates := newCounterRates()
+	t0 := time.Unix(1000, 0)
+
+	tests := []struct {
+		value     float64
+		timestamp time.Time
+		rate      float64
+		ok        bool
+	}{
+		// Unknown on the first sample
+		{100, t0, 0, false},
+		{160, t0.Add(time.Minute), 1, true},
+		// The counter is reset and has counted 30 since then
+		{30, t0.Add(2 * time.Minute), 0.5, true},
+		// The sample is not newer than the previous one
+		{30, t0.Add(2 * time.Minute), 0.5, true},
+	}
+
+	for i, test := range tests {
+		rate, ok := rates.rate("series", test.value, test.timestamp, test.timestamp)
+		if rate != test.rate || ok != test.ok {
+			t.Errorf("Sample %d: rate() = %v, %v, want %v, %v", i, rate, ok, test.rate, test.ok)
+		}
+	}
+
+	// The series not seen since the last discovery are dropped
+	rates.forgetBefore(t0.Add(3 * time.Minute))
+	if _, ok := rates.rate("series", 60, t0.Add(3*time.Minute), t0.Add(3*time.Minute)); ok {
+		t.Errorf("Expected the rate of a forgotten series to be unknown")
+	}
+}
+
+func TestEntityMetricSet_AddCounter(t *testing.T) {
+	rates := newCounterRates()
+	t0 := time.Unix(1000, 0)
+
+	first := map[string]string{"ip": "1.2.3.4", "code": "200"}
+	second := map[string]string{"ip": "1.2.3.4", "code": "201"}
+
+	metricSet := newEntityMetricSet()
+	metricSet.addCounter(rates, constant.ApplicationType, "1.2.3.4", constant.TPS, 10, first, t0, t0)
+	if metrics := metricSet.list(); len(metrics) != 0 {
+		t.Errorf("Expected no metric on the first observation but got %+v", metrics[0])
+	}
+
+	// The rate of the second series is unknown, so the sum of the rates is not reported
+	t1 := t0.Add(10 * time.Second)
+	metricSet = newEntityMetricSet()
+	metricSet.addCounter(rates, constant.ApplicationType, "1.2.3.4", constant.TPS, 20, first, t1, t1)
+	metricSet.addCounter(rates, constant.ApplicationType, "1.2.3.4", constant.TPS, 5, second, t1, t1)
+	if metrics := metricSet.list(); len(metrics) != 0 {
+		t.Errorf("Expected the metric to be unavailable but got %+v", metrics[0])
+	}
+
+	t2 := t1.Add(10 * time.Second)
+	metricSet = newEntityMetricSet()
+	metricSet.addCounter(rates, constant.ApplicationType, "1.2.3.4", constant.TPS, 30, first, t2, t2)
+	metricSet.addCounter(rates, constant.ApplicationType, "1.2.3.4", constant.TPS, 25, second, t2, t2)
+
+	expected := map[string]float64{constant.TPS: 3}
+	if metrics := metricSet.list(); len(metrics) != 1 || !reflect.DeepEqual(metrics[0].Metrics, expected) {
+		t.Errorf("addCounter() = %+v, want metrics %v", metrics, expected)
+	}
+}
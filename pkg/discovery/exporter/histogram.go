@@ -0,0 +1,354 @@
+package exporter
+
+import (
+	"github.com/golang/glog"
+	"github.com/turbonomic/prometurbo/pkg/conf"
+	"github.com/turbonomic/prometurbo/pkg/discovery/constant"
+	"math"
+	"sort"
+	"strconv"
+)
+
+const (
+	histogramBucketSuffix = "_bucket"
+	histogramCountSuffix  = "_count"
+
+	// The tolerance of matching the quantile label of a summary, e.g., "0.99", with a percentile
+	quantileTolerance = 1e-9
+)
+
+// histogramRule maps a histogram or a summary to a metric of a type of entities
+type histogramRule struct {
+	// The metric name used as the key of EntityMetric.Metrics
+	metric     string
+	entityType int32
+	// The label whose value becomes the EntityMetric.UID
+	uidLabel  string
+	histogram *conf.HistogramConf
+	// The bucket series of a histogram, or the quantile series of a summary
+	selector *seriesSelector
+	// The observation count series of a summary, which weigh the quantiles of the replicas of an entity
+	countSelector *seriesSelector
+}
+
+// histogramSample is the value of a bucket, quantile or count series
+type histogramSample struct {
+	labels map[string]string
+	value  float64
+}
+
+// bucket is the cumulative count of the observations less than or equal to the upper bound
+type bucket struct {
+	upperBound float64
+	count      float64
+}
+
+// newHistogramRules creates the rules of the commodities fed by histograms or summaries in the metric config
+func newHistogramRules(metricConf *conf.MetricConf) []*histogramRule {
+	var rules []*histogramRule
+	for _, entity := range metricConf.Entities {
+		for _, comm := range entity.Commodities {
+			if comm.Histogram == nil {
+				continue
+			}
+			rule, err := newHistogramRule(comm.Histogram)
+			if err != nil {
+				glog.Warningf("Metric %s of %s cannot be collected: %v", comm.Name, entity.Type, err)
+				continue
+			}
+			rule.metric = comm.Name
+			rule.entityType = int32(entity.EntityType())
+			rule.uidLabel = entity.UIDLabel
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func newHistogramRule(histogram *conf.HistogramConf) (*histogramRule, error) {
+	rule := &histogramRule{histogram: histogram}
+
+	var err error
+	if !histogram.IsSummary() {
+		rule.selector, err = parseSelector(histogram.Metric + histogramBucketSuffix + histogram.Matchers)
+		return rule, err
+	}
+
+	if rule.selector, err = parseSelector(histogram.Metric + histogram.Matchers); err != nil {
+		return nil, err
+	}
+	if rule.countSelector, err = parseSelector(histogram.Metric + histogramCountSuffix + histogram.Matchers); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// selectors returns the selectors of all the series needed by the rule
+func (r *histogramRule) selectors() []*seriesSelector {
+	if r.countSelector != nil {
+		return []*seriesSelector{r.selector, r.countSelector}
+	}
+	return []*seriesSelector{r.selector}
+}
+
+// addHistogram adds the used value, and the peak value if requested, of each entity from the samples of the rule.
+// The samples are the bucket counts of a histogram, or the quantiles of a summary weighed by the counts.
+// The replicas of an entity, which are the series with the same UID and different labels, are merged.
+func (s *entityMetricSet) addHistogram(rule *histogramRule, samples, counts []*histogramSample) {
+	weights := make(map[string]float64)
+	for _, c := range counts {
+		if !math.IsNaN(c.value) && !math.IsInf(c.value, 0) {
+			weights[histogramSeriesKey(c.labels)] = c.value
+		}
+	}
+
+	var uids []string
+	// The samples of each replica of each entity
+	replicas := make(map[string]map[string][]*histogramSample)
+	for _, sample := range samples {
+		uid, ok := sample.labels[rule.uidLabel]
+		if !ok || uid == "" {
+			glog.V(3).Infof("Skipping series %v matched by %s: missing label %s",
+				sample.labels, rule.selector, rule.uidLabel)
+			continue
+		}
+		if _, ok := replicas[uid]; !ok {
+			uids = append(uids, uid)
+			replicas[uid] = make(map[string][]*histogramSample)
+		}
+		key := histogramSeriesKey(sample.labels)
+		replicas[uid][key] = append(replicas[uid][key], sample)
+	}
+
+	used, peak := rule.histogram.Quantiles()
+	for _, uid := range uids {
+		var keys []string
+		for key := range replicas[uid] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		var quantile func(q float64) float64
+		if rule.histogram.IsSummary() {
+			quantile = func(q float64) float64 {
+				return summaryQuantile(q, keys, replicas[uid], weights)
+			}
+		} else {
+			var histograms [][]bucket
+			for _, key := range keys {
+				if buckets, ok := toBuckets(replicas[uid][key]); ok {
+					histograms = append(histograms, buckets)
+				}
+			}
+			merged := mergeBuckets(histograms)
+			quantile = func(q float64) float64 {
+				return bucketQuantile(q, merged)
+			}
+		}
+
+		labels := withoutLabels(replicas[uid][keys[0]][0].labels, bucketLabel, quantileLabel)
+
+		value := quantile(used)
+		if math.IsNaN(value) {
+			glog.V(3).Infof("Skipping metric %s of %s matched by %s: no observation", rule.metric, uid, rule.selector)
+			continue
+		}
+		s.add(rule.entityType, uid, rule.metric, value, labels)
+
+		if peak > 0 {
+			if value := quantile(peak); !math.IsNaN(value) {
+				s.add(rule.entityType, uid, rule.metric+constant.PeakSuffix, value, labels)
+			}
+		}
+	}
+}
+
+// toBuckets converts the samples of the buckets of a histogram into the buckets sorted by the upper bounds.
+// The histogram is invalid if it doesn't have the +Inf bucket.
+func toBuckets(samples []*histogramSample) ([]bucket, bool) {
+	var buckets []bucket
+	for _, sample := range samples {
+		upperBound, err := strconv.ParseFloat(sample.labels[bucketLabel], 64)
+		if err != nil || math.IsNaN(sample.value) || math.IsInf(sample.value, 0) {
+			glog.V(3).Infof("Skipping invalid bucket %v", sample.labels)
+			continue
+		}
+		buckets = append(buckets, bucket{upperBound: upperBound, count: sample.value})
+	}
+
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].upperBound < buckets[j].upperBound
+	})
+
+	if len(buckets) < 2 || !math.IsInf(buckets[len(buckets)-1].upperBound, 1) {
+		glog.V(3).Infof("Skipping histogram without the +Inf bucket: %v", samples[0].labels)
+		return nil, false
+	}
+
+	// The counts of the buckets may not be monotonic, e.g., if they are not scraped at the same time
+	for i := 1; i < len(buckets); i++ {
+		buckets[i].count = math.Max(buckets[i].count, buckets[i-1].count)
+	}
+
+	return buckets, true
+}
+
+// mergeBuckets sums up the histograms, which may have different bucket layouts, over the union of the upper bounds.
+// The count of a histogram at an upper bound it doesn't have is interpolated linearly within the enclosing bucket.
+func mergeBuckets(histograms [][]bucket) []bucket {
+	if len(histograms) == 1 {
+		return histograms[0]
+	}
+
+	seen := make(map[float64]bool)
+	var upperBounds []float64
+	for _, buckets := range histograms {
+		for _, b := range buckets {
+			if !seen[b.upperBound] {
+				seen[b.upperBound] = true
+				upperBounds = append(upperBounds, b.upperBound)
+			}
+		}
+	}
+	sort.Float64s(upperBounds)
+
+	merged := make([]bucket, len(upperBounds))
+	for i, upperBound := range upperBounds {
+		merged[i].upperBound = upperBound
+		for _, buckets := range histograms {
+			merged[i].count += cumulativeCount(buckets, upperBound)
+		}
+	}
+	return merged
+}
+
+// cumulativeCount estimates the count of the observations less than or equal to the value in the histogram.
+// The observations above the highest finite upper bound are assumed to be above the value.
+func cumulativeCount(buckets []bucket, value float64) float64 {
+	i := sort.Search(len(buckets), func(i int) bool {
+		return buckets[i].upperBound >= value
+	})
+
+	switch {
+	case buckets[i].upperBound == value:
+		return buckets[i].count
+	case i == len(buckets)-1:
+		return buckets[i-1].count
+	}
+
+	lowerBound, lowerCount := 0.0, 0.0
+	if i > 0 {
+		lowerBound, lowerCount = buckets[i-1].upperBound, buckets[i-1].count
+	} else if buckets[i].upperBound <= 0 || value <= 0 {
+		// The lower bound of the first bucket is only known to be 0 if its upper bound is positive
+		return 0
+	}
+
+	return lowerCount + (buckets[i].count-lowerCount)*(value-lowerBound)/(buckets[i].upperBound-lowerBound)
+}
+
+// bucketQuantile calculates the quantile in (0, 1] of the sorted buckets the same way as histogram_quantile()
+// in PromQL, i.e., by linear interpolation within the bucket of the quantile. It returns NaN if there is no
+// observation in the buckets.
+func bucketQuantile(q float64, buckets []bucket) float64 {
+	if len(buckets) < 2 {
+		return math.NaN()
+	}
+
+	total := buckets[len(buckets)-1].count
+	if total <= 0 {
+		return math.NaN()
+	}
+
+	rank := q * total
+	b := sort.Search(len(buckets)-1, func(i int) bool {
+		return buckets[i].count >= rank
+	})
+
+	switch {
+	case b == len(buckets)-1:
+		// The quantile is in the +Inf bucket
+		return buckets[len(buckets)-2].upperBound
+	case b == 0 && buckets[0].upperBound <= 0:
+		return buckets[0].upperBound
+	}
+
+	lowerBound, count := 0.0, buckets[b].count
+	if b > 0 {
+		lowerBound = buckets[b-1].upperBound
+		count -= buckets[b-1].count
+		rank -= buckets[b-1].count
+	}
+
+	return lowerBound + (buckets[b].upperBound-lowerBound)*(rank/count)
+}
+
+// summaryQuantile averages the quantile reported by the replicas of a summary, weighed by their observation
+// counts if all of them are known. It returns NaN if no replica reports the quantile.
+func summaryQuantile(q float64, keys []string, replicas map[string][]*histogramSample,
+	weights map[string]float64) float64 {
+	var values, valueWeights []float64
+	weighed := true
+	for _, key := range keys {
+		for _, sample := range replicas[key] {
+			quantile, err := strconv.ParseFloat(sample.labels[quantileLabel], 64)
+			if err != nil || math.Abs(quantile-q) > quantileTolerance {
+				continue
+			}
+			if math.IsNaN(sample.value) || math.IsInf(sample.value, 0) {
+				continue
+			}
+			weight, ok := weights[key]
+			weighed = weighed && ok
+			values = append(values, sample.value)
+			valueWeights = append(valueWeights, weight)
+		}
+	}
+
+	if len(values) == 0 {
+		return math.NaN()
+	}
+
+	sum, totalWeight := 0.0, 0.0
+	for i, v := range values {
+		sum += v * valueWeights[i]
+		totalWeight += valueWeights[i]
+	}
+	if weighed && totalWeight > 0 {
+		return sum / totalWeight
+	}
+	return Aggregate(values, conf.AggregationAvg)
+}
+
+// counterIncrease returns the increase of a counter from its valid values in time order, taking the resets into
+// account the same way as increase() in PromQL, but without extrapolating to the boundaries of the window
+func counterIncrease(values []float64) float64 {
+	increase := 0.0
+	for i := 1; i < len(values); i++ {
+		if values[i] < values[i-1] {
+			// The counter was reset
+			increase += values[i]
+		} else {
+			increase += values[i] - values[i-1]
+		}
+	}
+	return increase
+}
+
+// histogramSeriesKey identifies the series of a histogram or a summary by the labels other than the metric name,
+// the bucket and the quantile, so that the buckets, the quantiles and the count of a series share the key
+func histogramSeriesKey(labels map[string]string) string {
+	return labelSetKey(withoutLabels(labels, metricNameLabel, bucketLabel, quantileLabel))
+}
+
+// withoutLabels returns a copy of the labels without the given ones
+func withoutLabels(labels map[string]string, excluded ...string) map[string]string {
+	result := make(map[string]string, len(labels))
+	for name, value := range labels {
+		result[name] = value
+	}
+	for _, name := range excluded {
+		delete(result, name)
+	}
+	return result
+}
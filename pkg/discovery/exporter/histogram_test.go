@@ -0,0 +1,132 @@
+package exporter
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/turbonomic/prometurbo/pkg/conf"
+	"github.com/turbonomic/prometurbo/pkg/discovery/constant"
+)
+
+func newBucketSamples(instance string, buckets map[string]float64) []*histogramSample {
+	var samples []*histogramSample
+	for le, count := range buckets {
+		samples = append(samples, &histogramSample{
+			labels: map[string]string{metricNameLabel: "latency_seconds_bucket", "ip": "1.2.3.4", "instance": instance, bucketLabel: le},
+			value:  count,
+		})
+	}
+	return samples
+}
+
+func TestBucketQuantile(t *testing.T) {
+	inf := math.Inf(1)
+	buckets := []bucket{{0.1, 10}, {0.5, 30}, {1, 40}, {inf, 40}}
+
+	tests := map[float64]float64{
+		0.25: 0.1,
+		0.5:  0.3,
+		1:    1,
+	}
+	for q, expected := range tests {
+		if got := bucketQuantile(q, buckets); math.Abs(got-expected) > 1e-9 {
+			t.Errorf("bucketQuantile(%v) = %v, want %v", q, got, expected)
+		}
+	}
+
+	// The quantile in the +Inf bucket is the highest finite upper bound
+	if got := bucketQuantile(0.9, []bucket{{1, 5}, {inf, 10}}); got != 1 {
+		t.Errorf("bucketQuantile() = %v, want 1", got)
+	}
+
+	if got := bucketQuantile(0.9, []bucket{{1, 0}, {inf, 0}}); !math.IsNaN(got) {
+		t.Errorf("bucketQuantile() of an empty histogram = %v, want NaN", got)
+	}
+}
+
+func TestAddHistogram_MixedLayouts(t *testing.T) {
+	rule := &histogramRule{
+		metric:     constant.Latency,
+		entityType: constant.ApplicationType,
+		uidLabel:   "ip",
+		histogram:  &conf.HistogramConf{Metric: "latency_seconds", Percentile: "p50", PeakPercentile: "p99"},
+	}
+
+	samples := append(newBucketSamples("a", map[string]float64{"0.1": 10, "1": 20, "+Inf": 20}),
+		newBucketSamples("b", map[string]float64{"0.5": 10, "+Inf": 10})...)
+	// Skipped without the UID label
+	samples = append(samples, &histogramSample{labels: map[string]string{bucketLabel: "+Inf"}, value: 100})
+
+	metricSet := newEntityMetricSet()
+	metricSet.addHistogram(rule, samples, nil)
+	metrics := metricSet.list()
+
+	if len(metrics) != 1 {
+		t.Fatalf("Expected 1 entity but got %+v", metrics)
+	}
+
+	// The replicas are merged over the bounds 0.1, 0.5, 1 and +Inf into the counts 12, 24.44, 30 and 30
+	used := 0.1 + 0.4*(15-12)/(220.0/9-12)
+	peak := 0.5 + 0.5*(29.7-220.0/9)/(30-220.0/9)
+	if got := metrics[0].Metrics[constant.Latency]; math.Abs(got-used) > 1e-9 {
+		t.Errorf("Got used value %v, want %v", got, used)
+	}
+	if got := metrics[0].Metrics[constant.Latency+constant.PeakSuffix]; math.Abs(got-peak) > 1e-9 {
+		t.Errorf("Got peak value %v, want %v", got, peak)
+	}
+
+	if _, ok := metrics[0].Labels[bucketLabel]; ok {
+		t.Errorf("Unexpected bucket label in %v", metrics[0].Labels)
+	}
+}
+
+func TestAddHistogram_Summary(t *testing.T) {
+	rule := &histogramRule{
+		metric:     constant.Latency,
+		entityType: constant.ApplicationType,
+		uidLabel:   "ip",
+		histogram:  &conf.HistogramConf{Metric: "latency_seconds", Kind: conf.HistogramKindSummary, Percentile: "p90"},
+	}
+
+	newSample := func(instance, quantile string, value float64) *histogramSample {
+		labels := map[string]string{metricNameLabel: "latency_seconds", "ip": "1.2.3.4", "instance": instance}
+		if quantile != "" {
+			labels[quantileLabel] = quantile
+		}
+		return &histogramSample{labels: labels, value: value}
+	}
+	samples := []*histogramSample{
+		newSample("a", "0.5", 50),
+		newSample("a", "0.9", 100),
+		newSample("b", "0.90", 200),
+		newSample("c", "0.9", math.NaN()),
+	}
+	counts := []*histogramSample{newSample("a", "", 30), newSample("b", "", 10)}
+
+	tests := []struct {
+		counts   []*histogramSample
+		expected float64
+	}{
+		// Weighed by the counts
+		{counts, 125},
+		// Averaged without the counts
+		{nil, 150},
+	}
+
+	for _, test := range tests {
+		metricSet := newEntityMetricSet()
+		metricSet.addHistogram(rule, samples, test.counts)
+
+		expected := map[string]float64{constant.Latency: test.expected}
+		if metrics := metricSet.list(); len(metrics) != 1 || !reflect.DeepEqual(metrics[0].Metrics, expected) {
+			t.Errorf("addHistogram() = %+v, want metrics %v", metrics, expected)
+		}
+	}
+}
+
+func TestCounterIncrease(t *testing.T) {
+	if got := counterIncrease([]float64{5, 10, 2, 4}); got != 9 {
+		t.Errorf("counterIncrease() = %v, want 9", got)
+	}
+}
@@ -0,0 +1,190 @@
+package exporter
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/turbonomic/prometurbo/pkg/conf"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewHTTPClient creates the client that the exporters send the requests with, which
+// authenticates with the given settings and retries the transient failures with the given policy.
+// The client without auth is created if auth is nil, and the one without retry if retry is nil.
+func NewHTTPClient(auth *conf.AuthConf, retry *RetryPolicy) (*http.Client, error) {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	rt, err := newAuthRoundTripper(auth, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	if retry != nil && retry.MaxRetries > 0 {
+		rt = &retryRoundTripper{
+			policy: retry,
+			rt:     rt,
+		}
+	}
+
+	return &http.Client{Transport: rt}, nil
+}
+
+// newAuthRoundTripper applies the auth settings to the transport
+func newAuthRoundTripper(auth *conf.AuthConf, transport *http.Transport) (http.RoundTripper, error) {
+	if auth == nil {
+		return transport, nil
+	}
+
+	if auth.TLS != nil {
+		tlsConfig, err := newTLSConfig(auth.TLS)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	var rt http.RoundTripper = transport
+	if auth.Username != "" {
+		rt = &basicAuthRoundTripper{
+			username: auth.Username,
+			password: auth.Password,
+			rt:       rt,
+		}
+	} else if auth.BearerTokenFile != "" {
+		tokenRT := &bearerTokenFileRoundTripper{
+			tokenFile: auth.BearerTokenFile,
+			rt:        rt,
+		}
+		// Fail early if the token is not readable
+		if _, err := tokenRT.getToken(); err != nil {
+			return nil, err
+		}
+		rt = tokenRT
+	}
+
+	return rt, nil
+}
+
+func newTLSConfig(tlsConf *conf.TLSConf) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         tlsConf.ServerName,
+		InsecureSkipVerify: tlsConf.InsecureSkipVerify,
+	}
+
+	if tlsConf.CAFile != "" {
+		ca, err := ioutil.ReadFile(tlsConf.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the CA file %s: %v", tlsConf.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in the CA file %s", tlsConf.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if tlsConf.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(tlsConf.CertFile, tlsConf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the client certificate %s: %v", tlsConf.CertFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+type basicAuthRoundTripper struct {
+	username string
+	password string
+	rt       http.RoundTripper
+}
+
+func (b *basicAuthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = cloneRequest(req)
+	req.SetBasicAuth(b.username, b.password)
+	return b.rt.RoundTrip(req)
+}
+
+// bearerTokenFileRoundTripper sets the bearer token read from a file, which is reloaded when the file changes
+type bearerTokenFileRoundTripper struct {
+	tokenFile string
+	rt        http.RoundTripper
+
+	lock    sync.Mutex
+	token   string
+	modTime time.Time
+	size    int64
+}
+
+func (b *bearerTokenFileRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := b.getToken()
+	if err != nil {
+		return nil, err
+	}
+
+	req = cloneRequest(req)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return b.rt.RoundTrip(req)
+}
+
+// getToken returns the token in the file, which is read again only if the file has changed
+func (b *bearerTokenFileRoundTripper) getToken() (string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	info, err := os.Stat(b.tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the bearer token file %s: %v", b.tokenFile, err)
+	}
+
+	if b.token != "" && info.ModTime().Equal(b.modTime) && info.Size() == b.size {
+		return b.token, nil
+	}
+
+	content, err := ioutil.ReadFile(b.tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the bearer token file %s: %v", b.tokenFile, err)
+	}
+
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", fmt.Errorf("the bearer token file %s is empty", b.tokenFile)
+	}
+
+	if b.token != "" {
+		glog.V(2).Infof("Reloaded the bearer token from %s", b.tokenFile)
+	}
+	b.token, b.modTime, b.size = token, info.ModTime(), info.Size()
+
+	return b.token, nil
+}
+
+// cloneRequest returns a shallow copy of the request with a deep copy of the header,
+// since a RoundTripper must not modify the request
+func cloneRequest(req *http.Request) *http.Request {
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = append([]string(nil), v...)
+	}
+	return r
+}
@@ -0,0 +1,99 @@
+package exporter
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/turbonomic/prometurbo/pkg/conf"
+)
+
+func newAuthServer() (*httptest.Server, *string) {
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		w.Write([]byte("ok"))
+	}))
+	return server, &auth
+}
+
+func TestNewHTTPClient_BasicAuth(t *testing.T) {
+	server, auth := newAuthServer()
+	defer server.Close()
+
+	client, err := NewHTTPClient(&conf.AuthConf{Username: "user", Password: "secret"}, nil)
+	if err != nil {
+		t.Fatalf("NewHTTPClient() error = %v", err)
+	}
+
+	if _, err := sendRequest(context.Background(), client, server.URL); err != nil {
+		t.Fatalf("sendRequest() error = %v", err)
+	}
+
+	// base64("user:secret")
+	if expected := "Basic dXNlcjpzZWNyZXQ="; *auth != expected {
+		t.Errorf("Authorization = %q, want %q", *auth, expected)
+	}
+}
+
+func TestNewHTTPClient_BearerTokenReload(t *testing.T) {
+	server, auth := newAuthServer()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewHTTPClient(&conf.AuthConf{BearerTokenFile: tokenFile}, nil)
+	if err != nil {
+		t.Fatalf("NewHTTPClient() error = %v", err)
+	}
+
+	if _, err := sendRequest(context.Background(), client, server.URL); err != nil {
+		t.Fatalf("sendRequest() error = %v", err)
+	}
+	if expected := "Bearer first"; *auth != expected {
+		t.Errorf("Authorization = %q, want %q", *auth, expected)
+	}
+
+	// Rotate the token with a different modification time
+	if err := ioutil.WriteFile(tokenFile, []byte("second\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(tokenFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sendRequest(context.Background(), client, server.URL); err != nil {
+		t.Fatalf("sendRequest() error = %v", err)
+	}
+	if expected := "Bearer second"; *auth != expected {
+		t.Errorf("Authorization = %q, want %q", *auth, expected)
+	}
+}
+
+func TestNewHTTPClient_MissingFiles(t *testing.T) {
+	auths := []*conf.AuthConf{
+		{BearerTokenFile: "/nonexistent/token"},
+		{TLS: &conf.TLSConf{CAFile: "/nonexistent/ca.crt"}},
+		{TLS: &conf.TLSConf{CertFile: "/nonexistent/client.crt", KeyFile: "/nonexistent/client.key"}},
+	}
+
+	for _, auth := range auths {
+		if _, err := NewHTTPClient(auth, nil); err == nil {
+			t.Errorf("NewHTTPClient(%+v) expected an error", auth)
+		}
+	}
+}
@@ -1,28 +1,34 @@
 package exporter
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/golang/glog"
+	"github.com/turbonomic/prometurbo/pkg/discovery/constant"
 	"io/ioutil"
 	"net/http"
 )
 
 type MetricExporter interface {
-	Query() ([]*EntityMetric, error)
+	// Query returns the metrics of the entities, which gives up once the context is done
+	Query(ctx context.Context) ([]*EntityMetric, error)
 }
 
 type metricExporter struct {
 	endpoint string
+	client   *http.Client
 }
 
-func NewMetricExporter(endpoint string) *metricExporter {
+func NewMetricExporter(endpoint string, client *http.Client) *metricExporter {
 	return &metricExporter{
 		endpoint: endpoint,
+		client:   client,
 	}
 }
 
-func (m *metricExporter) Query() ([]*EntityMetric, error) {
-	resp, err := sendRequest(m.endpoint)
+func (m *metricExporter) Query(ctx context.Context) ([]*EntityMetric, error) {
+	resp, err := sendRequest(ctx, m.client, m.endpoint)
 	if err != nil {
 		return nil, err
 	}
@@ -40,14 +46,37 @@ func (m *metricExporter) Query() ([]*EntityMetric, error) {
 	glog.V(4).Infof("mr=%+v, len=%d\n", mr, len(mr.Data))
 	for i, e := range mr.Data {
 		glog.V(4).Infof("[%d] %+v\n", i, e)
+
+		// Translate the appmetric entity type into the Turbo entity type
+		if entityType, ok := constant.AppMetricEntityTypeMap[e.Type]; ok {
+			e.Type = int32(entityType)
+		}
 	}
 
 	return mr.Data, nil
 }
 
-func sendRequest(endpoint string) ([]byte, error) {
+// Ready checks if the exporter serves the metrics, as it has no readiness endpoint
+func (m *metricExporter) Ready(ctx context.Context) error {
+	_, err := sendRequest(ctx, m.client, m.endpoint)
+	return err
+}
+
+func sendRequest(ctx context.Context, client *http.Client, endpoint string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return send(ctx, client, req)
+}
+
+func send(ctx context.Context, client *http.Client, req *http.Request) ([]byte, error) {
+	endpoint := req.URL.String()
+	req = req.WithContext(ctx)
+
 	glog.V(2).Infof("Sending request to %s", endpoint)
-	resp, err := http.Get(endpoint)
+	resp, err := client.Do(req)
 	if err != nil {
 		glog.Errorf("Failed getting response from %s: %v", endpoint, err)
 		return nil, err
@@ -61,5 +90,10 @@ func sendRequest(endpoint string) ([]byte, error) {
 		return nil, err
 	}
 	glog.V(4).Infof("Received resposne: %s", string(body))
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return nil, fmt.Errorf("request to %s failed with status %s: %s", endpoint, resp.Status, string(body))
+	}
+
 	return body, nil
 }
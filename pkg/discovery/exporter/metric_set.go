@@ -0,0 +1,133 @@
+package exporter
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// entityMetricSet collects the metrics of entities identified by entity type and UID.
+// The entities are listed in the order they are first added, so that the output is stable.
+type entityMetricSet struct {
+	entities []*EntityMetric
+	index    map[string]*EntityMetric
+	// The metrics of the entities which are unavailable in this discovery
+	unavailable map[string]bool
+	// The units of the metrics of each entity type
+	units map[int32]map[string]string
+}
+
+func newEntityMetricSet() *entityMetricSet {
+	return &entityMetricSet{
+		index:       make(map[string]*EntityMetric),
+		unavailable: make(map[string]bool),
+		units:       make(map[int32]map[string]string),
+	}
+}
+
+// add sets the value of the named metric of an entity, creating the entity if it doesn't exist yet.
+// Values from multiple series of the same entity and metric are summed up.
+func (s *entityMetricSet) add(entityType int32, uid, metric string, value float64, labels map[string]string) {
+	key := fmt.Sprintf("%d/%s", entityType, uid)
+	if s.unavailable[key+"/"+metric] {
+		return
+	}
+
+	entity, ok := s.index[key]
+	if !ok {
+		entity = &EntityMetric{
+			UID:     uid,
+			Type:    entityType,
+			Labels:  labels,
+			Metrics: make(map[string]float64),
+		}
+		s.index[key] = entity
+		s.entities = append(s.entities, entity)
+	}
+
+	entity.Metrics[metric] += value
+}
+
+// addCall adds the value of the named metric of the calls from an entity to another one, creating the calling
+// entity if it doesn't exist yet. Values from multiple series of the same call and metric are summed up.
+func (s *entityMetricSet) addCall(entityType int32, source, destination, metric string, value float64) {
+	key := fmt.Sprintf("%d/%s", entityType, source)
+
+	entity, ok := s.index[key]
+	if !ok {
+		entity = &EntityMetric{
+			UID:     source,
+			Type:    entityType,
+			Metrics: make(map[string]float64),
+		}
+		s.index[key] = entity
+		s.entities = append(s.entities, entity)
+	}
+
+	if entity.Calls == nil {
+		entity.Calls = make(map[string]map[string]float64)
+	}
+	if _, ok := entity.Calls[destination]; !ok {
+		entity.Calls[destination] = make(map[string]float64)
+	}
+	entity.Calls[destination][metric] += value
+}
+
+// markUnavailable removes the named metric of an entity, and ignores the values of the metric added afterwards,
+// so that the metric is not reported rather than partially summed up
+func (s *entityMetricSet) markUnavailable(entityType int32, uid, metric string) {
+	key := fmt.Sprintf("%d/%s", entityType, uid)
+	s.unavailable[key+"/"+metric] = true
+
+	if entity, ok := s.index[key]; ok {
+		delete(entity.Metrics, metric)
+	}
+}
+
+// setUnit sets the unit of the named metric of all the entities of the type
+func (s *entityMetricSet) setUnit(entityType int32, metric, unit string) {
+	if _, ok := s.units[entityType]; !ok {
+		s.units[entityType] = make(map[string]string)
+	}
+	s.units[entityType][metric] = unit
+}
+
+// list returns the entities, except the ones left without any metric as all their metrics are unavailable,
+// unless they call other entities
+func (s *entityMetricSet) list() []*EntityMetric {
+	var entities []*EntityMetric
+	for _, entity := range s.entities {
+		if len(entity.Metrics) == 0 && len(entity.Calls) == 0 {
+			continue
+		}
+		for metric, unit := range s.units[entity.Type] {
+			if _, ok := entity.Metrics[metric]; !ok {
+				continue
+			}
+			if entity.Units == nil {
+				entity.Units = make(map[string]string)
+			}
+			entity.Units[metric] = unit
+		}
+		entities = append(entities, entity)
+	}
+	return entities
+}
+
+// labelSetKey identifies a series by its labels
+func labelSetKey(labels map[string]string) string {
+	var names []string
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte(0)
+		b.WriteString(labels[name])
+		b.WriteByte(0)
+	}
+	return b.String()
+}
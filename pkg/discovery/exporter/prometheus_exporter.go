@@ -0,0 +1,476 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/turbonomic/prometurbo/pkg/conf"
+	"github.com/turbonomic/prometurbo/pkg/discovery/constant"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	queryAPIPath      = "/api/v1/query"
+	queryRangeAPIPath = "/api/v1/query_range"
+	metadataAPIPath   = "/api/v1/metadata"
+	readyPath         = "/-/ready"
+
+	// The min resolution of the range queries, and the max number of points of a series in their results
+	minRangeStep      = 15 * time.Second
+	maxPointsPerRange = 1000
+
+	promStatusSuccess = "success"
+
+	resultTypeVector = "vector"
+	resultTypeMatrix = "matrix"
+	resultTypeScalar = "scalar"
+)
+
+// promQuery is a PromQL query whose result feeds one metric of a type of entities
+type promQuery struct {
+	// The metric name used as the key of EntityMetric.Metrics
+	metric string
+	// The PromQL expression
+	query string
+	// The type of the entities built from the query result
+	entityType int32
+	// The label whose value becomes the EntityMetric.UID
+	uidLabel string
+	// The aggregation of the query result over a window; the instant value is used if nil
+	aggregation *conf.AggregationConf
+	// The query result is a counter, whose rate since the previous discovery is reported
+	counter bool
+}
+
+// unitLookup looks up the unit of a metric, which is not set in the metric config, from the metadata in Prometheus
+type unitLookup struct {
+	metric     string
+	entityType int32
+	// The name of the Prometheus metric whose metadata has the unit
+	name string
+}
+
+// prometheusExporter queries the Prometheus HTTP API directly. The queries requesting an aggregation
+// are evaluated over the window, which defaults to the discovery interval, and so is the increase
+// of the buckets of the histograms.
+type prometheusExporter struct {
+	address    string
+	window     time.Duration
+	queries    []*promQuery
+	histograms []*histogramRule
+	rates      *counterRates
+	client     *http.Client
+	// The queries of the calls between the applications; none if nil
+	callGraph *conf.CallGraphConf
+
+	unitLookups []*unitLookup
+	// The units found in the metadata of the Prometheus metrics, guarded by the lock
+	metadataLock  sync.Mutex
+	metadataUnits map[string]string
+}
+
+func NewPrometheusExporter(address string, window time.Duration, metricConf *conf.MetricConf,
+	client *http.Client) *prometheusExporter {
+	return &prometheusExporter{
+		address:    strings.TrimSuffix(address, "/"),
+		window:     window,
+		queries:    newPromQueries(metricConf),
+		histograms: newHistogramRules(metricConf),
+		rates:      newCounterRates(),
+		client:     client,
+		callGraph:  metricConf.CallGraph,
+
+		unitLookups:   newUnitLookups(metricConf),
+		metadataUnits: make(map[string]string),
+	}
+}
+
+// newPromQueries collects the queries of all the commodities declared in the metric config,
+// followed by the queries of their capacities and their peaks
+func newPromQueries(metricConf *conf.MetricConf) []*promQuery {
+	var queries []*promQuery
+	for _, entity := range metricConf.Entities {
+		for _, comm := range entity.Commodities {
+			if comm.Query == "" {
+				continue
+			}
+			queries = append(queries, &promQuery{
+				metric:      comm.Name,
+				query:       comm.Query,
+				entityType:  int32(entity.EntityType()),
+				uidLabel:    entity.UIDLabel,
+				aggregation: comm.Aggregation,
+				counter:     comm.Counter,
+			})
+		}
+		for _, comm := range entity.Commodities {
+			if comm.CapacityQuery == "" {
+				continue
+			}
+			queries = append(queries, &promQuery{
+				metric:     comm.Name + constant.CapacitySuffix,
+				query:      comm.CapacityQuery,
+				entityType: int32(entity.EntityType()),
+				uidLabel:   entity.UIDLabel,
+			})
+		}
+		for _, comm := range entity.Commodities {
+			if comm.PeakQuery == "" {
+				continue
+			}
+			queries = append(queries, &promQuery{
+				metric:     comm.Name + constant.PeakSuffix,
+				query:      comm.PeakQuery,
+				entityType: int32(entity.EntityType()),
+				uidLabel:   entity.UIDLabel,
+			})
+		}
+	}
+	return queries
+}
+
+// newUnitLookups collects the metrics whose units are not set in the metric config, but can be found in
+// the metadata of the histograms or of the metrics queried by their names
+func newUnitLookups(metricConf *conf.MetricConf) []*unitLookup {
+	var lookups []*unitLookup
+	for _, entity := range metricConf.Entities {
+		for _, comm := range entity.Commodities {
+			// The rate of a counter is not in the unit of the counter
+			if comm.Unit != "" || comm.Counter {
+				continue
+			}
+
+			var name string
+			if comm.Histogram != nil {
+				name = comm.Histogram.Metric
+			} else if selector, err := parseSelector(comm.Query); err == nil {
+				name = selector.metricName()
+			}
+			if name == "" {
+				continue
+			}
+
+			lookups = append(lookups, &unitLookup{
+				metric:     comm.Name,
+				entityType: int32(entity.EntityType()),
+				name:       name,
+			})
+		}
+	}
+	return lookups
+}
+
+func (p *prometheusExporter) String() string {
+	return p.address
+}
+
+// Ready checks the readiness endpoint of the Prometheus server
+func (p *prometheusExporter) Ready(ctx context.Context) error {
+	_, err := sendRequest(ctx, p.client, p.address+readyPath)
+	return err
+}
+
+func (p *prometheusExporter) Query(ctx context.Context) ([]*EntityMetric, error) {
+	metricSet := newEntityMetricSet()
+	now := time.Now()
+
+	for _, q := range p.queries {
+		var series []*promSeries
+		var err error
+		if q.aggregation != nil {
+			series, err = p.queryRange(ctx, q.query, now.Add(-q.aggregation.WindowOr(p.window)), now)
+		} else {
+			series, err = p.query(ctx, q.query)
+		}
+		if err != nil {
+			glog.Errorf("Failed to query %s from %s: %v", q.query, p.address, err)
+			return nil, err
+		}
+
+		for _, s := range series {
+			uid, ok := s.Metric[q.uidLabel]
+			if !ok || uid == "" {
+				glog.V(3).Infof("Skipping series %v of query %s: missing label %s", s.Metric, q.query, q.uidLabel)
+				continue
+			}
+
+			if q.aggregation != nil {
+				metricSet.addAggregated(q.entityType, uid, q.metric, s.validValues(), q.aggregation, s.Metric)
+				continue
+			}
+
+			value, ok := s.lastValue()
+			if !ok {
+				glog.V(3).Infof("Skipping series %v of query %s: no valid value", s.Metric, q.query)
+				continue
+			}
+
+			if q.counter {
+				metricSet.addCounter(p.rates, q.entityType, uid, q.metric, value, s.Metric, now, now)
+				continue
+			}
+
+			metricSet.add(q.entityType, uid, q.metric, value, s.Metric)
+		}
+	}
+	p.rates.forgetBefore(now)
+
+	for _, rule := range p.histograms {
+		if err := p.queryHistogram(ctx, rule, metricSet); err != nil {
+			glog.Errorf("Failed to query %s from %s: %v", rule.selector, p.address, err)
+			return nil, err
+		}
+	}
+
+	if p.callGraph != nil {
+		if err := p.queryCallGraph(ctx, metricSet); err != nil {
+			glog.Errorf("Failed to query the call graph from %s: %v", p.address, err)
+			return nil, err
+		}
+	}
+
+	p.setUnits(ctx, metricSet)
+
+	return metricSet.list(), nil
+}
+
+// queryCallGraph queries the request rates and the response times of the calls between the applications,
+// and adds them to the calls of the calling applications
+func (p *prometheusExporter) queryCallGraph(ctx context.Context, metricSet *entityMetricSet) error {
+	queries := map[string]string{constant.TPS: p.callGraph.Query}
+	if p.callGraph.LatencyQuery != "" {
+		queries[constant.Latency] = p.callGraph.LatencyQuery
+	}
+
+	for _, metric := range []string{constant.TPS, constant.Latency} {
+		query, ok := queries[metric]
+		if !ok {
+			continue
+		}
+
+		series, err := p.query(ctx, query)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range series {
+			source, destination := s.Metric[p.callGraph.SourceLabel], s.Metric[p.callGraph.DestinationLabel]
+			if !isKnownApp(source) || !isKnownApp(destination) || source == destination {
+				glog.V(3).Infof("Skipping series %v of query %s: not a call between two applications", s.Metric, query)
+				continue
+			}
+
+			value, ok := s.lastValue()
+			if !ok {
+				glog.V(3).Infof("Skipping series %v of query %s: no valid value", s.Metric, query)
+				continue
+			}
+
+			metricSet.addCall(constant.ApplicationType, source, destination, metric, value)
+		}
+	}
+
+	return nil
+}
+
+// isKnownApp returns false for the applications istio cannot identify, e.g., the clients outside of the mesh
+func isKnownApp(workload string) bool {
+	return workload != "" && workload != "unknown"
+}
+
+// queryHistogram queries the increase of the buckets of a histogram over the window, or the quantiles
+// of a summary along with the increase of its count, and adds the resulting metric to the set
+func (p *prometheusExporter) queryHistogram(ctx context.Context, rule *histogramRule, metricSet *entityMetricSet) error {
+	window := formatPromDuration(rule.histogram.WindowOr(p.window))
+
+	// The quantiles of a summary are already computed over a sliding window by the clients
+	query := rule.selector.String()
+	if !rule.histogram.IsSummary() {
+		query = fmt.Sprintf("increase(%s[%s])", rule.selector, window)
+	}
+
+	series, err := p.query(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	var counts []*promSeries
+	if rule.countSelector != nil {
+		if counts, err = p.query(ctx, fmt.Sprintf("increase(%s[%s])", rule.countSelector, window)); err != nil {
+			return err
+		}
+	}
+
+	metricSet.addHistogram(rule, toHistogramSamples(series), toHistogramSamples(counts))
+	return nil
+}
+
+// setUnits sets the units of the metrics found in the metadata in Prometheus. The unit of each Prometheus
+// metric is kept once found, and the metadata without the unit is looked up again in the next discoveries,
+// as Prometheus may not have scraped the metric yet, e.g., at startup.
+func (p *prometheusExporter) setUnits(ctx context.Context, metricSet *entityMetricSet) {
+	for _, lookup := range p.unitLookups {
+		p.metadataLock.Lock()
+		unit, ok := p.metadataUnits[lookup.name]
+		p.metadataLock.Unlock()
+
+		if !ok {
+			var err error
+			if unit, err = p.queryUnit(ctx, lookup.name); err != nil {
+				glog.Warningf("Failed to query the metadata of %s from %s: %v", lookup.name, p.address, err)
+				continue
+			}
+			if unit == "" {
+				continue
+			}
+			p.metadataLock.Lock()
+			p.metadataUnits[lookup.name] = unit
+			p.metadataLock.Unlock()
+		}
+
+		metricSet.setUnit(lookup.entityType, lookup.metric, unit)
+	}
+}
+
+// queryUnit returns the unit in the metadata of the Prometheus metric, which is empty if the unit is unknown
+func (p *prometheusExporter) queryUnit(ctx context.Context, name string) (string, error) {
+	endpoint := p.address + metadataAPIPath + "?" + url.Values{"metric": []string{name}}.Encode()
+
+	resp, err := sendRequest(ctx, p.client, endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	var mr promMetadataResponse
+	if err := json.Unmarshal(resp, &mr); err != nil {
+		return "", fmt.Errorf("failed to decode the metadata: %v", err)
+	}
+
+	if mr.Status != promStatusSuccess {
+		return "", fmt.Errorf("metadata query failed with status %q: %s: %s", mr.Status, mr.ErrorType, mr.Error)
+	}
+
+	for _, metadata := range mr.Data[name] {
+		if metadata.Unit != "" {
+			return metadata.Unit, nil
+		}
+	}
+	return "", nil
+}
+
+func toHistogramSamples(series []*promSeries) []*histogramSample {
+	var samples []*histogramSample
+	for _, s := range series {
+		if value, ok := s.lastValue(); ok {
+			samples = append(samples, &histogramSample{labels: s.Metric, value: value})
+		}
+	}
+	return samples
+}
+
+// query sends an instant query to Prometheus and returns the result as a list of series.
+// A scalar result is returned as a single series without labels.
+func (p *prometheusExporter) query(ctx context.Context, query string) ([]*promSeries, error) {
+	return p.send(ctx, queryAPIPath, url.Values{"query": []string{query}})
+}
+
+// queryRange evaluates the query over the time range and returns the result as a list of series
+func (p *prometheusExporter) queryRange(ctx context.Context, query string, start, end time.Time) ([]*promSeries, error) {
+	step := end.Sub(start) / maxPointsPerRange
+	if step < minRangeStep {
+		step = minRangeStep
+	}
+
+	return p.send(ctx, queryRangeAPIPath, url.Values{
+		"query": []string{query},
+		"start": []string{formatPromTime(start)},
+		"end":   []string{formatPromTime(end)},
+		"step":  []string{strconv.FormatFloat(step.Seconds(), 'f', -1, 64)},
+	})
+}
+
+// formatPromDuration formats the duration as a PromQL duration in milliseconds, e.g., 600000ms
+func formatPromDuration(d time.Duration) string {
+	return strconv.FormatInt(int64(d/time.Millisecond), 10) + "ms"
+}
+
+func formatPromTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixNano())/float64(time.Second), 'f', 3, 64)
+}
+
+// send sends the query to the API at the path and decodes the result
+func (p *prometheusExporter) send(ctx context.Context, path string, params url.Values) ([]*promSeries, error) {
+	endpoint := p.address + path + "?" + params.Encode()
+
+	resp, err := sendRequest(ctx, p.client, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	var pr promResponse
+	if err := json.Unmarshal(resp, &pr); err != nil {
+		glog.Errorf("Failed to un-marshal bytes: %v", string(resp))
+		return nil, err
+	}
+
+	if pr.Status != promStatusSuccess {
+		return nil, fmt.Errorf("query failed with status %q: %s: %s", pr.Status, pr.ErrorType, pr.Error)
+	}
+
+	return pr.Data.series()
+}
+
+// series decodes the query result according to its result type
+func (d *promData) series() ([]*promSeries, error) {
+	switch d.ResultType {
+	case resultTypeVector, resultTypeMatrix:
+		var series []*promSeries
+		if err := json.Unmarshal(d.Result, &series); err != nil {
+			return nil, fmt.Errorf("failed to decode %s result: %v", d.ResultType, err)
+		}
+		return series, nil
+	case resultTypeScalar:
+		var point promPoint
+		if err := json.Unmarshal(d.Result, &point); err != nil {
+			return nil, fmt.Errorf("failed to decode %s result: %v", d.ResultType, err)
+		}
+		return []*promSeries{{Value: &point}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported result type %q", d.ResultType)
+	}
+}
+
+// lastValue returns the value of an instant vector sample, or the latest value of a range vector.
+func (s *promSeries) lastValue() (float64, bool) {
+	var point *promPoint
+	if s.Value != nil {
+		point = s.Value
+	} else if len(s.Values) > 0 {
+		point = &s.Values[len(s.Values)-1]
+	}
+
+	if point == nil || math.IsNaN(point.Value) || math.IsInf(point.Value, 0) {
+		return 0, false
+	}
+
+	return point.Value, true
+}
+
+// validValues returns the valid values of the series in time order
+func (s *promSeries) validValues() []float64 {
+	var values []float64
+	if s.Value != nil {
+		values = append(values, s.Value.Value)
+	}
+	for _, point := range s.Values {
+		values = append(values, point.Value)
+	}
+	return validValues(values)
+}
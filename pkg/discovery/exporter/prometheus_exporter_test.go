@@ -0,0 +1,309 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/turbonomic/prometurbo/pkg/conf"
+	"github.com/turbonomic/prometurbo/pkg/discovery/constant"
+)
+
+const (
+	vectorResult = `{"status":"success","data":{"resultType":"vector","result":[
+		{"metric":{"destination_ip":"1.2.3.4"},"value":[1435781451.781,"%s"]},
+		{"metric":{"destination_ip":"5.6.7.8"},"value":[1435781451.781,"NaN"]},
+		{"metric":{"job":"foo"},"value":[1435781451.781,"1"]}]}}`
+	matrixResult = `{"status":"success","data":{"resultType":"matrix","result":[
+		{"metric":{"destination_ip":"1.2.3.4"},"values":[[1435781430.781,"1"],[1435781445.781,"%s"]]}]}}`
+	scalarResult = `{"status":"success","data":{"resultType":"scalar","result":[1435781451.781,"%s"]}}`
+	errorResult  = `{"status":"error","errorType":"bad_data","error":"parse error"}`
+)
+
+func newPromServer(results map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != queryAPIPath && r.URL.Path != queryRangeAPIPath {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, results[r.URL.Query().Get("query")])
+	}))
+}
+
+func TestPrometheusExporter_Query(t *testing.T) {
+	server := newPromServer(map[string]string{
+		"tps":     fmt.Sprintf(vectorResult, "10.5"),
+		"latency": fmt.Sprintf(matrixResult, "200"),
+	})
+	defer server.Close()
+
+	p := NewPrometheusExporter(server.URL+"/", time.Minute, conf.DefaultMetricConf(), http.DefaultClient)
+	p.queries = []*promQuery{
+		{metric: constant.TPS, query: "tps", entityType: constant.ApplicationType, uidLabel: "destination_ip"},
+		{metric: constant.Latency, query: "latency", entityType: constant.ApplicationType, uidLabel: "destination_ip"},
+	}
+
+	metrics, err := p.Query(context.Background())
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+
+	expected := []*EntityMetric{
+		{
+			UID:     "1.2.3.4",
+			Type:    constant.ApplicationType,
+			Labels:  map[string]string{"destination_ip": "1.2.3.4"},
+			Metrics: map[string]float64{constant.TPS: 10.5, constant.Latency: 200},
+		},
+	}
+
+	if !reflect.DeepEqual(metrics, expected) {
+		t.Errorf("Query() = %+v, want %+v", metrics[0], expected[0])
+	}
+}
+
+func TestPrometheusExporter_Query_Failed(t *testing.T) {
+	server := newPromServer(map[string]string{
+		"tps": errorResult,
+	})
+	defer server.Close()
+
+	p := NewPrometheusExporter(server.URL, time.Minute, conf.DefaultMetricConf(), http.DefaultClient)
+	p.queries = []*promQuery{
+		{metric: constant.TPS, query: "tps", entityType: constant.ApplicationType, uidLabel: "destination_ip"},
+	}
+
+	if _, err := p.Query(context.Background()); err == nil {
+		t.Errorf("Query() expected an error from a failed query")
+	}
+}
+
+func TestPrometheusExporter_Query_Aggregation(t *testing.T) {
+	var start, end float64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != queryRangeAPIPath {
+			http.NotFound(w, r)
+			return
+		}
+		start, _ = strconv.ParseFloat(r.URL.Query().Get("start"), 64)
+		end, _ = strconv.ParseFloat(r.URL.Query().Get("end"), 64)
+		fmt.Fprint(w, `{"status":"success","data":{"resultType":"matrix","result":[
+			{"metric":{"destination_ip":"1.2.3.4"},"values":[[1,"4"],[2,"1"],[3,"NaN"],[4,"10"],[5,"2"],[6,"3"]]}]}}`)
+	}))
+	defer server.Close()
+
+	p := NewPrometheusExporter(server.URL, time.Minute, conf.DefaultMetricConf(), http.DefaultClient)
+	p.queries = []*promQuery{
+		{metric: constant.TPS, query: "tps", entityType: constant.ApplicationType, uidLabel: "destination_ip",
+			aggregation: &conf.AggregationConf{Used: "p50", Peak: conf.AggregationMax}},
+	}
+
+	metrics, err := p.Query(context.Background())
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+
+	expected := map[string]float64{constant.TPS: 3, constant.TPS + constant.PeakSuffix: 10}
+	if len(metrics) != 1 || !reflect.DeepEqual(metrics[0].Metrics, expected) {
+		t.Errorf("Query() = %+v, want metrics %v", metrics, expected)
+	}
+
+	// The window defaults to the one of the exporter
+	if window := end - start; window < 59.9 || window > 60.1 {
+		t.Errorf("Queried the range of %vs, want 60s", window)
+	}
+}
+
+func TestPrometheusExporter_Query_Histogram(t *testing.T) {
+	server := newPromServer(map[string]string{
+		`increase(latency_seconds_bucket{job="api"}[60000ms])`: `{"status":"success","data":{"resultType":"vector","result":[
+			{"metric":{"destination_ip":"1.2.3.4","le":"0.1"},"value":[1,"10"]},
+			{"metric":{"destination_ip":"1.2.3.4","le":"0.5"},"value":[1,"30"]},
+			{"metric":{"destination_ip":"1.2.3.4","le":"+Inf"},"value":[1,"40"]}]}}`,
+	})
+	defer server.Close()
+
+	p := NewPrometheusExporter(server.URL, time.Minute, conf.DefaultMetricConf(), http.DefaultClient)
+	p.queries = nil
+	rule, err := newHistogramRule(&conf.HistogramConf{Metric: "latency_seconds", Matchers: `{job="api"}`, Percentile: "p50"})
+	if err != nil {
+		t.Fatalf("newHistogramRule() error = %v", err)
+	}
+	rule.metric, rule.entityType, rule.uidLabel = constant.Latency, constant.ApplicationType, "destination_ip"
+	p.histograms = []*histogramRule{rule}
+
+	metrics, err := p.Query(context.Background())
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+
+	if len(metrics) != 1 || math.Abs(metrics[0].Metrics[constant.Latency]-0.3) > 1e-9 {
+		t.Errorf("Query() = %+v, want %s 0.3", metrics, constant.Latency)
+	}
+}
+
+func TestPrometheusExporter_Query_Units(t *testing.T) {
+	var lookups int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case queryAPIPath:
+			fmt.Fprintf(w, vectorResult, "0.2")
+		case metadataAPIPath:
+			atomic.AddInt32(&lookups, 1)
+			fmt.Fprintf(w, `{"status":"success","data":{"%s":[{"type":"gauge","help":"","unit":"seconds"}]}}`,
+				r.URL.Query().Get("metric"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	metricConf := conf.DefaultMetricConf()
+	latency := metricConf.Entities[0].Commodities[1]
+	latency.Query = `latency_seconds{code="200"}`
+	latency.Unit = ""
+
+	p := NewPrometheusExporter(server.URL, time.Minute, metricConf, http.DefaultClient)
+
+	for i := 0; i < 2; i++ {
+		metrics, err := p.Query(context.Background())
+		if err != nil {
+			t.Fatalf("Query() error = %v", err)
+		}
+
+		expected := map[string]string{constant.Latency: "seconds"}
+		if len(metrics) != 1 || !reflect.DeepEqual(metrics[0].Units, expected) {
+			t.Errorf("Query() = %+v, want units %v", metrics, expected)
+		}
+	}
+
+	// The metadata is looked up once
+	if lookups != 1 {
+		t.Errorf("Looked up the metadata %d times, want once", lookups)
+	}
+}
+
+func TestPrometheusExporter_Query_Units_NotScrapedYet(t *testing.T) {
+	var lookups int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case queryAPIPath:
+			fmt.Fprintf(w, vectorResult, "0.2")
+		case metadataAPIPath:
+			// The metric has no metadata until the second lookup
+			if atomic.AddInt32(&lookups, 1) == 1 {
+				fmt.Fprint(w, `{"status":"success","data":{}}`)
+				return
+			}
+			fmt.Fprintf(w, `{"status":"success","data":{"%s":[{"type":"gauge","help":"","unit":"seconds"}]}}`,
+				r.URL.Query().Get("metric"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	metricConf := conf.DefaultMetricConf()
+	latency := metricConf.Entities[0].Commodities[1]
+	latency.Query = `latency_seconds{code="200"}`
+	latency.Unit = ""
+
+	p := NewPrometheusExporter(server.URL, time.Minute, metricConf, http.DefaultClient)
+
+	expected := []map[string]string{nil, {constant.Latency: "seconds"}, {constant.Latency: "seconds"}}
+	for i, units := range expected {
+		metrics, err := p.Query(context.Background())
+		if err != nil {
+			t.Fatalf("Query() error = %v", err)
+		}
+
+		if len(metrics) != 1 || !reflect.DeepEqual(metrics[0].Units, units) {
+			t.Errorf("Query() #%d = %+v, want units %v", i, metrics, units)
+		}
+	}
+
+	// The metadata is looked up again until the unit is found
+	if lookups != 2 {
+		t.Errorf("Looked up the metadata %d times, want twice", lookups)
+	}
+}
+
+func TestPrometheusExporter_Query_CallGraph(t *testing.T) {
+	callResult := `{"status":"success","data":{"resultType":"vector","result":[
+		{"metric":{"source_workload":"frontend","destination_workload":"checkout"},"value":[1435781451.781,"%s"]},
+		{"metric":{"source_workload":"unknown","destination_workload":"checkout"},"value":[1435781451.781,"1"]},
+		{"metric":{"source_workload":"checkout","destination_workload":"checkout"},"value":[1435781451.781,"1"]}]}}`
+	server := newPromServer(map[string]string{
+		"tps":          fmt.Sprintf(vectorResult, "10"),
+		"calls":        fmt.Sprintf(callResult, "4"),
+		"call_latency": fmt.Sprintf(callResult, "25"),
+	})
+	defer server.Close()
+
+	metricConf := conf.DefaultMetricConf()
+	metricConf.CallGraph = &conf.CallGraphConf{
+		Query:            "calls",
+		LatencyQuery:     "call_latency",
+		SourceLabel:      "source_workload",
+		DestinationLabel: "destination_workload",
+	}
+	p := NewPrometheusExporter(server.URL, time.Minute, metricConf, http.DefaultClient)
+	p.queries = []*promQuery{
+		{metric: constant.TPS, query: "tps", entityType: constant.ApplicationType, uidLabel: "destination_ip"},
+	}
+
+	metrics, err := p.Query(context.Background())
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+
+	// The caller without metrics of its own is reported for its calls
+	expected := []*EntityMetric{
+		{
+			UID:     "1.2.3.4",
+			Type:    constant.ApplicationType,
+			Labels:  map[string]string{"destination_ip": "1.2.3.4"},
+			Metrics: map[string]float64{constant.TPS: 10},
+		},
+		{
+			UID:     "frontend",
+			Type:    constant.ApplicationType,
+			Metrics: map[string]float64{},
+			Calls: map[string]map[string]float64{
+				"checkout": {constant.TPS: 4, constant.Latency: 25},
+			},
+		},
+	}
+
+	if !reflect.DeepEqual(metrics, expected) {
+		t.Errorf("Query() = %+v, want %+v", metrics, expected)
+	}
+}
+
+func TestPromData_Series_Scalar(t *testing.T) {
+	var pr promResponse
+	if err := json.Unmarshal([]byte(fmt.Sprintf(scalarResult, "+Inf")), &pr); err != nil {
+		t.Fatalf("Failed to decode the scalar result: %v", err)
+	}
+
+	series, err := pr.Data.series()
+	if err != nil {
+		t.Fatalf("series() error = %v", err)
+	}
+
+	if len(series) != 1 || len(series[0].Metric) != 0 {
+		t.Fatalf("Expected one series without labels but got %v", series)
+	}
+
+	if _, ok := series[0].lastValue(); ok {
+		t.Errorf("Expected the infinite value to be invalid")
+	}
+}
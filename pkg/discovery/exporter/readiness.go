@@ -0,0 +1,75 @@
+package exporter
+
+import (
+	"context"
+	"github.com/golang/glog"
+	"sync"
+	"time"
+)
+
+// The timeout of a single readiness check
+const readinessCheckTimeout = 5 * time.Second
+
+// ReadinessChecker is a MetricExporter able to tell whether it is ready to serve the queries.
+// The exporters not implementing it are considered ready.
+type ReadinessChecker interface {
+	MetricExporter
+	Ready(ctx context.Context) error
+}
+
+// WaitUntilReady polls the exporters at the interval until all of them are ready or the context is done,
+// and returns the exporters which are not ready
+func WaitUntilReady(ctx context.Context, exporters []MetricExporter, interval time.Duration) []MetricExporter {
+	notReady := exporters
+	for {
+		notReady = checkReady(ctx, notReady)
+		if len(notReady) == 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return notReady
+		case <-timer.C:
+		}
+	}
+}
+
+// checkReady checks the exporters concurrently and returns the ones which are not ready
+func checkReady(ctx context.Context, exporters []MetricExporter) []MetricExporter {
+	ready := make([]bool, len(exporters))
+
+	var wg sync.WaitGroup
+	for i, exporter := range exporters {
+		checker, ok := exporter.(ReadinessChecker)
+		if !ok {
+			ready[i] = true
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, checker ReadinessChecker) {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, readinessCheckTimeout)
+			defer cancel()
+			if err := checker.Ready(checkCtx); err != nil {
+				glog.V(2).Infof("Metric exporter %v is not ready: %v", checker, err)
+				return
+			}
+			ready[i] = true
+		}(i, checker)
+	}
+	wg.Wait()
+
+	var notReady []MetricExporter
+	for i, exporter := range exporters {
+		if ready[i] {
+			glog.Infof("Metric exporter %v is ready", exporter)
+			continue
+		}
+		notReady = append(notReady, exporter)
+	}
+	return notReady
+}
@@ -0,0 +1,52 @@
+package exporter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/turbonomic/prometurbo/pkg/conf"
+)
+
+func TestWaitUntilReady(t *testing.T) {
+	var checks int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ready/-/ready":
+			w.WriteHeader(http.StatusOK)
+		case "/later/-/ready":
+			// Ready on the third check
+			if atomic.AddInt32(&checks, 1) < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		case "/remote/-/ready":
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	metricConf := conf.DefaultMetricConf()
+	ready := NewPrometheusExporter(server.URL+"/ready", time.Minute, metricConf, http.DefaultClient)
+	later := NewPrometheusExporter(server.URL+"/later", time.Minute, metricConf, http.DefaultClient)
+	remote := NewRemoteReadExporter(server.URL+"/remote/api/v1/read", time.Minute, metricConf, http.DefaultClient)
+	never := NewScrapeExporter(server.URL+"/never", metricConf, http.DefaultClient)
+	receiver := NewRemoteWriteReceiver(":0", time.Minute, metricConf)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	notReady := WaitUntilReady(ctx, []MetricExporter{ready, later, remote, never, receiver}, 10*time.Millisecond)
+
+	if len(notReady) != 1 || notReady[0] != never {
+		t.Errorf("WaitUntilReady() = %v, want [%v]", notReady, never)
+	}
+
+	if checks < 3 {
+		t.Errorf("Expected at least 3 checks of %v but got %d", later, checks)
+	}
+}
@@ -0,0 +1,413 @@
+package exporter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/turbonomic/prometurbo/pkg/conf"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	remoteReadVersion = "0.1.0"
+	remoteReadPath    = "/api/v1/read"
+
+	// The content type of the streamed response of chunks
+	chunkedReadContentType = "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse"
+
+	// The max size of a frame of the streamed response, which is the default of the Prometheus server
+	maxChunkedFrameSize = 50 * 1024 * 1024
+)
+
+var (
+	castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+	defaultAggregation = conf.DefaultAggregation()
+	// The aggregation of the capacities, which are the latest values
+	latestAggregation = &conf.AggregationConf{Used: conf.AggregationLast}
+)
+
+// remoteReadExporter retrieves the samples over a time window with the Prometheus remote read protocol,
+// and reports the values aggregated over the window for each metric, which are the average and the peak
+// values unless another aggregation is configured. The window defaults to the discovery interval.
+// The query of each commodity in the metric config must be a series selector, e.g., job:http_requests:rate1m.
+// The percentiles of the histograms are computed from the increase of the buckets over the window.
+type remoteReadExporter struct {
+	endpoint   string
+	window     time.Duration
+	rules      []*scrapeRule
+	histograms []*histogramRule
+	rates      *counterRates
+	client     *http.Client
+}
+
+func NewRemoteReadExporter(endpoint string, window time.Duration, metricConf *conf.MetricConf,
+	client *http.Client) *remoteReadExporter {
+	return &remoteReadExporter{
+		endpoint:   endpoint,
+		window:     window,
+		rules:      newScrapeRules(metricConf),
+		histograms: newHistogramRules(metricConf),
+		rates:      newCounterRates(),
+		client:     client,
+	}
+}
+
+func (r *remoteReadExporter) String() string {
+	return r.endpoint
+}
+
+// Ready checks the readiness endpoint of the Prometheus server serving the remote read endpoint
+func (r *remoteReadExporter) Ready(ctx context.Context) error {
+	u, err := url.Parse(r.endpoint)
+	if err != nil {
+		return err
+	}
+	u.Path = strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), remoteReadPath) + readyPath
+	u.RawQuery = ""
+
+	_, err = sendRequest(ctx, r.client, u.String())
+	return err
+}
+
+func (r *remoteReadExporter) Query(ctx context.Context) ([]*EntityMetric, error) {
+	end := time.Now()
+
+	req := &prompb.ReadRequest{
+		AcceptedResponseTypes: []prompb.ReadRequest_ResponseType{
+			prompb.ReadRequest_STREAMED_XOR_CHUNKS,
+			prompb.ReadRequest_SAMPLES,
+		},
+	}
+	for _, rule := range r.rules {
+		start := end.Add(-r.aggregation(rule).WindowOr(r.window))
+		req.Queries = append(req.Queries, newRemoteReadQuery(rule.selector, start, end))
+	}
+	for _, rule := range r.histograms {
+		start := end.Add(-rule.histogram.WindowOr(r.window))
+		for _, selector := range rule.selectors() {
+			req.Queries = append(req.Queries, newRemoteReadQuery(selector, start, end))
+		}
+	}
+
+	// The samples of the series returned for each query
+	results := make([]map[string]*seriesSamples, len(req.Queries))
+	for i := range results {
+		results[i] = make(map[string]*seriesSamples)
+	}
+
+	if err := r.read(ctx, req, results); err != nil {
+		glog.Errorf("Failed to read from %s: %v", r.endpoint, err)
+		return nil, err
+	}
+
+	metricSet := newEntityMetricSet()
+	for i, rule := range r.rules {
+		for _, samples := range results[i] {
+			uid, ok := samples.labels[rule.uidLabel]
+			if !ok || uid == "" {
+				glog.V(3).Infof("Skipping series %v matched by %s: missing label %s",
+					samples.labels, rule.selector, rule.uidLabel)
+				continue
+			}
+
+			if rule.counter {
+				if len(samples.values) > 0 {
+					metricSet.addCounter(r.rates, rule.entityType, uid, rule.metric,
+						samples.values[len(samples.values)-1], samples.labels, end, end)
+				}
+				continue
+			}
+
+			metricSet.addAggregated(rule.entityType, uid, rule.metric, samples.values, r.aggregation(rule),
+				samples.labels)
+		}
+	}
+	r.rates.forgetBefore(end)
+
+	next := len(r.rules)
+	for _, rule := range r.histograms {
+		// The quantiles of a summary are already computed over a sliding window by the clients
+		samples := toWindowSamples(results[next], !rule.histogram.IsSummary())
+		next++
+
+		var counts []*histogramSample
+		if rule.countSelector != nil {
+			counts = toWindowSamples(results[next], true)
+			next++
+		}
+
+		metricSet.addHistogram(rule, samples, counts)
+	}
+
+	return metricSet.list(), nil
+}
+
+// toWindowSamples converts the samples of the series over the window into the increase of the counters,
+// or the latest values otherwise. The series without any valid sample are skipped.
+func toWindowSamples(series map[string]*seriesSamples, counter bool) []*histogramSample {
+	var keys []string
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var samples []*histogramSample
+	for _, key := range keys {
+		s := series[key]
+		if len(s.values) == 0 {
+			continue
+		}
+		value := s.values[len(s.values)-1]
+		if counter {
+			value = counterIncrease(s.values)
+		}
+		samples = append(samples, &histogramSample{labels: s.labels, value: value})
+	}
+	return samples
+}
+
+// aggregation returns the aggregation of the rule, which is the average and the peak values by default,
+// or the latest value of a capacity
+func (r *remoteReadExporter) aggregation(rule *scrapeRule) *conf.AggregationConf {
+	if rule.aggregation != nil {
+		return rule.aggregation
+	}
+	if rule.capacity {
+		return latestAggregation
+	}
+	return defaultAggregation
+}
+
+// read sends the request and collects the samples of the series returned for each query
+func (r *remoteReadExporter) read(ctx context.Context, readReq *prompb.ReadRequest, results []map[string]*seriesSamples) error {
+	data, err := readReq.Marshal()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, r.endpoint, bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Encoding", "snappy")
+	req.Header.Add("Accept-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Read-Version", remoteReadVersion)
+
+	glog.V(2).Infof("Sending remote read request to %s", r.endpoint)
+	resp, err := r.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("remote read failed with status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/x-streamed-protobuf") {
+		if resp.Header.Get("Content-Type") != chunkedReadContentType {
+			return fmt.Errorf("unsupported streamed response type %s", resp.Header.Get("Content-Type"))
+		}
+		return readChunkedResponse(bufio.NewReader(resp.Body), func(res *prompb.ChunkedReadResponse) error {
+			if res.QueryIndex < 0 || int(res.QueryIndex) >= len(results) {
+				return fmt.Errorf("invalid query index %d in the response", res.QueryIndex)
+			}
+			query := readReq.Queries[res.QueryIndex]
+			for _, series := range res.ChunkedSeries {
+				samples := getSeriesSamples(results[res.QueryIndex], series.Labels)
+				if err := samples.addChunks(series.Chunks, query.StartTimestampMs, query.EndTimestampMs); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	compressed, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	uncompressed, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return fmt.Errorf("failed to decompress the response: %v", err)
+	}
+
+	var readResp prompb.ReadResponse
+	if err := readResp.Unmarshal(uncompressed); err != nil {
+		return fmt.Errorf("failed to decode the response: %v", err)
+	}
+
+	if len(readResp.Results) != len(results) {
+		return fmt.Errorf("got %d results for %d queries", len(readResp.Results), len(results))
+	}
+
+	for i, result := range readResp.Results {
+		for _, series := range result.Timeseries {
+			samples := getSeriesSamples(results[i], series.Labels)
+			for _, s := range series.Samples {
+				samples.add(s.Value)
+			}
+		}
+	}
+
+	return nil
+}
+
+// readChunkedResponse reads the frames of a streamed response until EOF. Each frame consists of
+// the uvarint size of the data, the CRC32 (Castagnoli) checksum of the data in big endian
+// and the data, which is a marshaled ChunkedReadResponse.
+func readChunkedResponse(r *bufio.Reader, handle func(*prompb.ChunkedReadResponse) error) error {
+	for {
+		size, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read the frame size: %v", err)
+		}
+
+		if size > maxChunkedFrameSize {
+			return fmt.Errorf("frame size %d exceeds the limit %d", size, maxChunkedFrameSize)
+		}
+
+		var checksum [4]byte
+		if _, err := io.ReadFull(r, checksum[:]); err != nil {
+			return fmt.Errorf("failed to read the frame checksum: %v", err)
+		}
+
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return fmt.Errorf("failed to read the frame: %v", err)
+		}
+
+		if crc32.Checksum(data, castagnoliTable) != binary.BigEndian.Uint32(checksum[:]) {
+			return fmt.Errorf("frame checksum mismatch")
+		}
+
+		var res prompb.ChunkedReadResponse
+		if err := res.Unmarshal(data); err != nil {
+			return fmt.Errorf("failed to decode the frame: %v", err)
+		}
+
+		if err := handle(&res); err != nil {
+			return err
+		}
+	}
+}
+
+func newRemoteReadQuery(selector *seriesSelector, start, end time.Time) *prompb.Query {
+	query := &prompb.Query{
+		StartTimestampMs: toMillis(start),
+		EndTimestampMs:   toMillis(end),
+	}
+
+	for _, m := range selector.matchers {
+		var matchType prompb.LabelMatcher_Type
+		switch m.op {
+		case matchEqual:
+			matchType = prompb.LabelMatcher_EQ
+		case matchNotEqual:
+			matchType = prompb.LabelMatcher_NEQ
+		case matchRegexp:
+			matchType = prompb.LabelMatcher_RE
+		case matchNotRegexp:
+			matchType = prompb.LabelMatcher_NRE
+		}
+		query.Matchers = append(query.Matchers, &prompb.LabelMatcher{
+			Type:  matchType,
+			Name:  m.name,
+			Value: m.value,
+		})
+	}
+
+	return query
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// seriesSamples is the valid values of the samples of a series in time order
+type seriesSamples struct {
+	labels map[string]string
+	values []float64
+}
+
+// getSeriesSamples returns the samples of the series with the given labels, creating it if not found
+func getSeriesSamples(samples map[string]*seriesSamples, labels []prompb.Label) *seriesSamples {
+	key := labelsKey(labels)
+	s, ok := samples[key]
+	if !ok {
+		s = &seriesSamples{
+			labels: make(map[string]string, len(labels)),
+		}
+		for _, l := range labels {
+			s.labels[l.Name] = l.Value
+		}
+		samples[key] = s
+	}
+	return s
+}
+
+func labelsKey(labels []prompb.Label) string {
+	var b bytes.Buffer
+	for _, l := range labels {
+		b.WriteString(l.Name)
+		b.WriteByte(0)
+		b.WriteString(l.Value)
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+func (s *seriesSamples) add(value float64) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+	s.values = append(s.values, value)
+}
+
+// addChunks adds the samples within [start, end] of the XOR encoded chunks
+func (s *seriesSamples) addChunks(chunks []prompb.Chunk, start, end int64) error {
+	for _, c := range chunks {
+		if c.Type != prompb.Chunk_XOR {
+			return fmt.Errorf("unsupported chunk encoding %s", c.Type)
+		}
+
+		chunk, err := chunkenc.FromData(chunkenc.EncXOR, c.Data)
+		if err != nil {
+			return fmt.Errorf("failed to decode the chunk: %v", err)
+		}
+
+		it := chunk.Iterator(nil)
+		for it.Next() {
+			t, v := it.At()
+			if t < start || t > end {
+				continue
+			}
+			s.add(v)
+		}
+		if err := it.Err(); err != nil {
+			return fmt.Errorf("failed to iterate the chunk: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package exporter
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/turbonomic/prometurbo/pkg/conf"
+	"github.com/turbonomic/prometurbo/pkg/discovery/constant"
+)
+
+// newRemoteReadServer serves the canned series for each query, either as samples or as streamed chunks
+func newRemoteReadServer(t *testing.T, streamed bool, series [][]*prompb.TimeSeries) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		compressed, _ := ioutil.ReadAll(r.Body)
+		data, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Errorf("Failed to decompress the request: %v", err)
+			return
+		}
+
+		var req prompb.ReadRequest
+		if err := req.Unmarshal(data); err != nil {
+			t.Errorf("Failed to decode the request: %v", err)
+			return
+		}
+
+		if len(req.Queries) != len(series) {
+			t.Errorf("Expected %d queries but got %d", len(series), len(req.Queries))
+			return
+		}
+
+		if !streamed {
+			resp := &prompb.ReadResponse{}
+			for _, ts := range series {
+				resp.Results = append(resp.Results, &prompb.QueryResult{Timeseries: ts})
+			}
+			data, _ := resp.Marshal()
+			w.Header().Set("Content-Type", "application/x-protobuf")
+			w.Write(snappy.Encode(nil, data))
+			return
+		}
+
+		w.Header().Set("Content-Type", chunkedReadContentType)
+		for i, ts := range series {
+			for _, s := range ts {
+				chunk := chunkenc.NewXORChunk()
+				app, _ := chunk.Appender()
+				for _, sample := range s.Samples {
+					app.Append(sample.Timestamp, sample.Value)
+				}
+				resp := &prompb.ChunkedReadResponse{
+					QueryIndex: int64(i),
+					ChunkedSeries: []*prompb.ChunkedSeries{{
+						Labels: s.Labels,
+						Chunks: []prompb.Chunk{{Type: prompb.Chunk_XOR, Data: chunk.Bytes()}},
+					}},
+				}
+				data, _ := resp.Marshal()
+				var header [binary.MaxVarintLen64 + 4]byte
+				n := binary.PutUvarint(header[:], uint64(len(data)))
+				binary.BigEndian.PutUint32(header[n:], crc32.Checksum(data, castagnoliTable))
+				w.Write(header[:n+4])
+				w.Write(data)
+			}
+		}
+	}))
+}
+
+func newTimeSeries(ip string, values ...float64) *prompb.TimeSeries {
+	ts := &prompb.TimeSeries{
+		Labels: []prompb.Label{{Name: "destination_ip", Value: ip}},
+	}
+	now := toMillis(time.Now())
+	for i, v := range values {
+		ts.Samples = append(ts.Samples, prompb.Sample{
+			Timestamp: now - int64(len(values)-i)*1000,
+			Value:     v,
+		})
+	}
+	return ts
+}
+
+func testRemoteReadExporter(t *testing.T, streamed bool) {
+	server := newRemoteReadServer(t, streamed, [][]*prompb.TimeSeries{
+		{newTimeSeries("1.2.3.4", 10, 20, 30), newTimeSeries("5.6.7.8", 5)},
+		{newTimeSeries("1.2.3.4", 100, 300)},
+	})
+	defer server.Close()
+
+	metricConf := conf.DefaultMetricConf()
+	metricConf.Entities[0].Commodities[0].Query = "app:tps:rate1m"
+	metricConf.Entities[0].Commodities[1].Query = `app:latency:rate1m{job!=""}`
+
+	r := NewRemoteReadExporter(server.URL, time.Minute, metricConf, http.DefaultClient)
+
+	metrics, err := r.Query(context.Background())
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+
+	expected := map[string]map[string]float64{
+		"1.2.3.4": {
+			constant.TPS:                           20,
+			constant.TPS + constant.PeakSuffix:     30,
+			constant.Latency:                       200,
+			constant.Latency + constant.PeakSuffix: 300,
+		},
+		"5.6.7.8": {
+			constant.TPS:                       5,
+			constant.TPS + constant.PeakSuffix: 5,
+		},
+	}
+	if len(metrics) != len(expected) {
+		t.Fatalf("Expected %d entities but got %d", len(expected), len(metrics))
+	}
+	for _, m := range metrics {
+		if !reflect.DeepEqual(m.Metrics, expected[m.UID]) {
+			t.Errorf("Expected metrics %v of %s but got %v", expected[m.UID], m.UID, m.Metrics)
+		}
+	}
+}
+
+func TestRemoteReadExporter_Query_Samples(t *testing.T) {
+	testRemoteReadExporter(t, false)
+}
+
+func TestRemoteReadExporter_Query_StreamedChunks(t *testing.T) {
+	testRemoteReadExporter(t, true)
+}
+
+func TestRemoteReadExporter_Query_Failed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", chunkedReadContentType)
+		// A frame with a wrong checksum
+		w.Write([]byte{3, 0, 0, 0, 0, 1, 2, 3})
+	}))
+	defer server.Close()
+
+	metricConf := conf.DefaultMetricConf()
+	metricConf.Entities[0].Commodities[0].Query = "app:tps:rate1m"
+	metricConf.Entities[0].Commodities[1].Query = "app:latency:rate1m"
+
+	if _, err := NewRemoteReadExporter(server.URL, time.Minute, metricConf, http.DefaultClient).Query(context.Background()); err == nil {
+		t.Errorf("Expected an error from a corrupted frame")
+	}
+}
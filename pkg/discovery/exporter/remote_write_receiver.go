@@ -0,0 +1,279 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/turbonomic/prometurbo/pkg/conf"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	RemoteWritePath = "/api/v1/write"
+
+	// The max size of a compressed write request
+	maxWriteRequestSize = 32 * 1024 * 1024
+
+	// The bits of the NaN value marking a series as stale in Prometheus
+	staleNaNBits = 0x7ff0000000000002
+)
+
+// MetricReceiver is a MetricExporter receiving the metrics pushed to it, which serves after Start()
+type MetricReceiver interface {
+	MetricExporter
+	Start() error
+}
+
+// remoteWriteReceiver receives the samples that Prometheus sends with the remote write protocol,
+// and keeps the latest sample of each series matched by the series selectors in the metric config.
+// The series which are not updated within the retention are dropped.
+type remoteWriteReceiver struct {
+	address    string
+	retention  time.Duration
+	rules      []*scrapeRule
+	histograms []*histogramRule
+	rates      *counterRates
+
+	lock   sync.Mutex
+	series map[string]*receivedSeries
+}
+
+// receivedSeries is the latest sample of a series
+type receivedSeries struct {
+	labels     map[string]string
+	value      float64
+	timestamp  int64
+	receivedAt time.Time
+}
+
+func NewRemoteWriteReceiver(address string, retention time.Duration, metricConf *conf.MetricConf) *remoteWriteReceiver {
+	rules := newScrapeRules(metricConf)
+	warnAggregationIgnored(rules, address+RemoteWritePath)
+	histograms := newHistogramRules(metricConf)
+	warnHistogramWindowIgnored(histograms, address+RemoteWritePath)
+
+	return &remoteWriteReceiver{
+		address:    address,
+		retention:  retention,
+		rules:      rules,
+		histograms: histograms,
+		rates:      newCounterRates(),
+		series:     make(map[string]*receivedSeries),
+	}
+}
+
+func (r *remoteWriteReceiver) String() string {
+	return r.address + RemoteWritePath
+}
+
+// Start listens on the address and serves the remote write requests in the background
+func (r *remoteWriteReceiver) Start() error {
+	listener, err := net.Listen("tcp", r.address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", r.address, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(RemoteWritePath, r)
+
+	glog.V(2).Infof("Receiving remote write requests at %s", r)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			glog.Errorf("Remote write receiver at %s stopped: %v", r, err)
+		}
+	}()
+
+	return nil
+}
+
+func (r *remoteWriteReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	compressed, err := ioutil.ReadAll(io.LimitReader(req.Body, maxWriteRequestSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(compressed) > maxWriteRequestSize {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		glog.V(3).Infof("Failed to decompress the remote write request: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var writeReq prompb.WriteRequest
+	if err := writeReq.Unmarshal(data); err != nil {
+		glog.V(3).Infof("Failed to decode the remote write request: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.store(writeReq.Timeseries, time.Now())
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// store keeps the latest sample of each series matched by any rule
+func (r *remoteWriteReceiver) store(timeseries []prompb.TimeSeries, now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for i := range timeseries {
+		ts := &timeseries[i]
+		if len(ts.Samples) == 0 {
+			continue
+		}
+
+		key := labelsKey(ts.Labels)
+		existing, found := r.series[key]
+
+		var labels map[string]string
+		if found {
+			labels = existing.labels
+		} else {
+			labels = make(map[string]string, len(ts.Labels))
+			for _, l := range ts.Labels {
+				labels[l.Name] = l.Value
+			}
+			if !r.matches(labels) {
+				continue
+			}
+		}
+
+		latest := ts.Samples[0]
+		for _, s := range ts.Samples[1:] {
+			if s.Timestamp >= latest.Timestamp {
+				latest = s
+			}
+		}
+
+		if found && latest.Timestamp < existing.timestamp {
+			continue
+		}
+
+		if math.Float64bits(latest.Value) == staleNaNBits {
+			delete(r.series, key)
+			continue
+		}
+
+		r.series[key] = &receivedSeries{
+			labels:     labels,
+			value:      latest.Value,
+			timestamp:  latest.Timestamp,
+			receivedAt: now,
+		}
+	}
+}
+
+func (r *remoteWriteReceiver) matches(labels map[string]string) bool {
+	for _, rule := range r.rules {
+		if rule.selector.matches(labels) {
+			return true
+		}
+	}
+	for _, rule := range r.histograms {
+		for _, selector := range rule.selectors() {
+			if selector.matches(labels) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// snapshot drops the expired series and returns the remaining ones sorted by labels
+func (r *remoteWriteReceiver) snapshot(now time.Time) []*receivedSeries {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	keys := make([]string, 0, len(r.series))
+	for key, s := range r.series {
+		if now.Sub(s.receivedAt) > r.retention {
+			delete(r.series, key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	series := make([]*receivedSeries, len(keys))
+	for i, key := range keys {
+		series[i] = r.series[key]
+	}
+	return series
+}
+
+func (r *remoteWriteReceiver) Query(ctx context.Context) ([]*EntityMetric, error) {
+	now := time.Now()
+	series := r.snapshot(now)
+
+	glog.V(4).Infof("%d series received at %s", len(series), r)
+
+	metricSet := newEntityMetricSet()
+	for _, rule := range r.rules {
+		for _, s := range series {
+			if !rule.selector.matches(s.labels) {
+				continue
+			}
+
+			uid, ok := s.labels[rule.uidLabel]
+			if !ok || uid == "" {
+				glog.V(3).Infof("Skipping series %v matched by %s: missing label %s",
+					s.labels, rule.selector, rule.uidLabel)
+				continue
+			}
+
+			if math.IsNaN(s.value) || math.IsInf(s.value, 0) {
+				glog.V(3).Infof("Skipping series %v matched by %s: no valid value", s.labels, rule.selector)
+				continue
+			}
+
+			if rule.counter {
+				timestamp := time.Unix(0, s.timestamp*int64(time.Millisecond))
+				metricSet.addCounter(r.rates, rule.entityType, uid, rule.metric, s.value, s.labels, timestamp, now)
+				continue
+			}
+
+			metricSet.add(rule.entityType, uid, rule.metric, s.value, s.labels)
+		}
+	}
+	r.rates.forgetBefore(now)
+
+	for _, rule := range r.histograms {
+		metricSet.addHistogram(rule, receivedSamples(series, rule.selector), receivedSamples(series, rule.countSelector))
+	}
+
+	return metricSet.list(), nil
+}
+
+// receivedSamples returns the latest samples of the series matched by the selector, if any
+func receivedSamples(series []*receivedSeries, selector *seriesSelector) []*histogramSample {
+	if selector == nil {
+		return nil
+	}
+
+	var matched []*histogramSample
+	for _, s := range series {
+		if selector.matches(s.labels) {
+			matched = append(matched, &histogramSample{labels: s.labels, value: s.value})
+		}
+	}
+	return matched
+}
@@ -0,0 +1,103 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/turbonomic/prometurbo/pkg/conf"
+	"github.com/turbonomic/prometurbo/pkg/discovery/constant"
+)
+
+func newWriteSeries(name, ip string, timestamp int64, value float64) prompb.TimeSeries {
+	return prompb.TimeSeries{
+		Labels: []prompb.Label{
+			{Name: metricNameLabel, Value: name},
+			{Name: "destination_ip", Value: ip},
+		},
+		Samples: []prompb.Sample{{Timestamp: timestamp, Value: value}},
+	}
+}
+
+func sendWriteRequest(t *testing.T, url string, series ...prompb.TimeSeries) {
+	data, err := (&prompb.WriteRequest{Timeseries: series}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Post(url, "application/x-protobuf", bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected status %d but got %d", http.StatusNoContent, resp.StatusCode)
+	}
+}
+
+func TestRemoteWriteReceiver_Query(t *testing.T) {
+	metricConf := conf.DefaultMetricConf()
+	metricConf.Entities[0].Commodities[0].Query = "app:tps:rate1m"
+	metricConf.Entities[0].Commodities[1].Query = "app:latency:rate1m"
+
+	r := NewRemoteWriteReceiver(":0", time.Minute, metricConf)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	sendWriteRequest(t, server.URL,
+		newWriteSeries("app:tps:rate1m", "1.2.3.4", 1000, 10),
+		newWriteSeries("app:latency:rate1m", "1.2.3.4", 1000, 100),
+		newWriteSeries("app:tps:rate1m", "5.6.7.8", 1000, 5),
+		newWriteSeries("unrelated", "1.2.3.4", 1000, 1))
+
+	// The later sample replaces the earlier one, while an out-of-order sample is ignored
+	sendWriteRequest(t, server.URL,
+		newWriteSeries("app:tps:rate1m", "1.2.3.4", 2000, 20),
+		newWriteSeries("app:latency:rate1m", "1.2.3.4", 500, 50))
+
+	// A stale marker removes the series
+	sendWriteRequest(t, server.URL,
+		newWriteSeries("app:tps:rate1m", "5.6.7.8", 2000, math.Float64frombits(staleNaNBits)))
+
+	if len(r.series) != 2 {
+		t.Errorf("Expected 2 series kept but got %d", len(r.series))
+	}
+
+	metrics, err := r.Query(context.Background())
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+
+	expected := map[string]float64{constant.TPS: 20, constant.Latency: 100}
+	if len(metrics) != 1 || metrics[0].UID != "1.2.3.4" || !reflect.DeepEqual(metrics[0].Metrics, expected) {
+		t.Errorf("Expected metrics %v of 1.2.3.4 but got %+v", expected, metrics)
+	}
+
+	// The series are dropped after the retention
+	if series := r.snapshot(time.Now().Add(2 * time.Minute)); len(series) != 0 {
+		t.Errorf("Expected all series expired but got %d", len(series))
+	}
+}
+
+func TestRemoteWriteReceiver_BadRequest(t *testing.T) {
+	server := httptest.NewServer(NewRemoteWriteReceiver(":0", time.Minute, conf.DefaultMetricConf()))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL, "application/x-protobuf", bytes.NewReader([]byte("not snappy")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status %d but got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
@@ -0,0 +1,114 @@
+package exporter
+
+import (
+	"github.com/golang/glog"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The max delay between two attempts
+const maxRetryBackoff = 30 * time.Second
+
+// RetryPolicy decides how the requests failed with transient errors are retried
+type RetryPolicy struct {
+	// The max number of retries after the first attempt; no retry if 0
+	MaxRetries int
+	// The delay before the first retry, which doubles on each retry with jitter
+	Backoff time.Duration
+}
+
+// retryRoundTripper retries the requests failed with transient errors, i.e., the connection errors,
+// 429 and 5xx responses. It gives up if the next attempt would start after the deadline of the request context.
+type retryRoundTripper struct {
+	policy *RetryPolicy
+	rt     http.RoundTripper
+}
+
+func (r *retryRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+
+	for attempt := 0; ; attempt++ {
+		resp, err := r.rt.RoundTrip(req)
+		if attempt >= r.policy.MaxRetries || ctx.Err() != nil || !isTransient(resp, err) {
+			return resp, err
+		}
+
+		backoff := r.backoff(attempt, resp)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(backoff).After(deadline) {
+			glog.V(3).Infof("Not retrying %s: no time left before the deadline", req.URL)
+			return resp, err
+		}
+
+		// The body of the request has been consumed, so a new one is needed for the retry
+		if req.Body != nil {
+			if req.GetBody == nil {
+				return resp, err
+			}
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return resp, err
+			}
+			req = cloneRequest(req)
+			req.Body = body
+		}
+
+		if err != nil {
+			glog.V(2).Infof("Request to %s failed: %v; retrying in %v", req.URL, err, backoff)
+		} else {
+			glog.V(2).Infof("Request to %s failed with status %s; retrying in %v", req.URL, resp.Status, backoff)
+			// Drain the body so that the connection can be reused
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns the delay before the next attempt, which is the exponential backoff with equal jitter,
+// or the delay in the Retry-After header of the response if it is longer
+func (r *retryRoundTripper) backoff(attempt int, resp *http.Response) time.Duration {
+	backoff := r.policy.Backoff
+	for i := 0; i < attempt && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	if backoff > 0 {
+		backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	}
+
+	if resp != nil {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			if retryAfter := time.Duration(seconds) * time.Second; retryAfter > backoff {
+				backoff = retryAfter
+			}
+		}
+	}
+
+	return backoff
+}
+
+// isTransient checks if a request failed because of a transient error, which is worth retrying
+func isTransient(resp *http.Response, err error) bool {
+	if err != nil {
+		// The request is never sent if the connection fails, e.g., connection refused
+		opErr, ok := err.(*net.OpError)
+		return ok && opErr.Op == "dial"
+	}
+
+	return resp.StatusCode == http.StatusTooManyRequests ||
+		(resp.StatusCode >= http.StatusInternalServerError && resp.StatusCode != http.StatusNotImplemented)
+}
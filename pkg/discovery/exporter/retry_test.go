@@ -0,0 +1,119 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRetryRoundTripper_TransientErrors(t *testing.T) {
+	statuses := []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(statuses[len(bodies)-1])
+	}))
+	defer server.Close()
+
+	client, err := NewHTTPClient(nil, &RetryPolicy{MaxRetries: 3, Backoff: time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewHTTPClient() error = %v", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL, bytes.NewReader([]byte("query")))
+	if _, err := send(context.Background(), client, req); err != nil {
+		t.Fatalf("send() error = %v", err)
+	}
+
+	if len(bodies) != len(statuses) {
+		t.Fatalf("Got %d attempts, want %d", len(bodies), len(statuses))
+	}
+	for i, body := range bodies {
+		if body != "query" {
+			t.Errorf("Body of attempt %d = %q, want %q", i, body, "query")
+		}
+	}
+}
+
+func TestRetryRoundTripper_NotTransient(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	client, _ := NewHTTPClient(nil, &RetryPolicy{MaxRetries: 3, Backoff: time.Millisecond})
+	if _, err := sendRequest(context.Background(), client, server.URL); err == nil {
+		t.Errorf("sendRequest() expected an error")
+	}
+
+	if attempts != 1 {
+		t.Errorf("Got %d attempts, want 1", attempts)
+	}
+}
+
+func TestRetryRoundTripper_ConnectionRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := "http://" + listener.Addr().String()
+	listener.Close()
+
+	attempts := 0
+	rt := &retryRoundTripper{
+		policy: &RetryPolicy{MaxRetries: 2, Backoff: time.Millisecond},
+		rt: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			attempts++
+			return http.DefaultTransport.RoundTrip(req)
+		}),
+	}
+
+	if _, err := sendRequest(context.Background(), &http.Client{Transport: rt}, endpoint); err == nil {
+		t.Errorf("sendRequest() expected an error")
+	}
+
+	if attempts != 3 {
+		t.Errorf("Got %d attempts, want 3", attempts)
+	}
+}
+
+func TestRetryRoundTripper_Deadline(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	client, _ := NewHTTPClient(nil, &RetryPolicy{MaxRetries: 10, Backoff: time.Second})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := sendRequest(ctx, client, server.URL); err == nil {
+		t.Errorf("sendRequest() expected an error")
+	}
+
+	// The first retry would start after the deadline
+	if attempts != 1 {
+		t.Errorf("Got %d attempts, want 1", attempts)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("sendRequest() took %v, beyond the deadline", elapsed)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
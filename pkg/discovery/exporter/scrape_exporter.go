@@ -0,0 +1,204 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/turbonomic/prometurbo/pkg/conf"
+	"github.com/turbonomic/prometurbo/pkg/discovery/constant"
+	"math"
+	"net/http"
+	"time"
+)
+
+// The formats accepted when scraping, with OpenMetrics preferred over the Prometheus text format
+const scrapeAcceptHeader = "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5,*/*;q=0.1"
+
+// scrapeRule maps the series matched by a selector to a metric of a type of entities
+type scrapeRule struct {
+	// The metric name used as the key of EntityMetric.Metrics
+	metric     string
+	selector   *seriesSelector
+	entityType int32
+	// The label whose value becomes the EntityMetric.UID
+	uidLabel string
+	// The aggregation of the samples over a window, if the exporter collects the samples over time
+	aggregation *conf.AggregationConf
+	// The series are counters, whose rates since the previous discovery are reported
+	counter bool
+	// The series are the capacities of the metric, whose latest values are reported
+	capacity bool
+}
+
+// scrapeExporter scrapes an endpoint serving metrics in the Prometheus text exposition or the OpenMetrics format.
+// The query of each commodity in the metric config must be a series selector, e.g., http_requests{code="200"}.
+// The percentiles of the histograms are computed from the bucket counts since the start of the target.
+type scrapeExporter struct {
+	endpoint   string
+	rules      []*scrapeRule
+	histograms []*histogramRule
+	rates      *counterRates
+	client     *http.Client
+}
+
+func NewScrapeExporter(endpoint string, metricConf *conf.MetricConf, client *http.Client) *scrapeExporter {
+	rules := newScrapeRules(metricConf)
+	warnAggregationIgnored(rules, endpoint)
+	histograms := newHistogramRules(metricConf)
+	warnHistogramWindowIgnored(histograms, endpoint)
+
+	return &scrapeExporter{
+		endpoint:   endpoint,
+		rules:      rules,
+		histograms: histograms,
+		rates:      newCounterRates(),
+		client:     client,
+	}
+}
+
+// newScrapeRules creates the rules from the queries which are series selectors in the metric config,
+// followed by the rules of the capacity queries
+func newScrapeRules(metricConf *conf.MetricConf) []*scrapeRule {
+	var rules []*scrapeRule
+	for _, entity := range metricConf.Entities {
+		for _, comm := range entity.Commodities {
+			if comm.Query == "" {
+				continue
+			}
+			selector, err := parseSelector(comm.Query)
+			if err != nil {
+				glog.Warningf("Metric %s of %s cannot be scraped: %v", comm.Name, entity.Type, err)
+				continue
+			}
+			rules = append(rules, &scrapeRule{
+				metric:      comm.Name,
+				selector:    selector,
+				entityType:  int32(entity.EntityType()),
+				uidLabel:    entity.UIDLabel,
+				aggregation: comm.Aggregation,
+				counter:     comm.Counter,
+			})
+		}
+		for _, comm := range entity.Commodities {
+			if comm.CapacityQuery == "" {
+				continue
+			}
+			selector, err := parseSelector(comm.CapacityQuery)
+			if err != nil {
+				glog.Warningf("Capacity of metric %s of %s cannot be scraped: %v", comm.Name, entity.Type, err)
+				continue
+			}
+			rules = append(rules, &scrapeRule{
+				metric:     comm.Name + constant.CapacitySuffix,
+				selector:   selector,
+				entityType: int32(entity.EntityType()),
+				uidLabel:   entity.UIDLabel,
+				capacity:   true,
+			})
+		}
+	}
+	return rules
+}
+
+// warnAggregationIgnored warns about the aggregations requested to the exporters reporting the latest values only
+func warnAggregationIgnored(rules []*scrapeRule, exporter string) {
+	for _, rule := range rules {
+		if rule.aggregation != nil {
+			glog.Warningf("Aggregation of metric %s is ignored by %s, which reports the latest value", rule.metric, exporter)
+		}
+	}
+}
+
+// warnHistogramWindowIgnored warns about the histogram windows requested to the exporters without the history
+// of the bucket counts
+func warnHistogramWindowIgnored(rules []*histogramRule, exporter string) {
+	for _, rule := range rules {
+		if rule.histogram.Window != "" {
+			glog.Warningf("Histogram window of metric %s is ignored by %s, which reports the percentiles "+
+				"of the bucket counts since the start of the target", rule.metric, exporter)
+		}
+	}
+}
+
+// matchingSamples returns the samples of the series matched by the selector, if any
+func matchingSamples(samples []*scrapedSample, selector *seriesSelector) []*histogramSample {
+	if selector == nil {
+		return nil
+	}
+
+	var matched []*histogramSample
+	for _, sample := range samples {
+		if selector.matches(sample.labels) {
+			matched = append(matched, &histogramSample{labels: sample.labels, value: sample.value})
+		}
+	}
+	return matched
+}
+
+func (s *scrapeExporter) String() string {
+	return s.endpoint
+}
+
+// Ready checks if the endpoint serves the metrics
+func (s *scrapeExporter) Ready(ctx context.Context) error {
+	_, err := sendRequest(ctx, s.client, s.endpoint)
+	return err
+}
+
+func (s *scrapeExporter) Query(ctx context.Context) ([]*EntityMetric, error) {
+	req, err := http.NewRequest(http.MethodGet, s.endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", scrapeAcceptHeader)
+
+	resp, err := send(ctx, s.client, req)
+	if err != nil {
+		return nil, err
+	}
+
+	samples, err := parseMetricText(bytes.NewReader(resp))
+	if err != nil {
+		glog.Errorf("Failed to parse the metrics scraped from %s: %v", s.endpoint, err)
+		return nil, fmt.Errorf("failed to parse the metrics scraped from %s: %v", s.endpoint, err)
+	}
+
+	glog.V(4).Infof("Scraped %d samples from %s", len(samples), s.endpoint)
+
+	now := time.Now()
+	metricSet := newEntityMetricSet()
+	for _, rule := range s.rules {
+		for _, sample := range samples {
+			if !rule.selector.matches(sample.labels) {
+				continue
+			}
+
+			uid, ok := sample.labels[rule.uidLabel]
+			if !ok || uid == "" {
+				glog.V(3).Infof("Skipping series %v matched by %s: missing label %s",
+					sample.labels, rule.selector, rule.uidLabel)
+				continue
+			}
+
+			if math.IsNaN(sample.value) || math.IsInf(sample.value, 0) {
+				glog.V(3).Infof("Skipping series %v matched by %s: no valid value", sample.labels, rule.selector)
+				continue
+			}
+
+			if rule.counter {
+				metricSet.addCounter(s.rates, rule.entityType, uid, rule.metric, sample.value, sample.labels, now, now)
+				continue
+			}
+
+			metricSet.add(rule.entityType, uid, rule.metric, sample.value, sample.labels)
+		}
+	}
+	s.rates.forgetBefore(now)
+
+	for _, rule := range s.histograms {
+		metricSet.addHistogram(rule, matchingSamples(samples, rule.selector), matchingSamples(samples, rule.countSelector))
+	}
+
+	return metricSet.list(), nil
+}
@@ -0,0 +1,205 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/turbonomic/prometurbo/pkg/conf"
+	"github.com/turbonomic/prometurbo/pkg/discovery/constant"
+)
+
+const scrapedText = `# HELP http_requests_total The total number of HTTP requests.
+# TYPE http_requests_total counter
+http_requests_total{method="post",code="200",instance="1.2.3.4"} 1027 1395066363000
+http_requests_total{method="post",code="400",instance="1.2.3.4"}    3 1395066363000
+http_requests_total{method="get",code="200",instance="5.6.7.8"} 10
+
+# A histogram, which has a pretty complex representation in the text format:
+# HELP http_request_duration_seconds A histogram of the request duration.
+# TYPE http_request_duration_seconds histogram
+http_request_duration_seconds_bucket{le="0.05",instance="1.2.3.4"} 24054
+http_request_duration_seconds_bucket{le="+Inf",instance="1.2.3.4"} 144320
+http_request_duration_seconds_sum{instance="1.2.3.4"} 53423
+http_request_duration_seconds_count{instance="1.2.3.4"} 144320
+
+# HELP rpc_duration_seconds A summary of the RPC duration in seconds.
+# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{quantile="0.5",instance="1.2.3.4"} 4773
+rpc_duration_seconds{quantile="0.99",instance="1.2.3.4"} 76656
+rpc_duration_seconds_sum{instance="1.2.3.4"} 1.7560473e+07
+rpc_duration_seconds_count{instance="1.2.3.4"} 2693
+
+# TYPE queue_length gauge
+queue_length{instance="1.2.3.4",path="C:\\DIR\\",msg="say \"hi\"\n"} NaN
+# EOF
+`
+
+func TestParseMetricText(t *testing.T) {
+	samples, err := parseMetricText(strings.NewReader(scrapedText))
+	if err != nil {
+		t.Fatalf("parseMetricText() error = %v", err)
+	}
+
+	if len(samples) != 12 {
+		t.Fatalf("Expected 12 samples but got %d", len(samples))
+	}
+
+	expectedTypes := map[string]string{
+		"http_requests_total":                  metricTypeCounter,
+		"http_request_duration_seconds_bucket": metricTypeHistogram,
+		"http_request_duration_seconds_count":  metricTypeHistogram,
+		"rpc_duration_seconds":                 metricTypeSummary,
+		"rpc_duration_seconds_sum":             metricTypeSummary,
+		"queue_length":                         metricTypeGauge,
+	}
+	for _, s := range samples {
+		name := s.labels[metricNameLabel]
+		if expected, ok := expectedTypes[name]; ok && s.metricType != expected {
+			t.Errorf("Expected type %s of %s but got %s", expected, name, s.metricType)
+		}
+	}
+
+	last := samples[len(samples)-1]
+	expectedLabels := map[string]string{
+		metricNameLabel: "queue_length",
+		"instance":      "1.2.3.4",
+		"path":          `C:\DIR\`,
+		"msg":           "say \"hi\"\n",
+	}
+	if !reflect.DeepEqual(last.labels, expectedLabels) || !math.IsNaN(last.value) {
+		t.Errorf("Unexpected sample %+v", last)
+	}
+}
+
+func TestParseMetricText_OverlappingFamilies(t *testing.T) {
+	text := `# TYPE tasks summary
+tasks_sum 12
+tasks_count 4
+tasks_created 1.6e9
+# TYPE tasks_count counter
+tasks_count_total 7
+tasks_count_created 1.6e9
+# EOF
+`
+	samples, err := parseMetricText(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("parseMetricText() error = %v", err)
+	}
+
+	// The series belong to the longest family declared so far which they are named after
+	expectedTypes := map[string]string{
+		"tasks_sum":           metricTypeSummary,
+		"tasks_count":         metricTypeSummary,
+		"tasks_created":       metricTypeSummary,
+		"tasks_count_total":   metricTypeCounter,
+		"tasks_count_created": metricTypeCounter,
+	}
+	if len(samples) != len(expectedTypes) {
+		t.Fatalf("Expected %d samples but got %d", len(expectedTypes), len(samples))
+	}
+	for _, s := range samples {
+		name := s.labels[metricNameLabel]
+		if s.metricType != expectedTypes[name] {
+			t.Errorf("Expected type %s of %s but got %s", expectedTypes[name], name, s.metricType)
+		}
+	}
+}
+
+func TestParseMetricText_Invalid(t *testing.T) {
+	tests := []string{
+		`http_requests_total{code="200" 1`,
+		`http_requests_total{code=~"200"} 1`,
+		`http_requests_total{code="200",code="400"} 1`,
+		`http_requests_total{code="\t"} 1`,
+		`http_requests_total abc`,
+		`http_requests_total 1 2 3`,
+		`0http_requests_total 1`,
+		"# TYPE foo bar",
+		"# TYPE foo histogram\nfoo_bucket 1",
+		"# EOF\nfoo 1",
+	}
+
+	for _, text := range tests {
+		if _, err := parseMetricText(strings.NewReader(text)); err == nil {
+			t.Errorf("Expected an error parsing %q", text)
+		}
+	}
+}
+
+func TestParseSelector(t *testing.T) {
+	labels := map[string]string{metricNameLabel: "http_requests_total", "code": "200", "method": "get"}
+
+	tests := map[string]bool{
+		`http_requests_total`:                                  true,
+		`http_requests_total{}`:                                true,
+		`http_requests_total{code="200"}`:                      true,
+		`http_requests_total{code!="200"}`:                     false,
+		`http_requests_total{code=~"2..", method!~"post|put"}`: true,
+		`http_requests_total{code=~"2"}`:                       false,
+		`{__name__=~"http_.*", job=""}`:                        true,
+		`http_requests{code="200"}`:                            false,
+	}
+
+	for expr, expected := range tests {
+		selector, err := parseSelector(expr)
+		if err != nil {
+			t.Errorf("parseSelector(%q) error = %v", expr, err)
+			continue
+		}
+		if selector.matches(labels) != expected {
+			t.Errorf("Expected %q matching %v to be %v", expr, labels, expected)
+		}
+	}
+
+	for _, expr := range []string{"", "{}", `rate(http_requests_total[1m])`, `foo{code=~"("}`} {
+		if _, err := parseSelector(expr); err == nil {
+			t.Errorf("Expected an error parsing selector %q", expr)
+		}
+	}
+}
+
+func TestScrapeExporter_Query(t *testing.T) {
+	body := scrapedText
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+	defer server.Close()
+
+	metricConf := conf.DefaultMetricConf()
+	entity := metricConf.Entities[0]
+	entity.UIDLabel = "instance"
+	entity.Commodities[0].Query = `http_requests_total{code="200"}`
+	entity.Commodities[1].Query = `rpc_duration_seconds{quantile="0.99"}`
+
+	s := NewScrapeExporter(server.URL, metricConf, http.DefaultClient)
+
+	metrics, err := s.Query(context.Background())
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+
+	expected := map[string]map[string]float64{
+		"1.2.3.4": {constant.TPS: 1027, constant.Latency: 76656},
+		"5.6.7.8": {constant.TPS: 10},
+	}
+	if len(metrics) != len(expected) {
+		t.Fatalf("Expected %d entities but got %d", len(expected), len(metrics))
+	}
+	for _, m := range metrics {
+		if m.Type != constant.ApplicationType || !reflect.DeepEqual(m.Metrics, expected[m.UID]) {
+			t.Errorf("Unexpected entity metric %+v", m)
+		}
+	}
+
+	// A parse failure fails the query
+	body = "http_requests_total{code=200} 1"
+	if _, err := s.Query(context.Background()); err == nil {
+		t.Errorf("Expected an error from a malformed response")
+	}
+}
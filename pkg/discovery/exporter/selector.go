@@ -0,0 +1,111 @@
+package exporter
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	matchEqual     = "="
+	matchNotEqual  = "!="
+	matchRegexp    = "=~"
+	matchNotRegexp = "!~"
+)
+
+// labelMatcher matches the value of a label
+type labelMatcher struct {
+	name  string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+func (m *labelMatcher) matches(labels map[string]string) bool {
+	// A missing label is matched as an empty value, the same as in PromQL
+	value := labels[m.name]
+
+	switch m.op {
+	case matchEqual:
+		return value == m.value
+	case matchNotEqual:
+		return value != m.value
+	case matchRegexp:
+		return m.re.MatchString(value)
+	case matchNotRegexp:
+		return !m.re.MatchString(value)
+	}
+
+	return false
+}
+
+// seriesSelector is a PromQL instant vector selector, e.g., http_requests_total{job="api",code=~"2.."}
+type seriesSelector struct {
+	expr     string
+	matchers []*labelMatcher
+}
+
+func parseSelector(expr string) (*seriesSelector, error) {
+	s := &lineScanner{line: strings.TrimSpace(expr)}
+
+	var matchers []*labelMatcher
+	if name := s.scanName(); name != "" {
+		matchers = append(matchers, &labelMatcher{name: metricNameLabel, op: matchEqual, value: name})
+	}
+
+	if s.peek() == '{' {
+		labelMatchers, err := s.scanLabels(true)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, labelMatchers...)
+	}
+
+	if s.peek() != 0 {
+		return nil, fmt.Errorf("%q is not a series selector", expr)
+	}
+
+	if len(matchers) == 0 {
+		return nil, fmt.Errorf("empty series selector %q", expr)
+	}
+
+	for _, m := range matchers {
+		if m.op != matchRegexp && m.op != matchNotRegexp {
+			continue
+		}
+		// The regular expressions are fully anchored as in PromQL
+		re, err := regexp.Compile("^(?:" + m.value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q in %q: %v", m.value, expr, err)
+		}
+		m.re = re
+	}
+
+	return &seriesSelector{
+		expr:     expr,
+		matchers: matchers,
+	}, nil
+}
+
+func (s *seriesSelector) matches(labels map[string]string) bool {
+	for _, m := range s.matchers {
+		if !m.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// metricName returns the metric name if the selector matches it exactly
+func (s *seriesSelector) metricName() string {
+	for _, m := range s.matchers {
+		if m.name == metricNameLabel && m.op == matchEqual {
+			return m.value
+		}
+	}
+	return ""
+}
+
+func (s *seriesSelector) String() string {
+	return s.expr
+}
@@ -0,0 +1,399 @@
+package exporter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	metricNameLabel = "__name__"
+
+	// The metric types of the text exposition and the OpenMetrics formats
+	metricTypeCounter        = "counter"
+	metricTypeGauge          = "gauge"
+	metricTypeHistogram      = "histogram"
+	metricTypeGaugeHistogram = "gaugehistogram"
+	metricTypeSummary        = "summary"
+	metricTypeInfo           = "info"
+	metricTypeStateSet       = "stateset"
+	metricTypeUntyped        = "untyped"
+	metricTypeUnknown        = "unknown"
+
+	bucketLabel   = "le"
+	quantileLabel = "quantile"
+)
+
+var knownMetricTypes = map[string]bool{
+	metricTypeCounter:        true,
+	metricTypeGauge:          true,
+	metricTypeHistogram:      true,
+	metricTypeGaugeHistogram: true,
+	metricTypeSummary:        true,
+	metricTypeInfo:           true,
+	metricTypeStateSet:       true,
+	metricTypeUntyped:        true,
+	metricTypeUnknown:        true,
+}
+
+// The suffixes of the series that belong to a metric family of the given types
+var familySuffixes = map[string][]string{
+	metricTypeCounter:        {"_total", "_created"},
+	metricTypeHistogram:      {"_bucket", "_sum", "_count", "_created"},
+	metricTypeGaugeHistogram: {"_bucket", "_gsum", "_gcount"},
+	metricTypeSummary:        {"_sum", "_count", "_created"},
+	metricTypeInfo:           {"_info"},
+}
+
+// scrapedSample is a sample of a series parsed from a metrics endpoint
+type scrapedSample struct {
+	// The labels of the series, including the metric name as label __name__
+	labels map[string]string
+	value  float64
+	// The type of the metric family which the series belongs to
+	metricType string
+}
+
+// parseMetricText parses the samples in the Prometheus text exposition format or the OpenMetrics text format
+func parseMetricText(r io.Reader) ([]*scrapedSample, error) {
+	p := &textParser{
+		types: make(map[string]string),
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		if p.eof {
+			return nil, fmt.Errorf("line %d: unexpected content after # EOF", lineNum)
+		}
+		if err := p.parseLine(scanner.Text()); err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return p.samples, nil
+}
+
+type textParser struct {
+	// The declared metric types keyed by metric family names
+	types   map[string]string
+	samples []*scrapedSample
+	eof     bool
+}
+
+func (p *textParser) parseLine(line string) error {
+	line = strings.TrimSpace(line)
+
+	if line == "" {
+		return nil
+	}
+
+	if strings.HasPrefix(line, "#") {
+		return p.parseComment(line)
+	}
+
+	return p.parseSample(line)
+}
+
+func (p *textParser) parseComment(line string) error {
+	fields := strings.Fields(strings.TrimPrefix(line, "#"))
+
+	if len(fields) == 1 && fields[0] == "EOF" {
+		p.eof = true
+		return nil
+	}
+
+	if len(fields) < 2 {
+		return nil
+	}
+
+	switch fields[0] {
+	case "TYPE":
+		if len(fields) != 3 {
+			return fmt.Errorf("malformed TYPE line %q", line)
+		}
+		name, metricType := fields[1], strings.ToLower(fields[2])
+		if !knownMetricTypes[metricType] {
+			return fmt.Errorf("unknown metric type %q of %s", fields[2], name)
+		}
+		if _, exists := p.types[name]; exists {
+			return fmt.Errorf("duplicate TYPE line of %s", name)
+		}
+		p.types[name] = metricType
+	case "HELP", "UNIT":
+		if !isValidMetricName(fields[1]) {
+			return fmt.Errorf("invalid metric name %q", fields[1])
+		}
+	}
+
+	// Other comments are ignored
+	return nil
+}
+
+func (p *textParser) parseSample(line string) error {
+	s := &lineScanner{line: line}
+
+	name := s.scanName()
+	if !isValidMetricName(name) {
+		return fmt.Errorf("invalid metric name in %q", line)
+	}
+
+	labels := map[string]string{}
+	if s.peek() == '{' {
+		matchers, err := s.scanLabels(false)
+		if err != nil {
+			return err
+		}
+		for _, m := range matchers {
+			if _, exists := labels[m.name]; exists {
+				return fmt.Errorf("duplicate label %s in %q", m.name, line)
+			}
+			labels[m.name] = m.value
+		}
+	}
+	labels[metricNameLabel] = name
+
+	// The value, followed by an optional timestamp and an optional OpenMetrics exemplar
+	rest := s.rest()
+	if i := strings.Index(rest, "#"); i >= 0 {
+		rest = rest[:i]
+	}
+	fields := strings.Fields(rest)
+	if len(fields) < 1 || len(fields) > 2 {
+		return fmt.Errorf("malformed sample %q", line)
+	}
+
+	value, err := parseSampleValue(fields[0])
+	if err != nil {
+		return fmt.Errorf("invalid value %q of %s: %v", fields[0], name, err)
+	}
+
+	if len(fields) == 2 {
+		if _, err := strconv.ParseFloat(fields[1], 64); err != nil {
+			return fmt.Errorf("invalid timestamp %q of %s", fields[1], name)
+		}
+	}
+
+	metricType := p.metricType(name)
+	switch metricType {
+	case metricTypeHistogram, metricTypeGaugeHistogram:
+		if strings.HasSuffix(name, "_bucket") {
+			if _, ok := labels[bucketLabel]; !ok {
+				return fmt.Errorf("histogram bucket %s without label %s", name, bucketLabel)
+			}
+		}
+	case metricTypeSummary:
+		if q, ok := labels[quantileLabel]; ok {
+			if _, err := parseSampleValue(q); err != nil {
+				return fmt.Errorf("invalid quantile %q of %s", q, name)
+			}
+		}
+	}
+
+	p.samples = append(p.samples, &scrapedSample{
+		labels:     labels,
+		value:      value,
+		metricType: metricType,
+	})
+
+	return nil
+}
+
+// metricType returns the declared type of the metric family which the named series belongs to
+func (p *textParser) metricType(name string) string {
+	if t, ok := p.types[name]; ok {
+		return t
+	}
+
+	// The longest family comes first, e.g., tasks_count_total is of the counter tasks_count rather than of
+	// the summary tasks
+	for i := len(name) - 1; i > 0; i-- {
+		if name[i] != '_' {
+			continue
+		}
+		t, ok := p.types[name[:i]]
+		if !ok {
+			continue
+		}
+		for _, suffix := range familySuffixes[t] {
+			if name[i:] == suffix {
+				return t
+			}
+		}
+	}
+
+	return metricTypeUntyped
+}
+
+func parseSampleValue(s string) (float64, error) {
+	switch s {
+	case "+Inf", "Inf":
+		return strconv.ParseFloat("+Inf", 64)
+	case "-Inf":
+		return strconv.ParseFloat("-Inf", 64)
+	case "NaN":
+		return strconv.ParseFloat("NaN", 64)
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+func isValidMetricName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		if !isNameChar(c, i == 0, true) {
+			return false
+		}
+	}
+	return true
+}
+
+func isNameChar(c rune, first, allowColon bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+		(allowColon && c == ':') || (!first && c >= '0' && c <= '9')
+}
+
+// lineScanner scans the metric names and label sets shared by the exposition formats and the series selectors
+type lineScanner struct {
+	line string
+	pos  int
+}
+
+func (s *lineScanner) skipSpaces() {
+	for s.pos < len(s.line) && (s.line[s.pos] == ' ' || s.line[s.pos] == '\t') {
+		s.pos++
+	}
+}
+
+func (s *lineScanner) peek() byte {
+	s.skipSpaces()
+	if s.pos >= len(s.line) {
+		return 0
+	}
+	return s.line[s.pos]
+}
+
+func (s *lineScanner) rest() string {
+	return s.line[s.pos:]
+}
+
+func (s *lineScanner) scanName() string {
+	s.skipSpaces()
+	start := s.pos
+	for s.pos < len(s.line) && isNameChar(rune(s.line[s.pos]), s.pos == start, true) {
+		s.pos++
+	}
+	return s.line[start:s.pos]
+}
+
+func (s *lineScanner) scanLabelName() string {
+	s.skipSpaces()
+	start := s.pos
+	for s.pos < len(s.line) && isNameChar(rune(s.line[s.pos]), s.pos == start, false) {
+		s.pos++
+	}
+	return s.line[start:s.pos]
+}
+
+// scanLabels scans a label set enclosed in braces. If withOperators is true, the label
+// matching operators of the series selector (=, !=, =~, !~) are allowed; otherwise only '='.
+func (s *lineScanner) scanLabels(withOperators bool) ([]*labelMatcher, error) {
+	if s.peek() != '{' {
+		return nil, fmt.Errorf("expected '{' at position %d of %q", s.pos, s.line)
+	}
+	s.pos++
+
+	var matchers []*labelMatcher
+	for {
+		if s.peek() == '}' {
+			s.pos++
+			return matchers, nil
+		}
+
+		name := s.scanLabelName()
+		if name == "" {
+			return nil, fmt.Errorf("invalid label name at position %d of %q", s.pos, s.line)
+		}
+
+		op, err := s.scanOperator(withOperators)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := s.scanQuoted()
+		if err != nil {
+			return nil, err
+		}
+
+		matchers = append(matchers, &labelMatcher{name: name, op: op, value: value})
+
+		switch s.peek() {
+		case ',':
+			s.pos++
+		case '}':
+		default:
+			return nil, fmt.Errorf("expected ',' or '}' at position %d of %q", s.pos, s.line)
+		}
+	}
+}
+
+func (s *lineScanner) scanOperator(withOperators bool) (string, error) {
+	s.skipSpaces()
+	for _, op := range []string{matchRegexp, matchNotEqual, matchNotRegexp, matchEqual} {
+		if strings.HasPrefix(s.line[s.pos:], op) {
+			if op != matchEqual && !withOperators {
+				break
+			}
+			s.pos += len(op)
+			return op, nil
+		}
+	}
+	return "", fmt.Errorf("expected '=' at position %d of %q", s.pos, s.line)
+}
+
+// scanQuoted scans a double-quoted label value with the escape sequences \\, \" and \n
+func (s *lineScanner) scanQuoted() (string, error) {
+	if s.peek() != '"' {
+		return "", fmt.Errorf("expected '\"' at position %d of %q", s.pos, s.line)
+	}
+	s.pos++
+
+	var b bytes.Buffer
+	for s.pos < len(s.line) {
+		c := s.line[s.pos]
+		s.pos++
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if s.pos >= len(s.line) {
+				return "", fmt.Errorf("unterminated escape sequence in %q", s.line)
+			}
+			e := s.line[s.pos]
+			s.pos++
+			switch e {
+			case '\\', '"':
+				b.WriteByte(e)
+			case 'n':
+				b.WriteByte('\n')
+			default:
+				return "", fmt.Errorf("invalid escape sequence \\%c in %q", e, s.line)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return "", fmt.Errorf("unterminated label value in %q", s.line)
+}
@@ -1,10 +1,23 @@
 package exporter
 
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// EntityMetric is the metrics of an entity, keyed by the metric names declared in the metric config
 type EntityMetric struct {
-	UID     string             `json:"uid,omitempty"`
+	UID string `json:"uid,omitempty"`
+	// The Turbo entity type, i.e., the value of proto.EntityDTO_EntityType
 	Type    int32              `json:"type,omitempty"`
 	Labels  map[string]string  `json:"labels,omitempty"`
 	Metrics map[string]float64 `json:"metrics,omitempty"`
+	// The units of the metrics reported by the exporter, which override the units in the metric config
+	Units map[string]string `json:"units,omitempty"`
+	// The metrics of the calls to other entities of the same type, keyed by the UIDs of the called entities
+	// and then by the metric names, i.e., tps and latency
+	Calls map[string]map[string]float64 `json:"calls,omitempty"`
 }
 
 type MetricResponse struct {
@@ -12,3 +25,72 @@ type MetricResponse struct {
 	Message string          `json:"message:omitemtpy"`
 	Data    []*EntityMetric `json:"data:omitempty"`
 }
+
+// promResponse is the response of the Prometheus HTTP API
+type promResponse struct {
+	Status    string   `json:"status"`
+	Data      promData `json:"data,omitempty"`
+	ErrorType string   `json:"errorType,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+type promData struct {
+	ResultType string          `json:"resultType"`
+	Result     json.RawMessage `json:"result"`
+}
+
+// promMetadataResponse is the response of the metadata API of Prometheus, keyed by metric names
+type promMetadataResponse struct {
+	Status    string                    `json:"status"`
+	Data      map[string][]promMetadata `json:"data,omitempty"`
+	ErrorType string                    `json:"errorType,omitempty"`
+	Error     string                    `json:"error,omitempty"`
+}
+
+type promMetadata struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+// promSeries is an element of a vector (with Value) or a matrix (with Values) result
+type promSeries struct {
+	Metric map[string]string `json:"metric"`
+	Value  *promPoint        `json:"value,omitempty"`
+	Values []promPoint       `json:"values,omitempty"`
+}
+
+// promPoint is a sample encoded as [<unix_time>, "<value>"]
+type promPoint struct {
+	Timestamp float64
+	Value     float64
+}
+
+func (p *promPoint) UnmarshalJSON(b []byte) error {
+	var raw []interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if len(raw) != 2 {
+		return fmt.Errorf("invalid sample %s", string(b))
+	}
+
+	ts, ok := raw[0].(float64)
+	if !ok {
+		return fmt.Errorf("invalid sample timestamp %v", raw[0])
+	}
+
+	str, ok := raw[1].(string)
+	if !ok {
+		return fmt.Errorf("invalid sample value %v", raw[1])
+	}
+	value, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return fmt.Errorf("invalid sample value %v: %v", str, err)
+	}
+
+	p.Timestamp = ts
+	p.Value = value
+
+	return nil
+}
@@ -1,9 +1,12 @@
 package pkg
 
 import (
+	"context"
+	"fmt"
 	"github.com/golang/glog"
 	"github.com/turbonomic/prometurbo/pkg/conf"
 	"github.com/turbonomic/prometurbo/pkg/discovery"
+	"github.com/turbonomic/prometurbo/pkg/discovery/dtofactory"
 	"github.com/turbonomic/prometurbo/pkg/discovery/exporter"
 	"github.com/turbonomic/prometurbo/pkg/registration"
 	"github.com/turbonomic/turbo-go-sdk/pkg/probe"
@@ -16,27 +19,41 @@ import (
 
 type disconnectFromTurboFunc func()
 
+// The interval of polling the readiness of the metric exporters at startup
+const readinessPollInterval = 5 * time.Second
+
 type P8sTAPService struct {
-	tapService *service.TAPService
+	tapService      *service.TAPService
+	metricExporters []exporter.MetricExporter
+	// The exporters receiving the metrics pushed to prometurbo, which are also in metricExporters
+	metricReceivers  []exporter.MetricReceiver
+	readinessTimeout time.Duration
+	readinessPolicy  string
 }
 
 func NewP8sTAPService(args *conf.PrometurboArgs) (*P8sTAPService, error) {
-	tapService, err := createTAPService(args)
+	p, err := createTAPService(args)
 
 	if err != nil {
 		glog.Errorf("Error while building turbo TAP service on target %v", err)
 		return nil, err
 	}
 
-	return &P8sTAPService{tapService}, nil
+	return p, nil
 }
 
 func (p *P8sTAPService) Start() {
 	glog.V(0).Infof("Starting prometheus TAP service...")
 
-	// Before running service, wait for the exporter to start up
-	// TODO: Check the readiness of the exporter
-	time.Sleep(5 * time.Second)
+	// Start receiving the metrics pushed to prometurbo
+	for _, receiver := range p.metricReceivers {
+		if err := receiver.Start(); err != nil {
+			glog.Fatalf("Failed to start the metric receiver %v: %v", receiver, err)
+		}
+	}
+
+	// Before running service, wait for the exporters to start up
+	p.waitForExporters()
 
 	// Disconnect from Turbo server when Kubeturbo is shutdown
 	handleExit(func() { p.tapService.DisconnectFromTurbo() })
@@ -47,12 +64,70 @@ func (p *P8sTAPService) Start() {
 	select {}
 }
 
-func createTAPService(args *conf.PrometurboArgs) (*service.TAPService, error) {
+// waitForExporters waits until the metric exporters are ready or the readiness timeout expires,
+// and exits if not all exporters are ready with the all policy; otherwise it starts in degraded mode,
+// as the exporters not ready yet are queried again in each discovery
+func (p *P8sTAPService) waitForExporters() {
+	if p.readinessPolicy == conf.ReadinessPolicyNone {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.readinessTimeout)
+	defer cancel()
+
+	notReady := exporter.WaitUntilReady(ctx, p.metricExporters, readinessPollInterval)
+	if len(notReady) == 0 {
+		glog.Infof("All %d metric exporters are ready", len(p.metricExporters))
+		return
+	}
+
+	for _, metricExporter := range notReady {
+		glog.Warningf("Metric exporter %v is not ready after %v", metricExporter, p.readinessTimeout)
+	}
+
+	if p.readinessPolicy == conf.ReadinessPolicyAll {
+		glog.Fatalf("%d of %d metric exporters are not ready", len(notReady), len(p.metricExporters))
+	}
+
+	if len(notReady) == len(p.metricExporters) {
+		glog.Errorf("Starting in degraded mode with none of the %d metric exporters ready",
+			len(p.metricExporters))
+		return
+	}
+
+	glog.Warningf("Starting in degraded mode with %d of %d metric exporters ready",
+		len(p.metricExporters)-len(notReady), len(p.metricExporters))
+}
+
+func createTAPService(args *conf.PrometurboArgs) (*P8sTAPService, error) {
+	switch *args.ReadinessPolicy {
+	case conf.ReadinessPolicyAll, conf.ReadinessPolicyAny, conf.ReadinessPolicyNone:
+	default:
+		return nil, fmt.Errorf("unsupported exporter readiness policy %s", *args.ReadinessPolicy)
+	}
+
 	confPath := conf.DefaultConfPath
+	metricConfPath := conf.DefaultMetricConfPath
 
 	if os.Getenv("PROMETURBO_LOCAL_DEBUG") == "1" {
 		confPath = conf.LocalDebugConfPath
-		glog.V(2).Infof("Using config file %s for local debugging", confPath)
+		metricConfPath = conf.LocalDebugMetricConfPath
+		glog.V(2).Infof("Using config files %s and %s for local debugging", confPath, metricConfPath)
+	}
+
+	metricConf, err := conf.NewMetricConf(metricConfPath)
+	if err != nil {
+		glog.Errorf("Error while parsing the metric config file %s: %v", metricConfPath, err)
+		os.Exit(1)
+	}
+
+	if *args.SLODir != "" {
+		slos, err := conf.NewSLOs(*args.SLODir)
+		if err != nil {
+			glog.Errorf("Error while loading the SLOs from %s: %v", *args.SLODir, err)
+			os.Exit(1)
+		}
+		metricConf.SLOs = slos
 	}
 
 	conf, err := conf.NewPrometurboConf(confPath)
@@ -66,25 +141,101 @@ func createTAPService(args *conf.PrometurboArgs) (*service.TAPService, error) {
 	communicator := conf.Communicator
 	targetAddr := conf.TargetConf.Address
 	scope := conf.TargetConf.Scope
-	metricExporters := []exporter.MetricExporter{exporter.NewMetricExporter(conf.MetricExporterEndpoint)}
+	window := time.Duration(*args.DiscoveryIntervalSec) * time.Second
+	timeout := time.Duration(*args.DiscoveryTimeoutSec) * time.Second
+	retry := &exporter.RetryPolicy{
+		MaxRetries: *args.ExporterMaxRetries,
+		Backoff:    time.Duration(*args.ExporterRetryBackoffMs) * time.Millisecond,
+	}
 
-	registrationClient := &registration.P8sRegistrationClient{}
-	discoveryClient := discovery.NewDiscoveryClient(targetAddr, scope, metricExporters)
+	var metricExporters []exporter.MetricExporter
+	var metricReceivers []exporter.MetricReceiver
+	for _, exporterConf := range conf.MetricExporters {
+		if !exporterConf.IsEnabled() {
+			glog.V(2).Infof("Skipping the disabled metric exporter %s", exporterConf.Name)
+			continue
+		}
 
-	return service.NewTAPServiceBuilder().
+		metricExporter, err := createMetricExporter(exporterConf, metricConf, window, retry)
+		if err != nil {
+			return nil, err
+		}
+		if receiver, ok := metricExporter.(exporter.MetricReceiver); ok {
+			metricReceivers = append(metricReceivers, receiver)
+		}
+
+		cacheTTL, ok := exporterConf.MetricCacheTTL()
+		if !ok {
+			cacheTTL = time.Duration(*args.ExporterCacheTTLSec) * time.Second
+		}
+		if cacheTTL > 0 {
+			metricExporter = exporter.NewCachedExporter(metricExporter, cacheTTL)
+		}
+
+		metricExporters = append(metricExporters, exporter.NewConfiguredExporter(exporterConf.Name, metricExporter,
+			exporterConf.QueryTimeout(), exporterConf.Scope))
+	}
+
+	registrationClient := registration.NewP8sRegistrationClient(metricConf)
+	history := dtofactory.NewCapacityHistory(*args.CapacityHistoryFile)
+	discoveryClient := discovery.NewDiscoveryClient(targetAddr, scope, metricExporters, metricConf, timeout,
+		*args.ExporterConcurrency, history)
+
+	tapService, err := service.NewTAPServiceBuilder().
 		WithTurboCommunicator(communicator).
 		WithTurboProbe(probe.NewProbeBuilder(registration.TargetType, registration.ProbeCategory).
 			WithDiscoveryOptions(probe.FullRediscoveryIntervalSecondsOption(int32(*args.DiscoveryIntervalSec))).
 			RegisteredBy(registrationClient).
 			DiscoversTarget(targetAddr, discoveryClient)).
 		Create()
+	if err != nil {
+		return nil, err
+	}
+
+	return &P8sTAPService{
+		tapService:       tapService,
+		metricExporters:  metricExporters,
+		metricReceivers:  metricReceivers,
+		readinessTimeout: time.Duration(*args.ReadinessTimeoutSec) * time.Second,
+		readinessPolicy:  *args.ReadinessPolicy,
+	}, nil
+}
+
+// createMetricExporter creates the exporter of the configured type
+func createMetricExporter(exporterConf *conf.ExporterConf, metricConf *conf.MetricConf,
+	window time.Duration, retry *exporter.RetryPolicy) (exporter.MetricExporter, error) {
+	endpoint := exporterConf.Endpoint
+	glog.V(2).Infof("Using the %s exporter %s at %s", exporterConf.Type, exporterConf.Name, endpoint)
+
+	if exporterConf.Type == conf.RemoteWriteReceiverType {
+		// Keep the received samples for two discovery intervals in case a discovery is delayed
+		return exporter.NewRemoteWriteReceiver(endpoint, 2*window, metricConf), nil
+	}
+
+	client, err := exporter.NewHTTPClient(exporterConf.Auth, retry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the http client of the metric exporter %s: %v", exporterConf.Name, err)
+	}
+
+	switch exporterConf.Type {
+	case conf.PrometheusExporterType:
+		return exporter.NewPrometheusExporter(endpoint, window, metricConf, client), nil
+	case conf.AppMetricExporterType:
+		return exporter.NewMetricExporter(endpoint, client), nil
+	case conf.ScrapeExporterType:
+		return exporter.NewScrapeExporter(endpoint, metricConf, client), nil
+	case conf.RemoteReadExporterType:
+		return exporter.NewRemoteReadExporter(endpoint, window, metricConf, client), nil
+	}
+
+	return nil, fmt.Errorf("unsupported type %s of metric exporter %s", exporterConf.Type, exporterConf.Name)
 }
 
 // TODO: Move the handle to turbo-sdk-probe as it should be common logic for similar probes
 // handleExit disconnects the tap service from Turbo service when prometurbo is terminated
 func handleExit(disconnectFunc disconnectFromTurboFunc) {
 	glog.V(4).Infof("*** Handling Prometurbo Termination ***")
-	sigChan := make(chan os.Signal)
+	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan,
 		os.Interrupt,
 		syscall.SIGTERM,
@@ -2,6 +2,7 @@ package registration
 
 import (
 	"github.com/golang/glog"
+	"github.com/turbonomic/prometurbo/pkg/conf"
 	"github.com/turbonomic/turbo-go-sdk/pkg/builder"
 	"github.com/turbonomic/turbo-go-sdk/pkg/proto"
 )
@@ -15,15 +16,22 @@ const (
 
 // Implements the TurboRegistrationClient interface
 type P8sRegistrationClient struct {
+	metricConf *conf.MetricConf
+}
+
+func NewP8sRegistrationClient(metricConf *conf.MetricConf) *P8sRegistrationClient {
+	return &P8sRegistrationClient{
+		metricConf: metricConf,
+	}
 }
 
 func (p *P8sRegistrationClient) GetSupplyChainDefinition() []*proto.TemplateDTO {
 	glog.Infoln("Building a supply chain ..........")
 
-	supplyChainFactory := &SupplyChainFactory{}
+	supplyChainFactory := NewSupplyChainFactory(p.metricConf)
 	templateDtos, err := supplyChainFactory.CreateSupplyChain()
 	if err != nil {
-		glog.Error("Error creating Supply chain for Prometurbo")
+		glog.Errorf("Error creating Supply chain for Prometurbo: %v", err)
 		return nil
 	}
 	glog.Infoln("Supply chain for Prometurbo is created.")
@@ -1,45 +1,133 @@
 package registration
 
 import (
+	"fmt"
+	"github.com/turbonomic/prometurbo/pkg/conf"
 	"github.com/turbonomic/turbo-go-sdk/pkg/proto"
 	"github.com/turbonomic/turbo-go-sdk/pkg/supplychain"
 )
 
 var (
-	respTimeType    = proto.CommodityDTO_RESPONSE_TIME
-	transactionType = proto.CommodityDTO_TRANSACTION
-	key             = "key-placeholder"
+	key = "key-placeholder"
+)
 
-	respTimeTemplateComm *proto.TemplateCommodity = &proto.TemplateCommodity{
-		CommodityType: &respTimeType,
-		Key:           &key,
+type SupplyChainFactory struct {
+	metricConf *conf.MetricConf
+}
+
+func NewSupplyChainFactory(metricConf *conf.MetricConf) *SupplyChainFactory {
+	return &SupplyChainFactory{
+		metricConf: metricConf,
 	}
+}
 
-	transactionTemplateComm *proto.TemplateCommodity = &proto.TemplateCommodity{
-		CommodityType: &transactionType,
-		Key:           &key,
+// CreateSupplyChain builds a supply chain node for each entity type declared in the metric config
+func (f *SupplyChainFactory) CreateSupplyChain() ([]*proto.TemplateDTO, error) {
+	if len(f.metricConf.Entities) == 0 {
+		return nil, fmt.Errorf("no entity is defined in the metric config")
 	}
-)
 
-type SupplyChainFactory struct{}
+	var nodes []*proto.TemplateDTO
 
-func (f *SupplyChainFactory) CreateSupplyChain() ([]*proto.TemplateDTO, error) {
-	appNode, err := f.buildAppSupplyBuilder()
-	if err != nil {
-		return nil, err
+	// The virtual applications of the services are on top of their applications
+	if f.metricConf.ServiceLabel() != "" {
+		node, err := f.buildVirtualAppSupplyBuilder()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+
+	for _, entityConf := range f.metricConf.Entities {
+		node, err := f.buildSupplyBuilder(entityConf)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+
+	scBuilder := supplychain.NewSupplyChainBuilder().Top(nodes[0])
+	for _, node := range nodes[1:] {
+		scBuilder.Entity(node)
 	}
 
-	return supplychain.NewSupplyChainBuilder().Top(appNode).
-		Create()
+	return scBuilder.Create()
+}
+
+// buildVirtualAppSupplyBuilder builds the node of the virtual applications, which sell the transactions and
+// the response times aggregated over the applications they buy from
+func (f *SupplyChainFactory) buildVirtualAppSupplyBuilder() (*proto.TemplateDTO, error) {
+	builder := supplychain.NewSupplyChainNodeBuilder(proto.EntityDTO_VIRTUAL_APPLICATION).
+		Sells(newTemplateComm(proto.CommodityDTO_TRANSACTION)).
+		Sells(newTemplateComm(proto.CommodityDTO_RESPONSE_TIME)).
+		Provider(proto.EntityDTO_APPLICATION, proto.Provider_LAYERED_OVER).
+		Buys(newTemplateComm(proto.CommodityDTO_TRANSACTION)).
+		Buys(newTemplateComm(proto.CommodityDTO_RESPONSE_TIME))
+
+	builder.SetPriority(-1)
+	builder.SetTemplateType(proto.TemplateDTO_BASE)
+
+	return builder.Create()
 }
 
-func (f *SupplyChainFactory) buildAppSupplyBuilder() (*proto.TemplateDTO, error) {
-	builder := supplychain.NewSupplyChainNodeBuilder(proto.EntityDTO_APPLICATION).
-		Sells(transactionTemplateComm).
-		Sells(respTimeTemplateComm)
+func (f *SupplyChainFactory) buildSupplyBuilder(entityConf *conf.EntityConf) (*proto.TemplateDTO, error) {
+	builder := supplychain.NewSupplyChainNodeBuilder(entityConf.EntityType())
+
+	soldTypes := make(map[proto.CommodityDTO_CommodityType]bool)
+	for _, commConf := range entityConf.Commodities {
+		commType := commConf.CommodityType()
+		if soldTypes[commType] {
+			continue
+		}
+		soldTypes[commType] = true
+
+		builder.Sells(newTemplateComm(commType))
+	}
+
+	// The applications buy the transactions and the response times from the applications they call,
+	// which sell the commodities of each call
+	if entityConf.EntityType() == proto.EntityDTO_APPLICATION && f.metricConf.CallGraph != nil {
+		for _, commType := range []proto.CommodityDTO_CommodityType{
+			proto.CommodityDTO_TRANSACTION,
+			proto.CommodityDTO_RESPONSE_TIME,
+		} {
+			if !soldTypes[commType] {
+				soldTypes[commType] = true
+				builder.Sells(newTemplateComm(commType))
+			}
+		}
+		builder.Provider(proto.EntityDTO_APPLICATION, proto.Provider_LAYERED_OVER).
+			Buys(newTemplateComm(proto.CommodityDTO_TRANSACTION)).
+			Buys(newTemplateComm(proto.CommodityDTO_RESPONSE_TIME))
+	}
+
+	// The entities buy the commodities sold by the entities hosting them
+	if provider := entityConf.Provider; provider != nil {
+		providerConf, ok := f.metricConf.Entity(provider.EntityType())
+		if !ok {
+			return nil, fmt.Errorf("provider type %s of entity type %s is not defined", provider.Type, entityConf.Type)
+		}
+		builder.Provider(provider.EntityType(), proto.Provider_HOSTING)
+		boughtTypes := make(map[proto.CommodityDTO_CommodityType]bool)
+		for _, commConf := range providerConf.Commodities {
+			commType := commConf.CommodityType()
+			if !boughtTypes[commType] {
+				boughtTypes[commType] = true
+				builder.Buys(newTemplateComm(commType))
+			}
+		}
+	}
+
 	builder.SetPriority(-1)
 	builder.SetTemplateType(proto.TemplateDTO_BASE)
 	//builder.SetTemplateType(proto.TemplateDTO_EXTENSION)
 
 	return builder.Create()
 }
+
+func newTemplateComm(commType proto.CommodityDTO_CommodityType) *proto.TemplateCommodity {
+	return &proto.TemplateCommodity{
+		CommodityType: &commType,
+		Key:           &key,
+	}
+}
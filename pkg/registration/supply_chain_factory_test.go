@@ -0,0 +1,83 @@
+package registration
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/turbonomic/prometurbo/pkg/conf"
+	"github.com/turbonomic/turbo-go-sdk/pkg/proto"
+)
+
+func TestSupplyChainFactory_CreateSupplyChain_CallGraph(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prometurbo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metrics.yaml")
+	if err := ioutil.WriteFile(path, []byte(`
+callGraph:
+  query: sum(rate(istio_requests_total[1m])) by (source_workload, destination_workload)
+entities:
+- type: APPLICATION
+  uidLabel: destination_workload
+  serviceLabel: destination_service
+  commodities:
+  - {name: tps, type: TRANSACTION, capacity: 100}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	metricConf, err := conf.NewMetricConf(path)
+	if err != nil {
+		t.Fatalf("NewMetricConf() error = %v", err)
+	}
+
+	templates, err := NewSupplyChainFactory(metricConf).CreateSupplyChain()
+	if err != nil {
+		t.Fatalf("CreateSupplyChain() error = %v", err)
+	}
+
+	// The applications are layered over the applications they call, besides the virtual applications layered over
+	// the applications
+	expected := []*proto.TemplateDTO{
+		newTemplate(proto.EntityDTO_VIRTUAL_APPLICATION, proto.EntityDTO_APPLICATION),
+		newTemplate(proto.EntityDTO_APPLICATION, proto.EntityDTO_APPLICATION),
+	}
+	if !reflect.DeepEqual(templates, expected) {
+		t.Errorf("CreateSupplyChain() = %v, want %v", templates, expected)
+	}
+}
+
+// newTemplate returns the base template of the entity type selling the transactions and the response times,
+// and buying them from the provider type layered under it
+func newTemplate(entityType, providerType proto.EntityDTO_EntityType) *proto.TemplateDTO {
+	templateType := proto.TemplateDTO_BASE
+	priority := int32(-1)
+	layeredOver := proto.Provider_LAYERED_OVER
+	maxCardinality := int32(math.MaxInt32)
+	minCardinality := int32(0)
+	comms := []*proto.TemplateCommodity{
+		newTemplateComm(proto.CommodityDTO_TRANSACTION),
+		newTemplateComm(proto.CommodityDTO_RESPONSE_TIME),
+	}
+
+	return &proto.TemplateDTO{
+		TemplateClass:    &entityType,
+		TemplateType:     &templateType,
+		TemplatePriority: &priority,
+		CommoditySold:    comms,
+		CommodityBought: []*proto.TemplateDTO_CommBoughtProviderProp{{
+			Key: &proto.Provider{
+				TemplateClass:  &providerType,
+				ProviderType:   &layeredOver,
+				CardinalityMax: &maxCardinality,
+				CardinalityMin: &minCardinality,
+			},
+			Value: comms,
+		}},
+	}
+}